@@ -1,29 +1,74 @@
 // The backend command runs the backend web server.
+//
+// With -migrate, it applies or reverts the database migrations instead and
+// exits. The server refuses to start until every migration has been applied.
 package main
 
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 
 	"github.com/google/safehtml/template"
 	"github.com/jessesomerville/yodahunters/internal/envconfig"
+	"github.com/jessesomerville/yodahunters/internal/pg"
 	"github.com/jessesomerville/yodahunters/internal/server"
+	"github.com/jessesomerville/yodahunters/migrations"
 )
 
 var (
 	addr    = flag.String("addr", ":"+envconfig.GetEnvOrDefault("PORT", "8080"), "the address for the server to listen on")
 	devmode = flag.Bool("devmode", false, "enable devmode (reload templates on each page load)")
+	migrate = flag.String("migrate", "", `apply every migration ("up") or revert the newest one ("down"), then exit`)
 )
 
 func main() {
 	flag.Parse()
 
+	ctx := context.Background()
+	if *migrate != "" {
+		if err := runMigrations(ctx, *migrate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	staticSrc := template.TrustedSourceFromConstant("templates")
 	cfg := server.Config{
 		Address:    *addr,
 		TemplateFS: template.TrustedFSFromTrustedSource(staticSrc),
 		DevMode:    *devmode,
 	}
-	log.Fatal(server.Run(context.Background(), cfg))
+	log.Fatal(server.Run(ctx, cfg))
+}
+
+func runMigrations(ctx context.Context, direction string) error {
+	dbClient, err := pg.NewClient(ctx, pg.DatabaseName())
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close(ctx)
+
+	m, err := pg.NewMigrator(dbClient, migrations.FS)
+	if err != nil {
+		return err
+	}
+	switch direction {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		err = m.Down(ctx, 1)
+	default:
+		return fmt.Errorf(`-migrate must be "up" or "down", not %q`, direction)
+	}
+	if err != nil {
+		return err
+	}
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Database schema is at version %d", version)
+	return nil
 }
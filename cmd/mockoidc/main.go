@@ -0,0 +1,36 @@
+// The mockoidc command runs a mock OpenID Connect provider for trying out
+// logging in with an identity provider locally. Every login is approved
+// without asking anything, as the user given by the flags.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/jessesomerville/yodahunters/internal/oidc/oidctest"
+)
+
+var (
+	addr         = flag.String("addr", "localhost:8081", "the address for the provider to listen on")
+	clientID     = flag.String("client_id", "yodahunters", "the client ID the backend is configured with")
+	clientSecret = flag.String("client_secret", "mock-secret", "the client secret the backend is configured with")
+	username     = flag.String("username", "yoda", "the username of the user every login is for")
+)
+
+func main() {
+	flag.Parse()
+
+	provider, err := oidctest.New(*clientID, *clientSecret, oidctest.Identity{
+		Subject:           "mock|" + *username,
+		Email:             *username + "@example.com",
+		EmailVerified:     true,
+		PreferredUsername: *username,
+		Name:              *username,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Serving mock OIDC provider at http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, provider))
+}
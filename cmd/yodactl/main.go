@@ -0,0 +1,479 @@
+// The yodactl command administers the forum directly through its database,
+// for the tasks that would otherwise need psql, like creating the first admin
+// and category of a new forum.
+//
+// Usage:
+//
+//	yodactl <group> <command> [flags] [args]
+//
+// Run yodactl without arguments to list the commands. It connects to the
+// database configured by the same YODAHUNTERS_DATABASE_* environment
+// variables as the backend.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/migrations"
+)
+
+// A command is one of yodactl's subcommands. run defines its flags on fs,
+// then calls ctl.parse with the arguments before doing anything else.
+type command struct {
+	group, name string
+	// args describes the positional arguments, for the usage message.
+	args string
+	help string
+	run  func(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"users", "list", "", "list every user", usersList},
+	{"users", "create", "<username>", "create a user with a random password", usersCreate},
+	{"users", "promote", "<username>", "change a user's role", usersPromote},
+	{"users", "ban", "<username>", "stop a user from logging in and log them out", usersBan},
+	{"users", "unban", "<username>", "let a banned user log in again", usersUnban},
+	{"users", "reset-password", "<username>", "give a user a new random password and log them out", usersResetPassword},
+	{"categories", "list", "", "list every category", categoriesList},
+	{"categories", "create", "<title>", "create a category", categoriesCreate},
+	{"keys", "list", "", "list every registration key", keysList},
+	{"keys", "create", "", "mint registration keys", keysCreate},
+	{"keys", "revoke", "<key>", "delete a registration key that hasn't been used", keysRevoke},
+	{"threads", "pin", "<thread id>", "pin a thread", threadsSetFlag(setPinned, true)},
+	{"threads", "unpin", "<thread id>", "unpin a thread", threadsSetFlag(setPinned, false)},
+	{"threads", "lock", "<thread id>", "lock a thread", threadsSetFlag(setLocked, true)},
+	{"threads", "unlock", "<thread id>", "unlock a thread", threadsSetFlag(setLocked, false)},
+	{"threads", "move", "<thread id> <category id>", "move a thread to another category", threadsMove},
+	{"migrate", "up", "", "apply every migration the database doesn't have", migrateUp},
+	{"migrate", "down", "", "revert the newest migrations", migrateDown},
+	{"migrate", "version", "", "print the version the database is at", migrateVersion},
+	{"migrate", "force", "<version>", "set the version after fixing a failed migration by hand", migrateForce},
+}
+
+// errUsage is returned when a command is run with the wrong arguments, after
+// its usage message has been printed.
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	i := -1
+	for j, cmd := range commands {
+		if cmd.group == flag.Arg(0) && cmd.name == flag.Arg(1) {
+			i = j
+		}
+	}
+	if i < 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd := commands[i]
+
+	fs := flag.NewFlagSet("yodactl "+cmd.group+" "+cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] %s\n\n%s\n", fs.Name(), cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	ctx := context.Background()
+	c := &ctl{}
+	err := cmd.run(ctx, c, fs, flag.Args()[2:])
+	c.close(ctx)
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: yodactl <group> <command> [flags] [args]\n\n")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s %s\t%s\n", cmd.group, cmd.name, cmd.args, cmd.help)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nRun yodactl <group> <command> -h for a command's flags.\n")
+}
+
+// ctl holds what the commands share: the database client, which is only
+// connected once a command's arguments have been parsed, so usage mistakes
+// don't need a database.
+type ctl struct {
+	dbClient *pg.Client
+	admin    *server.Admin
+}
+
+// parse parses the command's flags and checks that it has n positional
+// arguments, which it returns, then connects to the database.
+func (c *ctl) parse(ctx context.Context, fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.Parse(args)
+	if fs.NArg() != n {
+		fs.Usage()
+		return nil, errUsage
+	}
+	dbClient, err := pg.NewClient(ctx, pg.DatabaseName())
+	if err != nil {
+		return nil, err
+	}
+	c.dbClient = dbClient
+	c.admin = server.NewAdmin(dbClient)
+	return fs.Args(), nil
+}
+
+func (c *ctl) close(ctx context.Context) {
+	if c.dbClient != nil {
+		c.dbClient.Close(ctx)
+	}
+}
+
+// table writes rows of tab-separated columns to stdout, aligned.
+func table(header string, rows func(w *tabwriter.Writer)) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	rows(w)
+	w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.DateTime)
+}
+
+func parseID(name, s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return id, nil
+}
+
+func usersList(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	users, err := c.admin.Users(ctx)
+	if err != nil {
+		return err
+	}
+	table("ID\tUSERNAME\tEMAIL\tROLE\tBANNED\tCREATED", func(w *tabwriter.Writer) {
+		for _, u := range users {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Email, u.Role, formatTime(u.BannedAt), formatTime(&u.CreatedAt))
+		}
+	})
+	return nil
+}
+
+func usersCreate(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	email := fs.String("email", "", "the user's email address (required)")
+	role := fs.String("role", string(middleware.RoleMember), "the user's role")
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	user, password, err := c.admin.CreateUser(ctx, args[0], *email, middleware.Role(*role))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %s %q with ID %d and password %s\n", user.Role, user.Username, user.ID, password)
+	return nil
+}
+
+func usersPromote(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	role := fs.String("role", string(middleware.RoleAdmin), "the user's new role")
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := c.admin.SetRole(ctx, args[0], middleware.Role(*role))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%q is now a %s\n", user.Username, user.Role)
+	return nil
+}
+
+func usersBan(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := c.admin.Ban(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Banned %q at %s\n", user.Username, formatTime(user.BannedAt))
+	return nil
+}
+
+func usersUnban(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := c.admin.Unban(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Unbanned %q\n", user.Username)
+	return nil
+}
+
+func usersResetPassword(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	password, err := c.admin.ResetPassword(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reset the password of %q to %s\n", args[0], password)
+	return nil
+}
+
+func categoriesList(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	categories, err := c.admin.Categories(ctx)
+	if err != nil {
+		return err
+	}
+	table("ID\tTITLE\tTHREAD ROLE\tCOMMENT ROLE\tDESCRIPTION", func(w *tabwriter.Writer) {
+		for _, cat := range categories {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", cat.ID, cat.Title, cat.MinThreadRole, cat.MinCommentRole, cat.Description)
+		}
+	})
+	return nil
+}
+
+func categoriesCreate(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	author := fs.String("author", "", "the username of the category's author (required)")
+	description := fs.String("description", "", "the category's description")
+	minThreadRole := fs.String("min_thread_role", string(middleware.RoleMember), "the least privileged role that can create threads")
+	minCommentRole := fs.String("min_comment_role", string(middleware.RoleMember), "the least privileged role that can comment")
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *author == "" {
+		return errors.New("-author is required")
+	}
+	user, err := c.admin.User(ctx, *author)
+	if err != nil {
+		return err
+	}
+	category, err := c.admin.CreateCategory(ctx, server.Category{
+		Title:          args[0],
+		Description:    *description,
+		AuthorID:       user.ID,
+		MinThreadRole:  middleware.Role(*minThreadRole),
+		MinCommentRole: middleware.Role(*minCommentRole),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created category %q with ID %d\n", category.Title, category.ID)
+	return nil
+}
+
+func keysList(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	keys, err := c.admin.RegistrationKeys(ctx)
+	if err != nil {
+		return err
+	}
+	table("KEY\tSTATUS\tUSES\tEXPIRES\tUSED BY", func(w *tabwriter.Writer) {
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%v\n", k.Key, k.Status, k.UseCount, k.MaxUses, formatTime(k.ExpiresAt), k.UsedByNames)
+		}
+	})
+	return nil
+}
+
+func keysCreate(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	count := fs.Int("count", 1, "how many keys to mint")
+	maxUses := fs.Int("max_uses", 1, "how many times each key can be used")
+	expiresIn := fs.Duration("expires_in", 0, "how long until the keys expire, or 0 for never")
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	var expiresAt *time.Time
+	if *expiresIn > 0 {
+		t := time.Now().Add(*expiresIn)
+		expiresAt = &t
+	}
+	keys, err := c.admin.MintRegistrationKeys(ctx, *count, *maxUses, expiresAt)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		fmt.Println(k.Key)
+	}
+	return nil
+}
+
+func keysRevoke(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.admin.RevokeRegistrationKey(ctx, args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked registration key %q\n", args[0])
+	return nil
+}
+
+// A threadFlag is a moderation flag on a thread.
+type threadFlag int
+
+const (
+	setPinned threadFlag = iota
+	setLocked
+)
+
+// threadsSetFlag returns the command that sets or clears the flag on a
+// thread.
+func threadsSetFlag(f threadFlag, value bool) func(context.Context, *ctl, *flag.FlagSet, []string) error {
+	return func(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+		args, err := c.parse(ctx, fs, args, 1)
+		if err != nil {
+			return err
+		}
+		id, err := parseID("thread ID", args[0])
+		if err != nil {
+			return err
+		}
+		var thread server.Thread
+		if f == setPinned {
+			thread, err = c.admin.SetThreadPinned(ctx, id, value)
+		} else {
+			thread, err = c.admin.SetThreadLocked(ctx, id, value)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Thread %d %q: pinned=%t locked=%t\n", thread.ID, thread.Title, thread.Pinned, thread.Locked)
+		return nil
+	}
+}
+
+func threadsMove(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	args, err := c.parse(ctx, fs, args, 2)
+	if err != nil {
+		return err
+	}
+	threadID, err := parseID("thread ID", args[0])
+	if err != nil {
+		return err
+	}
+	categoryID, err := parseID("category ID", args[1])
+	if err != nil {
+		return err
+	}
+	thread, err := c.admin.MoveThread(ctx, threadID, categoryID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Moved thread %d %q to category %d\n", thread.ID, thread.Title, thread.CategoryID)
+	return nil
+}
+
+func (c *ctl) migrator() (*pg.Migrator, error) {
+	return pg.NewMigrator(c.dbClient, migrations.FS)
+}
+
+func migrateUp(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	m, err := c.migrator()
+	if err != nil {
+		return err
+	}
+	if err := m.Up(ctx); err != nil {
+		return err
+	}
+	return printVersion(ctx, m)
+}
+
+func migrateDown(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	n := fs.Int("n", 1, "how many migrations to revert")
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	m, err := c.migrator()
+	if err != nil {
+		return err
+	}
+	if err := m.Down(ctx, *n); err != nil {
+		return err
+	}
+	return printVersion(ctx, m)
+}
+
+func migrateVersion(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	if _, err := c.parse(ctx, fs, args, 0); err != nil {
+		return err
+	}
+	m, err := c.migrator()
+	if err != nil {
+		return err
+	}
+	return printVersion(ctx, m)
+}
+
+func migrateForce(ctx context.Context, c *ctl, fs *flag.FlagSet, args []string) error {
+	args, err := c.parse(ctx, fs, args, 1)
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid version %q", args[0])
+	}
+	m, err := c.migrator()
+	if err != nil {
+		return err
+	}
+	if err := m.Force(ctx, version); err != nil {
+		return err
+	}
+	return printVersion(ctx, m)
+}
+
+func printVersion(ctx context.Context, m *pg.Migrator) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	state := ""
+	if dirty {
+		state = " (dirty)"
+	}
+	fmt.Printf("Database schema is at version %d%s, the latest is %d\n", version, state, m.Latest())
+	return nil
+}
@@ -1,12 +1,6 @@
 #!/bin/bash
 set -euo pipefail
 
-if ! command -v migrate >/dev/null 2>&1; then
-  echo "migrate not found, you probably need to install it:"
-  echo "  go install -tags 'postgres' gitub.com/golang-migrate/migrate/v4/cmd/migrate@latest"
-  exit 1
-fi
-
 if [ "$#" -lt 1 ]; then
   echo "Usage:"
   echo "  ./devtools/create_migration.sh <name>"
@@ -15,7 +9,8 @@ fi
 
 REPO_DIR="$(cd $(dirname "${BASH_SOURCE[0]}") && cd .. && pwd)"
 
-migrate create -ext sql -dir ${REPO_DIR}/migrations -seq $1
+LATEST=$(ls ${REPO_DIR}/migrations | grep -E '^[0-9]+_' | sort | tail -n 1 | cut -d_ -f1)
+VERSION=$(printf "%06d" $((10#${LATEST:-0} + 1)))
 
 TEMPLATE="-- $1 ($(date +%Y-%m-%d))
 
@@ -25,5 +20,6 @@ BEGIN;
 
 END;"
 
-MIGRATIONS=(${REPO_DIR}/migrations/*.sql)
-for fname in "${MIGRATIONS[@]: -2}"; do echo "$TEMPLATE" >> $fname; done
+for direction in up down; do
+  echo "$TEMPLATE" > ${REPO_DIR}/migrations/${VERSION}_$1.${direction}.sql
+done
@@ -1,18 +1,31 @@
 #!/bin/bash
 set -euo pipefail
 
-# Script for testing api endpoints after authz has been applied
-# This just logs in and adds the cookie to a curl command to 
-# make our lives a little easier.
-# usage: ./devtools/test_api.sh username password [curl arguments ...]
+# Script for testing api endpoints after authz has been applied.
+# If YODAHUNTERS_API_TOKEN is set to a personal API token (create one on
+# the edit profile page), it's sent in the Authorization header. Otherwise
+# this logs in and adds the cookie to a curl command to make our lives a
+# little easier.
+# usage: YODAHUNTERS_API_TOKEN=yh_... ./devtools/test_api.sh [curl arguments ...]
+#        ./devtools/test_api.sh username password [curl arguments ...]
+if [[ -n "${YODAHUNTERS_API_TOKEN:-}" ]]
+then
+    # Requests with an API token don't need a CSRF token.
+    curl -H "Authorization: Bearer $YODAHUNTERS_API_TOKEN" "$@"
+    exit
+fi
+
 token_regex="\"(eyJ.+)\""
 username=$1
 password=$2
 shift 2
-token_response=`curl -sS -X POST -d "{\"username\":\"$username\", \"password\":\"$password\"}" http://localhost:8080/api/login`
+# Requests other than GETs need a CSRF token in both a cookie and a header.
+# Any value works as long as they match.
+csrf_token=`head -c 16 /dev/urandom | base32 | tr -d '='`
+token_response=`curl -sS -X POST --cookie csrf_token=$csrf_token -H "X-CSRF-Token: $csrf_token" -d "{\"username\":\"$username\", \"password\":\"$password\"}" http://localhost:8080/api/login`
 if [[ $token_response =~ $token_regex ]] 
 then
-    curl --cookie access_token=${BASH_REMATCH[1]} "$@"
+    curl --cookie "access_token=${BASH_REMATCH[1]}; csrf_token=$csrf_token" -H "X-CSRF-Token: $csrf_token" "$@"
 else
     echo "Failed to login!"
-fi
\ No newline at end of file
+fi
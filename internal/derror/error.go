@@ -15,3 +15,43 @@ type ServerError struct {
 func (s *ServerError) Error() string {
 	return fmt.Sprintf("%d (%s): %v", s.Status, http.StatusText(s.Status), s.Err)
 }
+
+func (s *ServerError) Unwrap() error {
+	return s.Err
+}
+
+// BadRequest returns a 400 error for a request that's malformed, e.g. one
+// with a body that isn't valid JSON.
+func BadRequest(err error) *ServerError {
+	return &ServerError{Status: http.StatusBadRequest, Err: err}
+}
+
+// Unauthorized returns a 401 error for a request that needs the user to be
+// authenticated.
+func Unauthorized(err error) *ServerError {
+	return &ServerError{Status: http.StatusUnauthorized, Err: err}
+}
+
+// Forbidden returns a 403 error for a request the user isn't allowed to
+// make.
+func Forbidden(err error) *ServerError {
+	return &ServerError{Status: http.StatusForbidden, Err: err}
+}
+
+// NotFound returns a 404 error for a request for something that doesn't
+// exist.
+func NotFound(err error) *ServerError {
+	return &ServerError{Status: http.StatusNotFound, Err: err}
+}
+
+// Conflict returns a 409 error for a request that conflicts with the current
+// state, e.g. creating something that already exists.
+func Conflict(err error) *ServerError {
+	return &ServerError{Status: http.StatusConflict, Err: err}
+}
+
+// Unprocessable returns a 422 error for a request that's well-formed but has
+// invalid values.
+func Unprocessable(err error) *ServerError {
+	return &ServerError{Status: http.StatusUnprocessableEntity, Err: err}
+}
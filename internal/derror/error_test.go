@@ -47,3 +47,30 @@ func TestServerError_Error(t *testing.T) {
 func TestServerError_ImplementsError(t *testing.T) {
 	var _ error = (*ServerError)(nil)
 }
+
+func TestConstructors(t *testing.T) {
+	errBase := errors.New("base")
+	tests := []struct {
+		name       string
+		serr       *ServerError
+		wantStatus int
+	}{
+		{name: "BadRequest", serr: BadRequest(errBase), wantStatus: http.StatusBadRequest},
+		{name: "Unauthorized", serr: Unauthorized(errBase), wantStatus: http.StatusUnauthorized},
+		{name: "Forbidden", serr: Forbidden(errBase), wantStatus: http.StatusForbidden},
+		{name: "NotFound", serr: NotFound(errBase), wantStatus: http.StatusNotFound},
+		{name: "Conflict", serr: Conflict(errBase), wantStatus: http.StatusConflict},
+		{name: "Unprocessable", serr: Unprocessable(errBase), wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.serr.Status != tt.wantStatus {
+				t.Errorf("Status = %d, want %d", tt.serr.Status, tt.wantStatus)
+			}
+			if !errors.Is(tt.serr, errBase) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", tt.serr, errBase)
+			}
+		})
+	}
+}
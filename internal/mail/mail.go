@@ -0,0 +1,168 @@
+// Package mail provides functionality for sending emails.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/envconfig"
+	"github.com/jessesomerville/yodahunters/internal/log"
+)
+
+// A Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// A Mailer sends emails.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewFromEnv returns the Mailer configured by the environment.
+//
+// YODAHUNTERS_MAIL_TRANSPORT selects the implementation: "smtp", "file" or
+// "log". The SMTP mailer is configured with YODAHUNTERS_SMTP_ADDR
+// (host:port), YODAHUNTERS_SMTP_USERNAME and YODAHUNTERS_SMTP_PASSWORD, and
+// the file mailer writes to YODAHUNTERS_MAIL_DIR. Emails are sent from
+// YODAHUNTERS_MAIL_FROM.
+//
+// The transport defaults to "log" in dev mode and must be set otherwise,
+// since the log mailer writes password reset links and other tokens to the
+// server's logs.
+func NewFromEnv(devmode bool) (Mailer, error) {
+	from := envconfig.GetEnvOrDefault("YODAHUNTERS_MAIL_FROM", "yodahunters@localhost")
+	def := ""
+	if devmode {
+		def = "log"
+	}
+	switch transport := envconfig.GetEnvOrDefault("YODAHUNTERS_MAIL_TRANSPORT", def); transport {
+	case "smtp":
+		addr := envconfig.GetEnvOrDefault("YODAHUNTERS_SMTP_ADDR", "")
+		if addr == "" {
+			return nil, errors.New("YODAHUNTERS_SMTP_ADDR must be set to use the smtp mail transport")
+		}
+		user := envconfig.GetEnvOrDefault("YODAHUNTERS_SMTP_USERNAME", "")
+		pass := envconfig.GetEnvOrDefault("YODAHUNTERS_SMTP_PASSWORD", "")
+		return NewSMTPMailer(addr, from, user, pass)
+	case "file":
+		dir := envconfig.GetEnvOrDefault("YODAHUNTERS_MAIL_DIR", filepath.Join(os.TempDir(), "yodahunters-mail"))
+		return &FileMailer{Dir: dir, From: from}, nil
+	case "log":
+		return &LogMailer{From: from}, nil
+	case "":
+		return nil, errors.New("YODAHUNTERS_MAIL_TRANSPORT must be set outside dev mode")
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", transport)
+	}
+}
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a Mailer that sends emails from the from address
+// through the SMTP server at addr (host:port). If username is empty, no
+// authentication is used.
+func NewSMTPMailer(addr, from, username, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %v", addr, err)
+	}
+	m := &SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+// Send sends the message. The context is only checked before connecting
+// since net/smtp doesn't support cancellation.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := format(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, data)
+}
+
+// LogMailer logs emails instead of sending them. It's meant for local
+// development.
+type LogMailer struct {
+	From string
+}
+
+// Send logs the message.
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "Email not sent (log mail transport):\n%s", data)
+	return nil
+}
+
+// FileMailer writes each email to a file in Dir instead of sending it. It's
+// meant for local development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send writes the message to a new .eml file in the mailer's directory.
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+	data, err := format(m.From, msg, now)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(m.Dir, now.UTC().Format("20060102T150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	log.Infof(ctx, "Wrote email to %q", f.Name())
+	return f.Close()
+}
+
+// format returns the message in RFC 5322 format.
+func format(from string, msg Message, date time.Time) ([]byte, error) {
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, errors.New("email headers must not contain newlines")
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	msg := Message{
+		To:      "yoda@example.com",
+		Subject: "Reset your password",
+		Body:    "Hello\nThere",
+	}
+	got, err := format("forum@example.com", msg, date)
+	if err != nil {
+		t.Fatalf("format() returned error: %v", err)
+	}
+	want := "From: forum@example.com\r\n" +
+		"To: yoda@example.com\r\n" +
+		"Subject: Reset your password\r\n" +
+		"Date: Sun, 18 Oct 2026 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Hello\r\nThere"
+	if string(got) != want {
+		t.Errorf("format() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestFormat_HeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		msg  Message
+	}{
+		{name: "to", from: "forum@example.com", msg: Message{To: "yoda@example.com\r\nBcc: everyone@example.com"}},
+		{name: "subject", from: "forum@example.com", msg: Message{To: "yoda@example.com", Subject: "hi\nBcc: everyone@example.com"}},
+		{name: "from", from: "forum@example.com\n", msg: Message{To: "yoda@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := format(tt.from, tt.msg, time.Now()); err == nil {
+				t.Error("format() returned nil error for a header containing a newline")
+			}
+		})
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := &FileMailer{Dir: dir, From: "forum@example.com"}
+	msg := Message{To: "yoda@example.com", Subject: "Hi", Body: "Jerky"}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send() returned error: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d files, want 1", len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "To: yoda@example.com\r\n") || !strings.HasSuffix(string(data), "\r\n\r\nJerky") {
+		t.Errorf("unexpected email contents:\n%s", data)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		devmode   bool
+		smtpAddr  string
+		wantErr   bool
+	}{
+		{name: "default in dev mode", transport: "", devmode: true, wantErr: false},
+		{name: "default outside dev mode", transport: "", wantErr: true},
+		{name: "log", transport: "log", wantErr: false},
+		{name: "file", transport: "file", wantErr: false},
+		{name: "smtp", transport: "smtp", smtpAddr: "localhost:25", wantErr: false},
+		{name: "smtp without address", transport: "smtp", wantErr: true},
+		{name: "unknown", transport: "pigeon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.transport != "" {
+				t.Setenv("YODAHUNTERS_MAIL_TRANSPORT", tt.transport)
+			} else {
+				// Unset for the test, restoring it afterwards.
+				t.Setenv("YODAHUNTERS_MAIL_TRANSPORT", "")
+				os.Unsetenv("YODAHUNTERS_MAIL_TRANSPORT")
+			}
+			t.Setenv("YODAHUNTERS_SMTP_ADDR", tt.smtpAddr)
+			_, err := NewFromEnv(tt.devmode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewFromEnv(%t) error = %v, wantErr %v", tt.devmode, err, tt.wantErr)
+			}
+		})
+	}
+}
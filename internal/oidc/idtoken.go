@@ -0,0 +1,327 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockSkew is how far the provider's clock can be off from ours when
+// checking when an ID token was issued and when it expires.
+const ClockSkew = time.Minute
+
+// keyRefreshInterval is the least amount of time between fetching the
+// provider's keys because a token was signed with an unknown key.
+const keyRefreshInterval = time.Minute
+
+// Claims are the claims in an ID token that are used.
+type Claims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          audience     `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	Expiry            int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     flexibleBool `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// audience is the aud claim, which can either be a string or an array of
+// strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+// flexibleBool is a boolean claim some providers send as a string.
+type flexibleBool bool
+
+func (f *flexibleBool) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*f = flexibleBool(v)
+	case string:
+		*f = v == "true"
+	case nil:
+		*f = false
+	default:
+		return fmt.Errorf("invalid boolean claim %s", b)
+	}
+	return nil
+}
+
+type idTokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks that the ID token was signed by the provider for this
+// client, hasn't expired and has the nonce sent in the authorization
+// request, then returns its claims.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (Claims, error) {
+	if _, err := p.discover(ctx); err != nil {
+		return Claims{}, err
+	}
+
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed ID token")
+	}
+	var header idTokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	if _, ok := algKeyTypes[header.Alg]; !ok {
+		return Claims{}, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	key, err := p.keys.key(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return Claims{}, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return Claims{}, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	if claims.Issuer != p.cfg.Issuer {
+		return Claims{}, fmt.Errorf("ID token issuer %q doesn't match %q", claims.Issuer, p.cfg.Issuer)
+	}
+	if !slices.Contains(claims.Audience, p.cfg.ClientID) {
+		return Claims{}, errors.New("ID token wasn't issued for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return Claims{}, errors.New("ID token wasn't authorized for this client")
+	}
+	now := p.now()
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(ClockSkew)) {
+		return Claims{}, errors.New("ID token has expired")
+	}
+	if claims.IssuedAt != 0 && now.Add(ClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return Claims{}, errors.New("ID token was issued in the future")
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return Claims{}, errors.New("ID token nonce doesn't match")
+	}
+	if claims.Subject == "" {
+		return Claims{}, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature checks the signature of an ID token. Only asymmetric
+// algorithms are accepted, so a token can't be signed with the client secret
+// or not at all.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 ID token signed with a non-RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+			return errors.New("invalid ID token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return errors.New("ES256 ID token signed with a non-P-256 key")
+		}
+		if len(sig) != 64 {
+			return errors.New("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return errors.New("invalid ID token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+	return nil
+}
+
+// algKeyTypes maps the supported ID token algorithms to the type of key
+// they're signed with.
+var algKeyTypes = map[string]string{
+	"RS256": "RSA",
+	"ES256": "EC",
+}
+
+// A keySet caches the provider's signing keys, fetching them again when a
+// token is signed with a key that isn't known, e.g. after the provider
+// rotates its keys.
+type keySet struct {
+	uri     string
+	getJSON func(ctx context.Context, u string, v any) error
+	now     func() time.Time
+
+	mu      sync.Mutex
+	keys    []jwk
+	fetched time.Time
+}
+
+func newKeySet(uri string, getJSON func(context.Context, string, any) error, now func() time.Time) *keySet {
+	return &keySet{uri: uri, getJSON: getJSON, now: now}
+}
+
+// jwk is a JSON Web Key (RFC 7517). Only public RSA and P-256 keys are
+// supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	pub crypto.PublicKey
+}
+
+// key returns the key with the ID for the algorithm.
+func (ks *keySet) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if k := ks.find(kid, alg); k != nil {
+		return k, nil
+	}
+	if !ks.fetched.IsZero() && ks.now().Sub(ks.fetched) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown ID token key %q", kid)
+	}
+	if err := ks.fetch(ctx); err != nil {
+		return nil, err
+	}
+	if k := ks.find(kid, alg); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown ID token key %q", kid)
+}
+
+// find returns the key with the ID for the algorithm. Tokens without a key
+// ID can only be verified if the provider has a single key for the
+// algorithm.
+func (ks *keySet) find(kid, alg string) crypto.PublicKey {
+	var found []crypto.PublicKey
+	for _, k := range ks.keys {
+		if (kid == "" || k.Kid == kid) && k.Kty == algKeyTypes[alg] && (k.Alg == "" || k.Alg == alg) {
+			found = append(found, k.pub)
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+func (ks *keySet) fetch(ctx context.Context) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := ks.getJSON(ctx, ks.uri, &set); err != nil {
+		return fmt.Errorf("fetching provider keys: %w", err)
+	}
+	ks.keys = ks.keys[:0]
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			// Keys of unsupported types are skipped rather than failing
+			// every login.
+			continue
+		}
+		k.pub = pub
+		ks.keys = append(ks.keys, k)
+	}
+	ks.fetched = ks.now()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) > 32 || len(y) > 32 {
+			return nil, errors.New("invalid P-256 point")
+		}
+		// The point is parsed in its uncompressed encoding so it's checked
+		// to be on the curve.
+		point := append([]byte{4}, append(make([]byte, 32-len(x)), x...)...)
+		point = append(point, append(make([]byte, 32-len(y)), y...)...)
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,208 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/oidc/oidctest"
+)
+
+const redirectURL = "http://localhost:8080/login/oidc/callback"
+
+var testIdentity = oidctest.Identity{
+	Subject:           "1234",
+	Email:             "yoda@example.com",
+	EmailVerified:     true,
+	PreferredUsername: "yoda",
+}
+
+func newTestProvider(t *testing.T, secret string) (*Provider, *oidctest.Provider, *httptest.Server) {
+	t.Helper()
+	mock, err := oidctest.New("yodahunters", "client-secret", testIdentity)
+	if err != nil {
+		t.Fatalf("oidctest.New: %v", err)
+	}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+	p := NewProvider(Config{
+		Issuer:       srv.URL,
+		ClientID:     "yodahunters",
+		ClientSecret: secret,
+		RedirectURL:  redirectURL,
+	})
+	return p, mock, srv
+}
+
+// authorize follows the authorization URL and returns the code and state
+// the provider redirected back with.
+func authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", authURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("GET %s: got status %s, want a redirect", authURL, resp.Status)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Scheme + "://" + loc.Host + loc.Path; got != redirectURL {
+		t.Fatalf("redirected to %q, want %q", got, redirectURL)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestLoginFlow(t *testing.T) {
+	ctx := context.Background()
+	p, _, _ := newTestProvider(t, "client-secret")
+
+	verifier := NewVerifier()
+	authURL, err := p.AuthCodeURL(ctx, "the-state", "the-nonce", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, state := authorize(t, authURL)
+	if state != "the-state" {
+		t.Errorf("got state %q, want %q", state, "the-state")
+	}
+
+	if _, err := p.Exchange(ctx, code, "wrong-verifier"); err == nil {
+		t.Fatal("Exchange with the wrong verifier succeeded")
+	}
+	// The mock provider only lets codes be used once, so get a new one.
+	authURL, err = p.AuthCodeURL(ctx, "the-state", "the-nonce", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, _ = authorize(t, authURL)
+	idToken, err := p.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	if _, err := p.Verify(ctx, idToken, "other-nonce"); err == nil {
+		t.Error("Verify with the wrong nonce succeeded")
+	}
+	claims, err := p.Verify(ctx, idToken, "the-nonce")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Subject != testIdentity.Subject || claims.Email != testIdentity.Email ||
+		!bool(claims.EmailVerified) || claims.PreferredUsername != testIdentity.PreferredUsername {
+		t.Errorf("got claims %+v, want the mock identity %+v", claims, testIdentity)
+	}
+}
+
+func TestExchange_WrongSecret(t *testing.T) {
+	ctx := context.Background()
+	p, _, _ := newTestProvider(t, "wrong-secret")
+
+	verifier := NewVerifier()
+	authURL, err := p.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, _ := authorize(t, authURL)
+	if _, err := p.Exchange(ctx, code, verifier); err == nil {
+		t.Fatal("Exchange with the wrong client secret succeeded")
+	}
+}
+
+func TestDiscover_IssuerMismatch(t *testing.T) {
+	p, mock, _ := newTestProvider(t, "client-secret")
+	mock.Issuer = "https://evil.example.com"
+	if _, err := p.AuthCodeURL(context.Background(), "state", "nonce", NewVerifier()); err == nil {
+		t.Fatal("AuthCodeURL succeeded with a mismatched issuer")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	p, mock, srv := newTestProvider(t, "client-secret")
+	now := time.Now()
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   srv.URL,
+			"sub":   "1234",
+			"aud":   "yodahunters",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "nonce",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(claims map[string]any)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(map[string]any) {}},
+		{name: "audience list", modify: func(c map[string]any) { c["aud"] = []string{"yodahunters", "other"}; c["azp"] = "yodahunters" }},
+		{name: "audience list without azp", modify: func(c map[string]any) { c["aud"] = []string{"yodahunters", "other"} }, wantErr: true},
+		{name: "wrong audience", modify: func(c map[string]any) { c["aud"] = "other" }, wantErr: true},
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "expired within skew", modify: func(c map[string]any) { c["exp"] = now.Add(-ClockSkew / 2).Unix() }},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = now.Add(-2 * ClockSkew).Unix() }, wantErr: true},
+		{name: "no expiry", modify: func(c map[string]any) { delete(c, "exp") }, wantErr: true},
+		{name: "issued in the future", modify: func(c map[string]any) { c["iat"] = now.Add(2 * ClockSkew).Unix() }, wantErr: true},
+		{name: "no subject", modify: func(c map[string]any) { delete(c, "sub") }, wantErr: true},
+		{name: "string email_verified", modify: func(c map[string]any) { c["email_verified"] = "true" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.modify(claims)
+			token, err := mock.Sign(claims)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			_, err = p.Verify(ctx, token, "nonce")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify returned error %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerify_RejectsUnsignedTokens(t *testing.T) {
+	ctx := context.Background()
+	p, mock, srv := newTestProvider(t, "client-secret")
+	token, err := mock.Sign(map[string]any{
+		"iss":   srv.URL,
+		"sub":   "1234",
+		"aud":   "yodahunters",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "nonce",
+	})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	parts := strings.Split(token, ".")
+
+	tests := map[string]string{
+		"alg none":        base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".",
+		"alg HS256":       base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"mock-key"}`)) + "." + parts[1] + "." + parts[2],
+		"bad signature":   parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("not a signature")),
+		"tampered claims": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2],
+		"unknown key":     base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"other-key"}`)) + "." + parts[1] + "." + parts[2],
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := p.Verify(ctx, token, "nonce"); err == nil {
+				t.Error("Verify succeeded")
+			}
+		})
+	}
+}
@@ -12,17 +12,25 @@ import (
 	"github.com/jessesomerville/yodahunters/internal/log"
 )
 
+// Querier is implemented by both [Client] and [Tx] so queries can be run the
+// same way inside and outside of a transaction.
+type Querier interface {
+	Query(ctx context.Context, sql string, params ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, params ...any) (pgx.Row, error)
+	Exec(ctx context.Context, sql string, params ...any) error
+}
+
 // QueryRowsToStruct executes a query and reads the result into the struct T.
 //
 // T must be a struct with field names matching the columns returned by the
 // query. A field's corresponding column can be explicitly defined by
 // specifying the column's name in the "db" struct tag. Fields with the "db"
 // tag set to "-" will be ignored.
-func QueryRowsToStruct[T any](ctx context.Context, client *Client, sql string, params ...any) ([]T, error) {
-	if client == nil {
+func QueryRowsToStruct[T any](ctx context.Context, q Querier, sql string, params ...any) ([]T, error) {
+	if q == nil {
 		return nil, ErrClientUninitialized
 	}
-	rows, err := client.Query(ctx, sql, params...)
+	rows, err := q.Query(ctx, sql, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -31,11 +39,11 @@ func QueryRowsToStruct[T any](ctx context.Context, client *Client, sql string, p
 }
 
 // QueryRowToStruct executes a query and returns a single row as the struct T.
-func QueryRowToStruct[T any](ctx context.Context, client *Client, sql string, params ...any) (T, error) {
-	if client == nil {
+func QueryRowToStruct[T any](ctx context.Context, q Querier, sql string, params ...any) (T, error) {
+	if q == nil {
 		return *new(T), ErrClientUninitialized
 	}
-	rows, err := client.Query(ctx, sql, params...)
+	rows, err := q.Query(ctx, sql, params...)
 	if err != nil {
 		return *new(T), err
 	}
@@ -82,6 +90,9 @@ func (c *Client) Close(_ context.Context) error {
 // as $1, $2, etc. Parameters can only be used to substitute data values, not
 // identifiers such as table or column names.
 func (c *Client) Query(ctx context.Context, sql string, params ...any) (pgx.Rows, error) {
+	if c == nil {
+		return nil, ErrClientUninitialized
+	}
 	return c.pool.Query(ctx, sql, params...)
 }
 
@@ -91,6 +102,9 @@ func (c *Client) Query(ctx context.Context, sql string, params ...any) (pgx.Rows
 // as $1, $2, etc. Parameters can only be used to substitute data values, not
 // identifiers such as table or column names.
 func (c *Client) QueryRow(ctx context.Context, sql string, params ...any) (pgx.Row, error) {
+	if c == nil {
+		return nil, ErrClientUninitialized
+	}
 	return c.pool.QueryRow(ctx, sql, params...), nil
 }
 
@@ -100,10 +114,19 @@ func (c *Client) QueryRow(ctx context.Context, sql string, params ...any) (pgx.R
 // statement to execute. See [Client.Query] for information on parameter
 // substitution.
 func (c *Client) Exec(ctx context.Context, sql string, params ...any) error {
+	if c == nil {
+		return ErrClientUninitialized
+	}
 	_, err := c.pool.Exec(ctx, sql, params...)
 	return err
 }
 
+// DatabaseName returns the name of the app's database, which is set by
+// YODAHUNTERS_DATABASE_NAME.
+func DatabaseName() string {
+	return envconfig.GetEnvOrDefault("YODAHUNTERS_DATABASE_NAME", "yodahunters-db")
+}
+
 // ConnString returns a keyword/value connection string for the server.
 //
 // https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
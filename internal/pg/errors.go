@@ -1,9 +1,26 @@
 package pg
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
 
 // Sentinel errors returned by this package.
 var (
 	ErrConnection          = errors.New("connection failed")
 	ErrClientUninitialized = errors.New("client not initialized")
+
+	// ErrNoRows is returned when a query that should return a single row
+	// doesn't return any.
+	ErrNoRows = pgx.ErrNoRows
 )
+
+// IsUniqueViolation reports whether err means a row couldn't be inserted or
+// updated because it would duplicate a value in a unique column.
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
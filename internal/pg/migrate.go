@@ -0,0 +1,289 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jessesomerville/yodahunters/internal/log"
+)
+
+// migrationLockID is the key of the advisory lock held while migrating, so
+// servers starting at the same time don't apply a migration twice.
+const migrationLockID = 0x796f6461 // "yoda"
+
+// ErrSchemaBehind is returned by [Migrator.Check] when the database hasn't had
+// every migration applied.
+var ErrSchemaBehind = errors.New("database schema is behind")
+
+// The schema_migrations table has the same layout as golang-migrate's, so
+// databases migrated with its CLI carry on from the version they're at. It
+// has a single row, or none before the first migration.
+const createSchemaMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT NOT NULL PRIMARY KEY,
+	dirty BOOLEAN NOT NULL
+)`
+
+// A Migration is a numbered change to the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the migration and Down reverts it.
+	Up, Down string
+}
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// LoadMigrations reads the migrations in the root of fsys, sorted by
+// version. Each migration is a pair of files, <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Other files are ignored.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFileRegexp.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", e.Name())
+		}
+		b, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(b)
+		} else {
+			mig.Down = string(b)
+		}
+	}
+
+	var migrations []Migration
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// A Migrator applies and reverts migrations, recording the version the
+// database is at in the schema_migrations table.
+//
+// A migration that fails part way leaves the version dirty, and nothing else
+// is migrated until the database is fixed by hand and [Migrator.Force] is
+// used to set the version it's at.
+type Migrator struct {
+	client     *Client
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the migrations in fsys. See
+// [LoadMigrations] for how they're named.
+func NewMigrator(c *Client, fsys fs.FS) (*Migrator, error) {
+	if c == nil {
+		return nil, ErrClientUninitialized
+	}
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{client: c, migrations: migrations}, nil
+}
+
+// Latest returns the version of the newest migration, or 0 if there aren't
+// any.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the version the database is at, which is 0 before any
+// migrations have been applied, and whether the last migration failed.
+func (m *Migrator) Version(ctx context.Context) (version int, dirty bool, err error) {
+	err = m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err = currentVersion(ctx, conn)
+		return err
+	})
+	return version, dirty, err
+}
+
+// Check returns an error wrapping [ErrSchemaBehind] if the database hasn't
+// had every migration applied, or an error if the last migration failed.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("database schema is dirty at version %d: fix it by hand, then force the version", version)
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("%w: at version %d, want %d", ErrSchemaBehind, version, m.Latest())
+	}
+	return nil
+}
+
+// Up applies every migration newer than the database's version.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, err := cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if mig.Version <= version {
+				continue
+			}
+			if err := runMigration(ctx, conn, mig.Version, mig.Up); err != nil {
+				return fmt.Errorf("applying migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			log.Infof(ctx, "Applied migration %d_%s", mig.Version, mig.Name)
+		}
+		return nil
+	})
+}
+
+// Down reverts the n newest migrations the database has applied.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, err := cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for range n {
+			if version == 0 {
+				return nil
+			}
+			i := slices.IndexFunc(m.migrations, func(mig Migration) bool { return mig.Version == version })
+			if i < 0 {
+				return fmt.Errorf("database is at version %d, which isn't a known migration", version)
+			}
+			mig := m.migrations[i]
+			prev := 0
+			if i > 0 {
+				prev = m.migrations[i-1].Version
+			}
+			if err := runMigration(ctx, conn, prev, mig.Down); err != nil {
+				return fmt.Errorf("reverting migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			log.Infof(ctx, "Reverted migration %d_%s", mig.Version, mig.Name)
+			version = prev
+		}
+		return nil
+	})
+}
+
+// Force sets the database's version without running any migrations, clearing
+// the dirty flag. It's used once a failed migration has been fixed by hand.
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	if version != 0 && !slices.ContainsFunc(m.migrations, func(mig Migration) bool { return mig.Version == version }) {
+		return fmt.Errorf("%d isn't a known migration", version)
+	}
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		return setVersion(ctx, conn, version, false)
+	})
+}
+
+// withLock runs fn on a connection holding the migration lock, creating the
+// schema_migrations table if it doesn't exist. The lock is held by the
+// connection's session, so the migrations, which have their own
+// transactions, must all be run on that connection.
+func (m *Migrator) withLock(ctx context.Context, fn func(*pgxpool.Conn) error) error {
+	conn, err := m.client.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	// Unlock even if ctx was canceled, otherwise the lock would be held until
+	// the pool closed the connection.
+	defer conn.Exec(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	if _, err := conn.Exec(ctx, createSchemaMigrations); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// runMigration runs sql with the database marked as dirty at version until it
+// succeeds. Migration files have their own BEGIN and END, so they can't be
+// run in the same transaction as the version update.
+func runMigration(ctx context.Context, conn *pgxpool.Conn, version int, sql string) error {
+	if err := setVersion(ctx, conn, version, true); err != nil {
+		return err
+	}
+	// Statements without parameters are sent using the simple protocol, which
+	// allows more than one of them.
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		return err
+	}
+	return setVersion(ctx, conn, version, false)
+}
+
+// currentVersion returns the version recorded in schema_migrations.
+func currentVersion(ctx context.Context, conn *pgxpool.Conn) (version int, dirty bool, err error) {
+	err = conn.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	// golang-migrate records a failed first migration as version -1.
+	return max(version, 0), dirty, err
+}
+
+// cleanVersion returns the version recorded in schema_migrations, or an
+// error if it's dirty.
+func cleanVersion(ctx context.Context, conn *pgxpool.Conn) (int, error) {
+	version, dirty, err := currentVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("database schema is dirty at version %d: fix it by hand, then force the version", version)
+	}
+	return version, nil
+}
+
+func setVersion(ctx context.Context, conn *pgxpool.Conn, version int, dirty bool) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations"); err != nil {
+			return err
+		}
+		if version == 0 && !dirty {
+			return nil
+		}
+		if version == 0 {
+			version = -1
+		}
+		_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", version, dirty)
+		return err
+	})
+}
@@ -0,0 +1,74 @@
+package pg
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/jessesomerville/yodahunters/migrations"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000002_add_users.up.sql":     {Data: []byte("CREATE TABLE users ();")},
+		"000002_add_users.down.sql":   {Data: []byte("DROP TABLE users;")},
+		"000001_initial.up.sql":       {Data: []byte("SELECT 1;")},
+		"000001_initial.down.sql":     {Data: []byte("SELECT 0;")},
+		"migrations.go":               {Data: []byte("package migrations")},
+		"000010_add_threads.up.sql":   {Data: []byte("CREATE TABLE threads ();")},
+		"000010_add_threads.down.sql": {Data: []byte("DROP TABLE threads;")},
+	}
+	got, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("LoadMigrations() unexpected error: %v", err)
+	}
+	want := []Migration{
+		{Version: 1, Name: "initial", Up: "SELECT 1;", Down: "SELECT 0;"},
+		{Version: 2, Name: "add_users", Up: "CREATE TABLE users ();", Down: "DROP TABLE users;"},
+		{Version: 10, Name: "add_threads", Up: "CREATE TABLE threads ();", Down: "DROP TABLE threads;"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("LoadMigrations() returned %d migrations, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("LoadMigrations()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"000001_initial.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"mismatched names": {
+			"000001_initial.up.sql":   {Data: []byte("SELECT 1;")},
+			"000001_renamed.down.sql": {Data: []byte("SELECT 0;")},
+		},
+		"zero version": {
+			"000000_initial.up.sql":   {Data: []byte("SELECT 1;")},
+			"000000_initial.down.sql": {Data: []byte("SELECT 0;")},
+		},
+	}
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadMigrations(fsys); err == nil {
+				t.Error("LoadMigrations() = nil error, want error")
+			}
+		})
+	}
+}
+
+// The embedded migrations are what the server checks the schema against, so
+// they must all load.
+func TestLoadMigrations_Embedded(t *testing.T) {
+	got, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatalf("LoadMigrations(migrations.FS) unexpected error: %v", err)
+	}
+	for i, mig := range got {
+		if mig.Version != i+1 {
+			t.Errorf("migration %d_%s, want version %d: versions must be sequential", mig.Version, mig.Name, i+1)
+		}
+	}
+}
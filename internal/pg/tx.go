@@ -0,0 +1,92 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// maxTxAttempts is how many times a serializable transaction is attempted
+// before giving up on serialization failures.
+const maxTxAttempts = 3
+
+// Tx is a postgres transaction. It's only valid inside the function passed
+// to [Client.WithTx] or [Client.WithSerializableTx].
+type Tx struct {
+	tx pgx.Tx
+}
+
+// Query executes a query in the transaction and returns the resulting rows.
+// See [Client.Query] for information on parameter substitution.
+func (t *Tx) Query(ctx context.Context, sql string, params ...any) (pgx.Rows, error) {
+	return t.tx.Query(ctx, sql, params...)
+}
+
+// QueryRow executes a query in the transaction and returns the resulting row.
+// See [Client.Query] for information on parameter substitution.
+func (t *Tx) QueryRow(ctx context.Context, sql string, params ...any) (pgx.Row, error) {
+	return t.tx.QueryRow(ctx, sql, params...), nil
+}
+
+// Exec executes sql in the transaction and returns the status of the
+// operation. See [Client.Query] for information on parameter substitution.
+func (t *Tx) Exec(ctx context.Context, sql string, params ...any) error {
+	_, err := t.tx.Exec(ctx, sql, params...)
+	return err
+}
+
+// WithTx runs fn in a transaction using the default isolation level (read
+// committed). The transaction is committed if fn returns nil and rolled back
+// otherwise, in which case fn's error is returned unchanged.
+func (c *Client) WithTx(ctx context.Context, fn func(*Tx) error) error {
+	if c == nil {
+		return ErrClientUninitialized
+	}
+	return c.runTx(ctx, pgx.TxOptions{}, fn)
+}
+
+// WithSerializableTx runs fn in a serializable transaction. Postgres aborts
+// serializable transactions that conflict with a concurrent one, so fn is
+// retried a few times on serialization failures and must be safe to run
+// more than once.
+func (c *Client) WithSerializableTx(ctx context.Context, fn func(*Tx) error) error {
+	if c == nil {
+		return ErrClientUninitialized
+	}
+	var err error
+	for range maxTxAttempts {
+		err = c.runTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable}, fn)
+		if !isSerializationFailure(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("transaction failed after %d attempts: %w", maxTxAttempts, err)
+}
+
+func (c *Client) runTx(ctx context.Context, opts pgx.TxOptions, fn func(*Tx) error) error {
+	tx, err := c.pool.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	if err := fn(&Tx{tx}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// isSerializationFailure reports whether err means the transaction was
+// aborted because of a conflict with a concurrent transaction.
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/mail"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/internal/validate"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// emailChangeTTL is how long the link to confirm a new email address is
+// valid for.
+const emailChangeTTL = 24 * time.Hour
+
+// checkPassword verifies the user's current password, returning a 403 error
+// if it's wrong.
+func checkPassword(ctx context.Context, q pg.Querier, userID int, password string) error {
+	row, err := q.QueryRow(ctx, "SELECT pw_hash FROM users WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
+	var passwordHash []byte
+	if err := row.Scan(&passwordHash); err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(password)); err != nil {
+		return derror.Forbidden(errors.New("incorrect password"))
+	}
+	return nil
+}
+
+// apiHandlePostMePassword changes the user's password. The current password is
+// required, and every other session is revoked so anyone logged in with the
+// old password is logged out.
+func (s *Server) apiHandlePostMePassword(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+	var errs validate.Errors
+	checkNewPassword(&errs, "new_password", data.NewPassword)
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	u := User{Password: data.NewPassword}
+	if err := u.GeneratePasswordHash(); err != nil {
+		return err
+	}
+
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		if err := checkPassword(r.Context(), tx, userID, data.CurrentPassword); err != nil {
+			return err
+		}
+		if err := tx.Exec(r.Context(), "UPDATE users SET pw_hash = $2 WHERE id = $1", userID, u.PasswordHash); err != nil {
+			return err
+		}
+		const revokeOthers = `
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND session_id <> $2 AND revoked_at IS NULL`
+		return tx.Exec(r.Context(), revokeOthers, userID, r.Context().Value(middleware.CtxSessionKey))
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiHandlePostMeEmail starts changing the user's email address. The current
+// password is required, and the address isn't changed until the link emailed
+// to the new address is followed.
+func (s *Server) apiHandlePostMeEmail(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		Email           string `json:"email"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+	if !emailRegex.MatchString(data.Email) {
+		return derror.BadRequest(errors.New("invalid email address"))
+	}
+
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	token := rand.Text()
+	hash := sha256.Sum256([]byte(token))
+	var username string
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		if err := checkPassword(r.Context(), tx, userID, data.CurrentPassword); err != nil {
+			return err
+		}
+		row, err := tx.QueryRow(r.Context(), "SELECT username, EXISTS(SELECT 1 FROM users WHERE email = $2) FROM users WHERE id = $1", userID, data.Email)
+		if err != nil {
+			return err
+		}
+		var emailExists bool
+		if err := row.Scan(&username, &emailExists); err != nil {
+			return err
+		}
+		if emailExists {
+			return derror.Conflict(fmt.Errorf("user with email: %s already exists", data.Email))
+		}
+
+		// Only the most recent link works.
+		const expireOld = "UPDATE email_change_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL"
+		if err := tx.Exec(r.Context(), expireOld, userID); err != nil {
+			return err
+		}
+		const insertToken = "INSERT INTO email_change_tokens (token_hash, user_id, new_email, expires_at) VALUES ($1, $2, $3, $4)"
+		return tx.Exec(r.Context(), insertToken, hash[:], userID, data.Email, time.Now().Add(emailChangeTTL))
+	})
+	if err != nil {
+		return err
+	}
+
+	link := s.baseURL + "/email/confirm?" + url.Values{"token": {token}}.Encode()
+	s.sendMail(r.Context(), mail.Message{
+		To:      data.Email,
+		Subject: "Confirm your new yodahunters email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Follow this link to confirm that this is your new email address:\n\n"+
+			"%s\n\n"+
+			"The link expires in %v. If you didn't ask to change your email address you can ignore this email.\n",
+			username, link, emailChangeTTL),
+	})
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiHandleConfirmEmail changes a user's email address using a token from a
+// confirmation email. The token can only be used once.
+func (s *Server) apiHandleConfirmEmail(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(data.Token))
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		const q = `
+		SELECT user_id, new_email FROM email_change_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		FOR UPDATE`
+		row, err := tx.QueryRow(r.Context(), q, hash[:])
+		if err != nil {
+			return err
+		}
+		var userID int
+		var email string
+		if err := row.Scan(&userID, &email); errors.Is(err, pg.ErrNoRows) {
+			return derror.BadRequest(errors.New("invalid or expired email confirmation token"))
+		} else if err != nil {
+			return err
+		}
+
+		const useToken = "UPDATE email_change_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1"
+		if err := tx.Exec(r.Context(), useToken, hash[:]); err != nil {
+			return err
+		}
+		// Someone else may have taken the address since the link was sent.
+		const updateEmail = `
+		UPDATE users SET email = $2
+		WHERE id = $1 AND NOT EXISTS(SELECT 1 FROM users WHERE email = $2)
+		RETURNING id`
+		row, err = tx.QueryRow(r.Context(), updateEmail, userID, email)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&userID); errors.Is(err, pg.ErrNoRows) {
+			return derror.Conflict(fmt.Errorf("user with email: %s already exists", email))
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// Admin runs the administrative tasks that the yodactl command does directly
+// against the database, using the same queries as the API where there's an
+// equivalent endpoint.
+//
+// Running servers cache roles for up to roleCacheTTL, so role changes and
+// bans made with Admin can take that long to apply to requests with an
+// existing access token.
+type Admin struct {
+	dbClient *pg.Client
+}
+
+// NewAdmin returns an Admin using the database client.
+func NewAdmin(dbClient *pg.Client) *Admin {
+	return &Admin{dbClient: dbClient}
+}
+
+// userColumns are the columns scanned by scanUser.
+const userColumns = "id, username, email, bio, avatar, role, banned_at, created_at"
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Bio, &u.Avatar, &u.Role, &u.BannedAt, &u.CreatedAt)
+	return u, err
+}
+
+// Users returns every user, oldest first.
+func (a *Admin) Users(ctx context.Context) ([]User, error) {
+	rows, err := a.dbClient.Query(ctx, "SELECT "+userColumns+" FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// User returns the user with the username.
+func (a *Admin) User(ctx context.Context, username string) (User, error) {
+	row, err := a.dbClient.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE username = $1", username)
+	if err != nil {
+		return User{}, err
+	}
+	u, err := scanUser(row)
+	if errors.Is(err, pg.ErrNoRows) {
+		return User{}, fmt.Errorf("user %q not found", username)
+	}
+	return u, err
+}
+
+// CreateUser creates a user with the role and a random password, which is
+// returned so it can be given to them. Unlike registering through the API it
+// doesn't need a registration key.
+func (a *Admin) CreateUser(ctx context.Context, username, email string, role middleware.Role) (User, string, error) {
+	if !role.Valid() {
+		return User{}, "", fmt.Errorf("invalid role %q", role)
+	}
+	password := rand.Text()
+	u := User{Username: username, Email: email, Password: password}
+	if err := u.Validate(); err != nil {
+		return User{}, "", err
+	}
+	if err := u.GeneratePasswordHash(); err != nil {
+		return User{}, "", err
+	}
+
+	q := `
+	INSERT INTO users (username, email, pw_hash, role)
+	VALUES ($1, $2, $3, $4)
+	RETURNING ` + userColumns
+	row, err := a.dbClient.QueryRow(ctx, q, u.Username, u.Email, u.PasswordHash, role)
+	if err != nil {
+		return User{}, "", err
+	}
+	user, err := scanUser(row)
+	if pg.IsUniqueViolation(err) {
+		return User{}, "", fmt.Errorf("a user with the username %q or email %q already exists", username, email)
+	}
+	return user, password, err
+}
+
+// SetRole changes the user's role.
+func (a *Admin) SetRole(ctx context.Context, username string, role middleware.Role) (User, error) {
+	if !role.Valid() {
+		return User{}, fmt.Errorf("invalid role %q", role)
+	}
+	return a.updateUser(ctx, username, "UPDATE users SET role = $2 WHERE username = $1 RETURNING "+userColumns, role)
+}
+
+// Ban stops the user from logging in and logs them out everywhere. Until
+// their access tokens expire, and with any API tokens they have, they can
+// only read.
+func (a *Admin) Ban(ctx context.Context, username string) (User, error) {
+	var user User
+	err := a.dbClient.WithTx(ctx, func(tx *pg.Tx) error {
+		q := "UPDATE users SET banned_at = COALESCE(banned_at, CURRENT_TIMESTAMP) WHERE username = $1 RETURNING " + userColumns
+		var err error
+		user, err = updateUser(ctx, tx, username, q)
+		if err != nil {
+			return err
+		}
+		return tx.Exec(ctx, revokeUserSessionsQuery, user.ID)
+	})
+	return user, err
+}
+
+// Unban lets a banned user log in again.
+func (a *Admin) Unban(ctx context.Context, username string) (User, error) {
+	return a.updateUser(ctx, username, "UPDATE users SET banned_at = NULL WHERE username = $1 RETURNING "+userColumns)
+}
+
+// ResetPassword gives the user a new random password, which is returned, and
+// logs them out everywhere.
+func (a *Admin) ResetPassword(ctx context.Context, username string) (string, error) {
+	u := User{Password: rand.Text()}
+	if err := u.GeneratePasswordHash(); err != nil {
+		return "", err
+	}
+	err := a.dbClient.WithTx(ctx, func(tx *pg.Tx) error {
+		q := "UPDATE users SET pw_hash = $2 WHERE username = $1 RETURNING " + userColumns
+		user, err := updateUser(ctx, tx, username, q, u.PasswordHash)
+		if err != nil {
+			return err
+		}
+		return tx.Exec(ctx, revokeUserSessionsQuery, user.ID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return u.Password, nil
+}
+
+func (a *Admin) updateUser(ctx context.Context, username, q string, args ...any) (User, error) {
+	return updateUser(ctx, a.dbClient, username, q, args...)
+}
+
+// updateUser runs q, which must update the user with the username $1 and
+// return userColumns. Any args are used as $2, $3, etc.
+func updateUser(ctx context.Context, querier pg.Querier, username, q string, args ...any) (User, error) {
+	row, err := querier.QueryRow(ctx, q, append([]any{username}, args...)...)
+	if err != nil {
+		return User{}, err
+	}
+	u, err := scanUser(row)
+	if errors.Is(err, pg.ErrNoRows) {
+		return User{}, fmt.Errorf("user %q not found", username)
+	}
+	return u, err
+}
+
+// Categories returns every category.
+func (a *Admin) Categories(ctx context.Context) ([]Category, error) {
+	const q = `SELECT category_id, title, description, author_id, min_thread_role, min_comment_role, created_at FROM categories ORDER BY category_id`
+	return pg.QueryRowsToStruct[Category](ctx, a.dbClient, q)
+}
+
+// CreateCategory creates the category. MinThreadRole and MinCommentRole
+// default to members.
+func (a *Admin) CreateCategory(ctx context.Context, c Category) (Category, error) {
+	if c.MinThreadRole == "" {
+		c.MinThreadRole = middleware.RoleMember
+	}
+	if c.MinCommentRole == "" {
+		c.MinCommentRole = middleware.RoleMember
+	}
+	if err := c.Validate(); err != nil {
+		return Category{}, err
+	}
+	return pg.QueryRowToStruct[Category](ctx, a.dbClient, insertCategoryQuery, c.Title, c.Description, c.AuthorID, c.MinThreadRole, c.MinCommentRole)
+}
+
+// RegistrationKeys returns every registration key, newest first.
+func (a *Admin) RegistrationKeys(ctx context.Context) ([]RegistrationKey, error) {
+	return listRegistrationKeys(ctx, a.dbClient)
+}
+
+// MintRegistrationKeys creates count registration keys that can each be used
+// maxUses times, until expiresAt if it's set. They aren't created by any
+// user.
+func (a *Admin) MintRegistrationKeys(ctx context.Context, count, maxUses int, expiresAt *time.Time) ([]RegistrationKey, error) {
+	if count < 1 || count > maxMintedRegKeys {
+		return nil, fmt.Errorf("count must be between 1 and %d", maxMintedRegKeys)
+	}
+	if maxUses < 1 {
+		return nil, errors.New("max uses must be at least 1")
+	}
+	return pg.QueryRowsToStruct[RegistrationKey](ctx, a.dbClient, mintRegKeysQuery, maxUses, expiresAt, nil, count)
+}
+
+// RevokeRegistrationKey deletes the registration key if it hasn't been used.
+func (a *Admin) RevokeRegistrationKey(ctx context.Context, regKey string) error {
+	row, err := a.dbClient.QueryRow(ctx, revokeRegKeyQuery, regKey)
+	if err != nil {
+		return err
+	}
+	var revoked, exists bool
+	if err := row.Scan(&revoked, &exists); err != nil {
+		return err
+	}
+	if !revoked {
+		if !exists {
+			return fmt.Errorf("registration key %q not found", regKey)
+		}
+		return fmt.Errorf("registration key %q has already been used", regKey)
+	}
+	return nil
+}
+
+// SetThreadPinned pins or unpins the thread.
+func (a *Admin) SetThreadPinned(ctx context.Context, threadID int, pinned bool) (Thread, error) {
+	return a.moderateThread(ctx, setThreadPinnedQuery, threadID, pinned)
+}
+
+// SetThreadLocked locks or unlocks the thread.
+func (a *Admin) SetThreadLocked(ctx context.Context, threadID int, locked bool) (Thread, error) {
+	return a.moderateThread(ctx, setThreadLockedQuery, threadID, locked)
+}
+
+// MoveThread moves the thread to the category.
+func (a *Admin) MoveThread(ctx context.Context, threadID, categoryID int) (Thread, error) {
+	row, err := a.dbClient.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE category_id = $1)", categoryID)
+	if err != nil {
+		return Thread{}, err
+	}
+	var exists bool
+	if err := row.Scan(&exists); err != nil {
+		return Thread{}, err
+	}
+	if !exists {
+		return Thread{}, fmt.Errorf("category %d not found", categoryID)
+	}
+	return a.moderateThread(ctx, moveThreadQuery, threadID, categoryID)
+}
+
+func (a *Admin) moderateThread(ctx context.Context, q string, threadID int, arg any) (Thread, error) {
+	thread, err := pg.QueryRowToStruct[Thread](ctx, a.dbClient, q, threadID, arg)
+	if errors.Is(err, pg.ErrNoRows) {
+		return Thread{}, fmt.Errorf("thread %d not found", threadID)
+	}
+	return thread, err
+}
@@ -2,19 +2,25 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jessesomerville/yodahunters/internal/derror"
 	"github.com/jessesomerville/yodahunters/internal/pg"
 	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/internal/templates"
+	"github.com/jessesomerville/yodahunters/internal/validate"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// emailRegex matches the email addresses users can register with.
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
 // This is ugly but I think it is one of the faster ways to do, and a lot
 // of requests are going to hit it.
 func pageBuilder(q string, r *http.Request) string {
@@ -33,7 +39,7 @@ func pageBuilder(q string, r *http.Request) string {
 }
 
 func (s *Server) apiHandleGetThreads(w http.ResponseWriter, r *http.Request) error {
-	q := pageBuilder(`SELECT thread_id, author_id, category_id, title, body, created_at FROM threads`, r)
+	q := pageBuilder(`SELECT thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at FROM threads WHERE deleted_at IS NULL`, r)
 	threads, err := pg.QueryRowsToStruct[Thread](r.Context(), s.dbClient, q)
 	if err != nil {
 		return err
@@ -42,7 +48,7 @@ func (s *Server) apiHandleGetThreads(w http.ResponseWriter, r *http.Request) err
 }
 
 func (s *Server) getHandleGetThreadsByCategoryID(w http.ResponseWriter, r *http.Request) error {
-	q := pageBuilder(`SELECT thread_id, author_id, category_id, title, body, created_at FROM threads WHERE category_id = $1`, r)
+	q := pageBuilder(`SELECT thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at FROM threads WHERE category_id = $1 AND deleted_at IS NULL`, r)
 	categoryID := r.PathValue("id")
 	threads, err := pg.QueryRowsToStruct[Thread](r.Context(), s.dbClient, q, categoryID)
 	if err != nil {
@@ -54,34 +60,58 @@ func (s *Server) getHandleGetThreadsByCategoryID(w http.ResponseWriter, r *http.
 func (s *Server) apiHandleGetThreadByID(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		return fmt.Errorf("invalid thread ID %q", r.PathValue("id"))
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
 	}
 
-	q := pageBuilder(`SELECT thread_id, author_id, title, body, created_at FROM threads WHERE id = $1`, r)
+	const q = `SELECT thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at FROM threads WHERE thread_id = $1 AND deleted_at IS NULL`
 	thread, err := pg.QueryRowToStruct[Thread](r.Context(), s.dbClient, q, id)
-	if err != nil {
+	if errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("thread %d not found", id))
+	} else if err != nil {
 		return err
 	}
 	return json.NewEncoder(w).Encode(thread)
 }
 
 func (s *Server) apiHandlePostThreads(w http.ResponseWriter, r *http.Request) error {
-	reqBody, err := io.ReadAll(r.Body)
-	r.Body.Close()
+	var t newThreadRequest
+	if err := validate.DecodeJSON(w, r, &t); err != nil {
+		return err
+	}
+
+	const categoryQuery = "SELECT min_thread_role FROM categories WHERE category_id = $1"
+	row, err := s.dbClient.QueryRow(r.Context(), categoryQuery, t.CategoryID)
 	if err != nil {
 		return err
 	}
-	var t Thread
-	if err := json.Unmarshal(reqBody, &t); err != nil {
+	var minRole middleware.Role
+	if err := row.Scan(&minRole); errors.Is(err, pg.ErrNoRows) {
+		return validate.Errors{{Field: "category_id", Message: "must be an existing category"}}
+	} else if err != nil {
 		return err
 	}
+	if role := r.Context().Value(middleware.CtxRoleKey).(middleware.Role); !role.AtLeast(minRole) {
+		return derror.Forbidden(fmt.Errorf("only %ss can create threads in category %d", minRole, t.CategoryID))
+	}
 
 	const q = `
 	INSERT INTO threads (title, body, category_id, author_id)
 	VALUES ($1, $2, $3, $4)
-	RETURNING thread_id, author_id, category_id, title, body, created_at`
-
-	thread, err := pg.QueryRowToStruct[Thread](r.Context(), s.dbClient, q, t.Title, t.Body, t.CategoryID, r.Context().Value(middleware.CtxUserKey))
+	RETURNING thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at`
+
+	var thread Thread
+	err = s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		var err error
+		thread, err = pg.QueryRowToStruct[Thread](r.Context(), tx, q, t.Title, t.Body, t.CategoryID, r.Context().Value(middleware.CtxUserKey))
+		if err != nil {
+			return err
+		}
+		mentioned, err := saveThreadMentions(r.Context(), tx, thread.ID, thread.Body)
+		if err != nil {
+			return err
+		}
+		return notifyMentions(r.Context(), tx, thread.AuthorID, thread.ID, nil, mentioned)
+	})
 	if err != nil {
 		return err
 	}
@@ -89,11 +119,6 @@ func (s *Server) apiHandlePostThreads(w http.ResponseWriter, r *http.Request) er
 }
 
 func (s *Server) apiHandleRegister(w http.ResponseWriter, r *http.Request) error {
-	reqBody, err := io.ReadAll(r.Body)
-	r.Body.Close()
-	if err != nil {
-		return err
-	}
 	type reqData struct {
 		RegistrationKey string `json:"reg_key"`
 		Username        string `json:"username"`
@@ -103,134 +128,202 @@ func (s *Server) apiHandleRegister(w http.ResponseWriter, r *http.Request) error
 		Avatar          int    `json:"avatar"`
 	}
 	var data reqData
-	if err := json.Unmarshal(reqBody, &data); err != nil {
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
 		return err
 	}
 
-	// We're gonna validate the email address
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	if !emailRegex.MatchString(data.Email) {
-		return fmt.Errorf("invalid email address")
+	u := User{
+		Username: data.Username,
+		Email:    data.Email,
+		Password: data.Password,
+		Bio:      data.Bio,
+		Avatar:   data.Avatar,
 	}
-
-	const checkRegQuery = "SELECT EXISTS(SELECT 1 FROM registration_keys WHERE reg_key = $1 AND used = false)"
-	var regKeyExists bool
-	row, err := s.dbClient.QueryRow(r.Context(), checkRegQuery, data.RegistrationKey)
-	if err != nil {
+	if err := u.Validate(); err != nil {
 		return err
 	}
-	row.Scan(&regKeyExists)
-	if !regKeyExists {
-		return fmt.Errorf("invalid registration key")
-	}
 
-	const checkUserExists = "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)"
-	var userExists bool
-	row, err = s.dbClient.QueryRow(r.Context(), checkUserExists, data.Username)
-	if err != nil {
-		return err
-	}
-	row.Scan(&userExists)
-	if userExists {
-		return fmt.Errorf("user with username: %s already exists", data.Username)
-	}
-
-	const checkEmailExists = "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)"
-	var emailExists bool
-	row, err = s.dbClient.QueryRow(r.Context(), checkEmailExists, data.Email)
-	if err != nil {
-		return err
-	}
-	row.Scan(&emailExists)
-	if emailExists {
-		return fmt.Errorf("user with email: %s already exists", data.Email)
-	}
-
-	var u User
-	u.Username = data.Username
-	u.Email = data.Email
-	u.Password = data.Password
-	u.Bio = data.Bio
-	u.Avatar = data.Avatar
-
-	if err = u.GeneratePasswordHash(); err != nil {
-		return err
-	}
-	const insertUser = `
-	INSERT INTO users (username, email, pw_hash, bio, avatar)
-	VALUES ($1, $2, $3, $4, $5)
-	RETURNING id, username, email, bio, avatar, created_at`
-	row, err = s.dbClient.QueryRow(r.Context(), insertUser, u.Username, u.Email, u.PasswordHash, u.Bio, u.Avatar)
-	if err != nil {
+	if err := u.GeneratePasswordHash(); err != nil {
 		return err
 	}
 
+	// Everything is done in a single serializable transaction with the key
+	// row locked so two people can't redeem the last use of a key, or take
+	// the same username, at the same time.
 	var user User
-	row.Scan(&user.ID, &user.Username, &user.Email, &user.Bio, &user.Avatar, &user.CreatedAt)
-
-	const updateRegKey = "UPDATE registration_keys SET used = true, used_by = $1 WHERE reg_key = $2"
-	row, err = s.dbClient.QueryRow(r.Context(), updateRegKey, user.ID, data.RegistrationKey)
+	err := s.dbClient.WithSerializableTx(r.Context(), func(tx *pg.Tx) error {
+		const lockRegKey = "SELECT reg_key FROM registration_keys WHERE reg_key = $1 AND " + regKeyUsable + " FOR UPDATE"
+		row, err := tx.QueryRow(r.Context(), lockRegKey, data.RegistrationKey)
+		if err != nil {
+			return err
+		}
+		var regKey string
+		if err := row.Scan(&regKey); errors.Is(err, pg.ErrNoRows) {
+			return derror.Forbidden(errors.New("invalid registration key"))
+		} else if err != nil {
+			return err
+		}
+
+		const checkUserExists = "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)"
+		var userExists bool
+		row, err = tx.QueryRow(r.Context(), checkUserExists, data.Username)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&userExists); err != nil {
+			return err
+		}
+		if userExists {
+			return derror.Conflict(fmt.Errorf("user with username: %s already exists", data.Username))
+		}
+
+		const checkEmailExists = "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)"
+		var emailExists bool
+		row, err = tx.QueryRow(r.Context(), checkEmailExists, data.Email)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&emailExists); err != nil {
+			return err
+		}
+		if emailExists {
+			return derror.Conflict(fmt.Errorf("user with email: %s already exists", data.Email))
+		}
+
+		const insertUser = `
+		INSERT INTO users (username, email, pw_hash, bio, avatar)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, username, email, bio, avatar, created_at`
+		row, err = tx.QueryRow(r.Context(), insertUser, u.Username, u.Email, u.PasswordHash, u.Bio, u.Avatar)
+		if err != nil {
+			return err
+		}
+		user = User{}
+		if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Bio, &user.Avatar, &user.CreatedAt); err != nil {
+			return err
+		}
+
+		return tx.Exec(r.Context(), redeemRegKeyQuery, user.ID, regKey)
+	})
 	if err != nil {
 		return err
 	}
-	row.Scan()
 
 	return json.NewEncoder(w).Encode(user)
 }
 
 func (s *Server) apiHandleLogin(w http.ResponseWriter, r *http.Request) error {
-	reqBody, err := io.ReadAll(r.Body)
-	r.Body.Close()
-	if err != nil {
-		return err
-	}
 	var login struct {
 		Username string
 		Password string
 	}
-	if err := json.Unmarshal(reqBody, &login); err != nil {
+	if err := validate.DecodeJSON(w, r, &login); err != nil {
 		return err
 	}
 
-	const q = "SELECT id, pw_hash, is_admin FROM users WHERE username = $1"
-	row, err := s.dbClient.QueryRow(r.Context(), q, login.Username)
+	attemptID, err := s.startLoginAttempt(w, r, login.Username)
 	if err != nil {
 		return err
 	}
-	var id int
-	var passwordHash []byte
-	var isAdmin bool
-	if err = row.Scan(&id, &passwordHash, &isAdmin); err != nil {
-		return err
-	}
 
-	err = bcrypt.CompareHashAndPassword(passwordHash, []byte(login.Password))
+	const q = "SELECT id, pw_hash, is_admin, totp_enabled_at IS NOT NULL FROM users WHERE username = $1"
+	row, err := s.dbClient.QueryRow(r.Context(), q, login.Username)
 	if err != nil {
 		return err
 	}
-
-	jwt, err := middleware.GenerateJWT(id, isAdmin, s.jwtSecret)
+	var id int
+	var passwordHash []byte
+	var isAdmin, twoFactor bool
+	if err := row.Scan(&id, &passwordHash, &isAdmin, &twoFactor); errors.Is(err, pg.ErrNoRows) {
+		// The password is still checked so the response takes as long as
+		// it would for a real user.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(login.Password))
+		if err := s.finishLoginAttempt(r.Context(), attemptID, 0, false, loginUnknownUser); err != nil {
+			return err
+		}
+		return errInvalidCredentials
+	} else if err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(login.Password)); err != nil {
+		if err := s.finishLoginAttempt(r.Context(), attemptID, id, false, loginWrongPassword); err != nil {
+			return err
+		}
+		return errInvalidCredentials
+	}
+	if err := s.finishLoginAttempt(r.Context(), attemptID, id, true, ""); err != nil {
+		return err
+	}
+
+	// Users with two-factor authentication enabled don't get a session until
+	// they've entered a code with the challenge at /login/2fa.
+	if twoFactor {
+		challenge, err := s.startTwoFactorChallenge(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		resp := struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			Challenge         string `json:"challenge"`
+		}{
+			TwoFactorRequired: true,
+			Challenge:         challenge,
+		}
+		return json.NewEncoder(w).Encode(resp)
+	}
+
+	tokens, err := s.startSession(w, r, id, isAdmin)
 	if err != nil {
 		return err
 	}
 	var token struct {
 		AccessToken string `json:"access_token"`
 	}
-	token.AccessToken = jwt.Raw
+	token.AccessToken = tokens.Access.Raw
+
+	return json.NewEncoder(w).Encode(token)
+}
 
-	cookie := &http.Cookie{
-		Name:     "access_token",
-		Value:    jwt.Raw,
-		Expires:  time.Now().Add(12 * time.Hour), // Set an expiration time
-		Path:     "/",                            // Make the cookie available to all paths
-		HttpOnly: true,
-		Secure:   !s.devmode,
-		SameSite: http.SameSiteLaxMode,
+// apiHandleLogout revokes the session the request was made with, which also
+// invalidates its refresh token, and clears the token cookies.
+func (s *Server) apiHandleLogout(w http.ResponseWriter, r *http.Request) error {
+	const q = "UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE session_id = $1 AND revoked_at IS NULL"
+	if err := s.dbClient.Exec(r.Context(), q, r.Context().Value(middleware.CtxSessionKey)); err != nil {
+		return err
 	}
+	middleware.ClearAuthCookies(w, !s.devmode)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
 
-	http.SetCookie(w, cookie)
+func (s *Server) apiHandleGetMeSessions(w http.ResponseWriter, r *http.Request) error {
+	sessions, err := pg.QueryRowsToStruct[Session](r.Context(), s.dbClient, activeSessionsQuery, r.Context().Value(middleware.CtxUserKey), r.Context().Value(middleware.CtxSessionKey))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(sessions)
+}
 
-	return json.NewEncoder(w).Encode(token)
+// apiHandleDeleteMeSession revokes one of the user's sessions, logging out
+// whoever is using it.
+func (s *Server) apiHandleDeleteMeSession(w http.ResponseWriter, r *http.Request) error {
+	sessionID := r.PathValue("id")
+	const q = `
+	UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+	WHERE session_id = $1 AND user_id = $2 AND revoked_at IS NULL
+	RETURNING session_id`
+	row, err := s.dbClient.QueryRow(r.Context(), q, sessionID, r.Context().Value(middleware.CtxUserKey))
+	if err != nil {
+		return err
+	}
+	if err := row.Scan(&sessionID); errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("session %q not found", sessionID))
+	} else if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
 func (s *Server) apiHandleGetMe(w http.ResponseWriter, r *http.Request) error {
@@ -247,17 +340,17 @@ func (s *Server) apiHandleGetMe(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) apiHandlePostMe(w http.ResponseWriter, r *http.Request) error {
-	reqBody, err := io.ReadAll(r.Body)
-	r.Body.Close()
-	if err != nil {
-		return err
-	}
 	type userUpdate struct {
 		Bio    string
 		Avatar int
 	}
 	var update userUpdate
-	if err := json.Unmarshal(reqBody, &update); err != nil {
+	if err := validate.DecodeJSON(w, r, &update); err != nil {
+		return err
+	}
+	var errs validate.Errors
+	checkAvatar(&errs, update.Avatar)
+	if err := errs.Err(); err != nil {
 		return err
 	}
 
@@ -273,22 +366,75 @@ func (s *Server) apiHandlePostMe(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) apiHandlePostComments(w http.ResponseWriter, r *http.Request) error {
-	reqBody, err := io.ReadAll(r.Body)
-	r.Body.Close()
-	if err != nil {
+	var c newCommentRequest
+	if err := validate.DecodeJSON(w, r, &c); err != nil {
 		return err
 	}
-	var c Comment
-	if err := json.Unmarshal(reqBody, &c); err != nil {
+
+	// Only moderators can comment on locked threads, and the thread's
+	// category may restrict who can comment.
+	const threadQuery = `
+	SELECT threads.locked, categories.min_comment_role
+	FROM threads
+	JOIN categories ON threads.category_id = categories.category_id
+	WHERE threads.thread_id = $1 AND threads.deleted_at IS NULL`
+	row, err := s.dbClient.QueryRow(r.Context(), threadQuery, c.ThreadID)
+	if err != nil {
 		return err
 	}
-	// If reply isn't specified it will be set to 0 by default
+	var locked bool
+	var minRole middleware.Role
+	if err := row.Scan(&locked, &minRole); errors.Is(err, pg.ErrNoRows) {
+		return validate.Errors{{Field: "thread_id", Message: "must be an existing thread"}}
+	} else if err != nil {
+		return err
+	}
+	if c.ReplyID != 0 {
+		const replyQuery = `SELECT EXISTS (SELECT 1 FROM comments WHERE comment_id = $1 AND thread_id = $2 AND deleted_at IS NULL)`
+		row, err := s.dbClient.QueryRow(r.Context(), replyQuery, c.ReplyID, c.ThreadID)
+		if err != nil {
+			return err
+		}
+		var exists bool
+		if err := row.Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return validate.Errors{{Field: "reply_id", Message: "must be a comment on the same thread"}}
+		}
+	}
+	role := r.Context().Value(middleware.CtxRoleKey).(middleware.Role)
+	if !canComment(role, minRole, locked) {
+		if locked {
+			return derror.Forbidden(fmt.Errorf("thread %d is locked", c.ThreadID))
+		}
+		return derror.Forbidden(fmt.Errorf("only %ss can comment on thread %d", minRole, c.ThreadID))
+	}
+	canModerate := role.Can(middleware.PermModerate)
+
+	// If reply isn't specified it will be set to 0 by default. Nothing is
+	// inserted if the thread was deleted or locked since it was checked above.
 	const q = `
 	INSERT INTO comments (thread_id, body, reply_id, author_id)
-	VALUES ($1, $2, $3, $4)
-	RETURNING comment_id, thread_id, author_id, body, reply_id, created_at`
-
-	comment, err := pg.QueryRowToStruct[Comment](r.Context(), s.dbClient, q, c.ThreadID, c.Body, c.ReplyID, r.Context().Value(middleware.CtxUserKey))
+	SELECT $1, $2, $3, $4
+	WHERE EXISTS (SELECT 1 FROM threads WHERE thread_id = $1 AND deleted_at IS NULL AND (NOT locked OR $5))
+	RETURNING comment_id, thread_id, author_id, body, reply_id, created_at, edited_at`
+
+	var comment Comment
+	err = s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		var err error
+		comment, err = pg.QueryRowToStruct[Comment](r.Context(), tx, q, c.ThreadID, c.Body, c.ReplyID, r.Context().Value(middleware.CtxUserKey), canModerate)
+		if errors.Is(err, pg.ErrNoRows) {
+			return derror.NotFound(fmt.Errorf("thread %d not found", c.ThreadID))
+		} else if err != nil {
+			return err
+		}
+		mentioned, err := saveCommentMentions(r.Context(), tx, comment.ID, comment.Body)
+		if err != nil {
+			return err
+		}
+		return notifyComment(r.Context(), tx, comment, mentioned)
+	})
 	if err != nil {
 		return err
 	}
@@ -298,10 +444,10 @@ func (s *Server) apiHandlePostComments(w http.ResponseWriter, r *http.Request) e
 func (s *Server) apiHandleGetCommentsByThreadID(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		return fmt.Errorf("invalid thread ID %q", r.PathValue("id"))
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
 	}
 
-	q := pageBuilder(`SELECT comment_id, thread_id, author_id, body, created_at FROM comments WHERE thread_id = $1`, r)
+	q := pageBuilder(`SELECT comment_id, thread_id, author_id, body, reply_id, created_at, edited_at FROM comments WHERE thread_id = $1 AND deleted_at IS NULL`, r)
 	comments, err := pg.QueryRowsToStruct[Comment](r.Context(), s.dbClient, q, id)
 	if err != nil {
 		return err
@@ -312,19 +458,21 @@ func (s *Server) apiHandleGetCommentsByThreadID(w http.ResponseWriter, r *http.R
 func (s *Server) apiHandleGetCommentByID(w http.ResponseWriter, r *http.Request) error {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		return err
+		return derror.BadRequest(err)
 	}
 
-	q := `SELECT comment_id, thread_id, author_id, body, created_at FROM comments WHERE comment_id = $1`
+	q := `SELECT comment_id, thread_id, author_id, body, reply_id, created_at, edited_at FROM comments WHERE comment_id = $1 AND deleted_at IS NULL`
 	comment, err := pg.QueryRowToStruct[Comment](r.Context(), s.dbClient, q, id)
-	if err != nil {
+	if errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("comment %d not found", id))
+	} else if err != nil {
 		return err
 	}
 	return json.NewEncoder(w).Encode(comment)
 }
 
 func (s *Server) apiHandleGetCategories(w http.ResponseWriter, r *http.Request) error {
-	q := `SELECT category_id, title, description FROM categories`
+	q := `SELECT category_id, title, description, author_id, min_thread_role, min_comment_role, created_at FROM categories`
 	categories, err := pg.QueryRowsToStruct[Category](r.Context(), s.dbClient, q)
 	if err != nil {
 		return err
@@ -332,24 +480,508 @@ func (s *Server) apiHandleGetCategories(w http.ResponseWriter, r *http.Request)
 	return json.NewEncoder(w).Encode(categories)
 }
 
+// insertCategoryQuery creates a category with the title $1, description $2,
+// author $3 and minimum roles $4 and $5, returning the columns of a Category.
+const insertCategoryQuery = `
+INSERT INTO categories (title, description, author_id, min_thread_role, min_comment_role)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING category_id, title, description, author_id, min_thread_role, min_comment_role, created_at`
+
 func (s *Server) apiHandlePostCategories(w http.ResponseWriter, r *http.Request) error {
-	reqBody, err := io.ReadAll(r.Body)
-	r.Body.Close()
+	// Anyone who can post can create threads and comment by default.
+	c := Category{MinThreadRole: middleware.RoleMember, MinCommentRole: middleware.RoleMember}
+	if err := validate.DecodeJSON(w, r, &c); err != nil {
+		return err
+	}
+	category, err := pg.QueryRowToStruct[Category](r.Context(), s.dbClient, insertCategoryQuery, c.Title, c.Description, r.Context().Value(middleware.CtxUserKey), c.MinThreadRole, c.MinCommentRole)
 	if err != nil {
 		return err
 	}
-	var c Category
-	if err := json.Unmarshal(reqBody, &c); err != nil {
+	return json.NewEncoder(w).Encode(category)
+}
+
+func (s *Server) apiHandleSearch(w http.ResponseWriter, r *http.Request) error {
+	params, err := parseSearchParams(r)
+	if err != nil {
+		return err
+	}
+	page := r.Context().Value(middleware.CtxPageKey).(middleware.Page)
+	results, total, err := s.search(r.Context(), params, page)
+	if err != nil {
 		return err
 	}
+	// API clients get the snippets as HTML with the matches wrapped in <mark>.
+	for i := range results {
+		results[i].Snippet = templates.HighlightSnippet(results[i].Snippet).String()
+	}
+	resp := struct {
+		Total   int            `json:"total"`
+		Results []SearchResult `json:"results"`
+	}{
+		Total:   total,
+		Results: results,
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// authorizePostChange checks that the user making the request is allowed to
+// edit or delete a post, which is only the post's author or a moderator. q must
+// select the author_id of the post with the ID $1 if it hasn't been deleted.
+func (s *Server) authorizePostChange(r *http.Request, q string, id int) error {
+	row, err := s.dbClient.QueryRow(r.Context(), q, id)
+	if err != nil {
+		return err
+	}
+	var authorID int
+	if err := row.Scan(&authorID); errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("post %d not found", id))
+	} else if err != nil {
+		return err
+	}
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	role := r.Context().Value(middleware.CtxRoleKey).(middleware.Role)
+	if authorID != userID && !role.Can(middleware.PermModerate) {
+		return derror.Forbidden(fmt.Errorf("user %d cannot modify post %d", userID, id))
+	}
+	return nil
+}
+
+func (s *Server) apiHandlePatchThread(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
+	}
+	const authorQuery = `SELECT author_id FROM threads WHERE thread_id = $1 AND deleted_at IS NULL`
+	if err := s.authorizePostChange(r, authorQuery, id); err != nil {
+		return err
+	}
+
+	// Fields that are left out of the request are left unchanged.
+	var update struct {
+		Title *string `json:"title"`
+		Body  *string `json:"body"`
+	}
+	if err := validate.DecodeJSON(w, r, &update); err != nil {
+		return err
+	}
+	var errs validate.Errors
+	if update.Title != nil {
+		checkThreadTitle(&errs, *update.Title)
+	}
+	if update.Body != nil {
+		errs.Required("body", *update.Body)
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	// The current version of the thread is saved as a revision in the same
+	// statement that updates it.
 	const q = `
-	INSERT INTO categories (title, description, author_id)
-	VALUES ($1, $2, $3)
-	RETURNING category_id, title, description, author_id, created_at`
+	WITH old AS (
+		SELECT thread_id, title, body FROM threads
+		WHERE thread_id = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	), revision AS (
+		INSERT INTO post_revisions (thread_id, title, body, editor_id)
+		SELECT thread_id, title, body, $4 FROM old
+	)
+	UPDATE threads SET
+		title = COALESCE($2, threads.title),
+		body = COALESCE($3, threads.body),
+		edited_at = CURRENT_TIMESTAMP
+	FROM old
+	WHERE threads.thread_id = old.thread_id
+	RETURNING threads.thread_id, threads.author_id, threads.category_id, threads.title, threads.body, threads.pinned, threads.locked, threads.created_at, threads.edited_at`
+
+	// Users who are newly mentioned by the edit are notified that the editor
+	// mentioned them.
+	var thread Thread
+	err = s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		var err error
+		thread, err = pg.QueryRowToStruct[Thread](r.Context(), tx, q, id, update.Title, update.Body, r.Context().Value(middleware.CtxUserKey))
+		if err != nil || update.Body == nil {
+			return err
+		}
+		mentioned, err := saveThreadMentions(r.Context(), tx, thread.ID, thread.Body)
+		if err != nil {
+			return err
+		}
+		return notifyMentions(r.Context(), tx, r.Context().Value(middleware.CtxUserKey).(int), thread.ID, nil, mentioned)
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(thread)
+}
 
-	category, err := pg.QueryRowToStruct[Category](r.Context(), s.dbClient, q, c.Title, c.Description, r.Context().Value(middleware.CtxUserKey))
+func (s *Server) apiHandleDeleteThread(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
+	}
+	const authorQuery = `SELECT author_id FROM threads WHERE thread_id = $1 AND deleted_at IS NULL`
+	if err := s.authorizePostChange(r, authorQuery, id); err != nil {
 		return err
 	}
-	return json.NewEncoder(w).Encode(category)
+
+	const q = `UPDATE threads SET deleted_at = CURRENT_TIMESTAMP WHERE thread_id = $1 AND deleted_at IS NULL`
+	if err := s.dbClient.Exec(r.Context(), q, id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) apiHandleGetThreadRevisions(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
+	}
+
+	const q = `
+	SELECT post_revisions.revision_id, COALESCE(post_revisions.title, '') AS title, post_revisions.body,
+		post_revisions.editor_id, users.username AS editor_name, post_revisions.created_at
+	FROM post_revisions
+	JOIN users ON post_revisions.editor_id = users.id
+	JOIN threads ON post_revisions.thread_id = threads.thread_id
+	WHERE post_revisions.thread_id = $1 AND threads.deleted_at IS NULL
+	ORDER BY post_revisions.created_at DESC`
+	revisions, err := pg.QueryRowsToStruct[Revision](r.Context(), s.dbClient, q, id)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(revisions)
+}
+
+func (s *Server) apiHandlePatchComment(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid comment ID %q", r.PathValue("id")))
+	}
+	const authorQuery = `SELECT author_id FROM comments WHERE comment_id = $1 AND deleted_at IS NULL`
+	if err := s.authorizePostChange(r, authorQuery, id); err != nil {
+		return err
+	}
+
+	var update struct {
+		Body string `json:"body"`
+	}
+	if err := validate.DecodeJSON(w, r, &update); err != nil {
+		return err
+	}
+	var errs validate.Errors
+	errs.Required("body", update.Body)
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	const q = `
+	WITH old AS (
+		SELECT comment_id, body FROM comments
+		WHERE comment_id = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	), revision AS (
+		INSERT INTO post_revisions (comment_id, body, editor_id)
+		SELECT comment_id, body, $3 FROM old
+	)
+	UPDATE comments SET body = $2, edited_at = CURRENT_TIMESTAMP
+	FROM old
+	WHERE comments.comment_id = old.comment_id
+	RETURNING comments.comment_id, comments.thread_id, comments.author_id, comments.body, comments.reply_id, comments.created_at, comments.edited_at`
+
+	// Users who are newly mentioned by the edit are notified that the editor
+	// mentioned them.
+	var comment Comment
+	err = s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		var err error
+		comment, err = pg.QueryRowToStruct[Comment](r.Context(), tx, q, id, update.Body, r.Context().Value(middleware.CtxUserKey))
+		if err != nil {
+			return err
+		}
+		mentioned, err := saveCommentMentions(r.Context(), tx, comment.ID, comment.Body)
+		if err != nil {
+			return err
+		}
+		return notifyMentions(r.Context(), tx, r.Context().Value(middleware.CtxUserKey).(int), comment.ThreadID, &comment.ID, mentioned)
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(comment)
+}
+
+func (s *Server) apiHandleDeleteComment(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid comment ID %q", r.PathValue("id")))
+	}
+	const authorQuery = `SELECT author_id FROM comments WHERE comment_id = $1 AND deleted_at IS NULL`
+	if err := s.authorizePostChange(r, authorQuery, id); err != nil {
+		return err
+	}
+
+	const q = `UPDATE comments SET deleted_at = CURRENT_TIMESTAMP WHERE comment_id = $1 AND deleted_at IS NULL`
+	if err := s.dbClient.Exec(r.Context(), q, id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) apiHandleGetCommentRevisions(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid comment ID %q", r.PathValue("id")))
+	}
+
+	const q = `
+	SELECT post_revisions.revision_id, '' AS title, post_revisions.body,
+		post_revisions.editor_id, users.username AS editor_name, post_revisions.created_at
+	FROM post_revisions
+	JOIN users ON post_revisions.editor_id = users.id
+	JOIN comments ON post_revisions.comment_id = comments.comment_id
+	WHERE post_revisions.comment_id = $1 AND comments.deleted_at IS NULL
+	ORDER BY post_revisions.created_at DESC`
+	revisions, err := pg.QueryRowsToStruct[Revision](r.Context(), s.dbClient, q, id)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(revisions)
+}
+
+// Moderation updates to the thread with the ID $1, which return the columns
+// of a Thread. They're shared with the admin commands in admin.go.
+const (
+	setThreadPinnedQuery = `
+	UPDATE threads SET pinned = $2 WHERE thread_id = $1 AND deleted_at IS NULL
+	RETURNING thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at`
+	setThreadLockedQuery = `
+	UPDATE threads SET locked = $2 WHERE thread_id = $1 AND deleted_at IS NULL
+	RETURNING thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at`
+	moveThreadQuery = `
+	UPDATE threads SET category_id = $2 WHERE thread_id = $1 AND deleted_at IS NULL
+	RETURNING thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at`
+)
+
+// moderateThread runs an admin update on the thread in the request path and
+// responds with the updated thread. q must update the thread with the ID $1
+// and return the columns of a Thread. Any args are used as $2, $3, etc.
+func (s *Server) moderateThread(w http.ResponseWriter, r *http.Request, q string, args ...any) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
+	}
+	thread, err := pg.QueryRowToStruct[Thread](r.Context(), s.dbClient, q, append([]any{id}, args...)...)
+	if errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("thread %d not found", id))
+	} else if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(thread)
+}
+
+func (s *Server) apiHandlePinThread(w http.ResponseWriter, r *http.Request) error {
+	return s.moderateThread(w, r, setThreadPinnedQuery, true)
+}
+
+func (s *Server) apiHandleUnpinThread(w http.ResponseWriter, r *http.Request) error {
+	return s.moderateThread(w, r, setThreadPinnedQuery, false)
+}
+
+func (s *Server) apiHandleLockThread(w http.ResponseWriter, r *http.Request) error {
+	return s.moderateThread(w, r, setThreadLockedQuery, true)
+}
+
+func (s *Server) apiHandleUnlockThread(w http.ResponseWriter, r *http.Request) error {
+	return s.moderateThread(w, r, setThreadLockedQuery, false)
+}
+
+func (s *Server) apiHandleMoveThread(w http.ResponseWriter, r *http.Request) error {
+	var move struct {
+		CategoryID int `json:"category_id"`
+	}
+	if err := validate.DecodeJSON(w, r, &move); err != nil {
+		return err
+	}
+
+	const checkCategory = "SELECT EXISTS(SELECT 1 FROM categories WHERE category_id = $1)"
+	row, err := s.dbClient.QueryRow(r.Context(), checkCategory, move.CategoryID)
+	if err != nil {
+		return err
+	}
+	var categoryExists bool
+	if err := row.Scan(&categoryExists); err != nil {
+		return err
+	}
+	if !categoryExists {
+		return validate.Errors{{Field: "category_id", Message: "must be an existing category"}}
+	}
+
+	return s.moderateThread(w, r, moveThreadQuery, move.CategoryID)
+}
+
+// apiHandleMergeThread merges the thread in the request path into the target
+// thread. The comments are moved to the target thread, the opening post of the
+// merged thread becomes a comment in the target thread, and the merged thread
+// is deleted. The response is the target thread.
+func (s *Server) apiHandleMergeThread(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid thread ID %q", r.PathValue("id")))
+	}
+	var merge struct {
+		TargetThreadID int `json:"target_thread_id"`
+	}
+	if err := validate.DecodeJSON(w, r, &merge); err != nil {
+		return err
+	}
+	if merge.TargetThreadID == id {
+		return derror.BadRequest(errors.New("cannot merge a thread into itself"))
+	}
+
+	const checkThread = "SELECT EXISTS(SELECT 1 FROM threads WHERE thread_id = $1 AND deleted_at IS NULL)"
+	for _, threadID := range []int{id, merge.TargetThreadID} {
+		row, err := s.dbClient.QueryRow(r.Context(), checkThread, threadID)
+		if err != nil {
+			return err
+		}
+		var threadExists bool
+		if err := row.Scan(&threadExists); err != nil {
+			return err
+		}
+		if !threadExists {
+			return derror.NotFound(fmt.Errorf("thread %d not found", threadID))
+		}
+	}
+
+	// All of the changes are made in a single statement so a failure can't
+	// leave the comments split between the two threads. The opening post's
+	// mentions move to the comment it becomes.
+	const q = `
+	WITH source AS (
+		UPDATE threads SET deleted_at = CURRENT_TIMESTAMP
+		WHERE thread_id = $1 AND deleted_at IS NULL
+		RETURNING thread_id, title, body, author_id, created_at
+	), opening_post AS (
+		INSERT INTO comments (thread_id, body, author_id, created_at)
+		SELECT $2, '**' || title || E'**\n\n' || body, author_id, created_at FROM source
+		RETURNING comment_id
+	), opening_post_mentions AS (
+		INSERT INTO mentions (user_id, comment_id, username)
+		SELECT mentions.user_id, opening_post.comment_id, mentions.username
+		FROM mentions, opening_post
+		WHERE mentions.thread_id = $1
+	)
+	UPDATE comments SET thread_id = $2
+	FROM source
+	WHERE comments.thread_id = source.thread_id`
+	if err := s.dbClient.Exec(r.Context(), q, id, merge.TargetThreadID); err != nil {
+		return err
+	}
+
+	const targetQuery = `SELECT thread_id, author_id, category_id, title, body, pinned, locked, created_at, edited_at FROM threads WHERE thread_id = $1`
+	thread, err := pg.QueryRowToStruct[Thread](r.Context(), s.dbClient, targetQuery, merge.TargetThreadID)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(thread)
+}
+
+// maxMintedRegKeys is the most registration keys that can be minted at once.
+const maxMintedRegKeys = 100
+
+func (s *Server) apiHandlePostRegistrationKeys(w http.ResponseWriter, r *http.Request) error {
+	// Count defaults to a single key that can be used once and never expires.
+	mint := struct {
+		Count     int        `json:"count"`
+		MaxUses   int        `json:"max_uses"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}{Count: 1, MaxUses: 1}
+	if err := validate.DecodeJSON(w, r, &mint); err != nil {
+		return err
+	}
+	if mint.Count < 1 || mint.Count > maxMintedRegKeys {
+		return derror.BadRequest(fmt.Errorf("count must be between 1 and %d", maxMintedRegKeys))
+	}
+	if mint.MaxUses < 1 {
+		return derror.BadRequest(errors.New("max_uses must be at least 1"))
+	}
+	if mint.ExpiresAt != nil && mint.ExpiresAt.Before(time.Now()) {
+		return derror.BadRequest(errors.New("expires_at is in the past"))
+	}
+
+	keys, err := pg.QueryRowsToStruct[RegistrationKey](r.Context(), s.dbClient, mintRegKeysQuery, mint.MaxUses, mint.ExpiresAt, r.Context().Value(middleware.CtxUserKey), mint.Count)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(keys)
+}
+
+func (s *Server) apiHandleGetRegistrationKeys(w http.ResponseWriter, r *http.Request) error {
+	keys, err := listRegistrationKeys(r.Context(), s.dbClient)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(keys)
+}
+
+// apiHandleDeleteRegistrationKey revokes a registration key. Only keys that
+// haven't been used can be revoked so the record of who used a key is kept.
+func (s *Server) apiHandleDeleteRegistrationKey(w http.ResponseWriter, r *http.Request) error {
+	regKey := r.PathValue("key")
+
+	row, err := s.dbClient.QueryRow(r.Context(), revokeRegKeyQuery, regKey)
+	if err != nil {
+		return err
+	}
+	var revoked, exists bool
+	if err := row.Scan(&revoked, &exists); err != nil {
+		return err
+	}
+	if !revoked {
+		if !exists {
+			return derror.NotFound(fmt.Errorf("registration key %q not found", regKey))
+		}
+		return derror.Conflict(fmt.Errorf("registration key %q has already been used", regKey))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiHandlePutUserRole changes a user's role. The change applies to the
+// user's next request since their cached role is invalidated. Admins can't
+// change their own role so the forum can't be left without an admin.
+func (s *Server) apiHandlePutUserRole(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid user ID %q", r.PathValue("id")))
+	}
+	if id == r.Context().Value(middleware.CtxUserKey).(int) {
+		return derror.Conflict(errors.New("admins can't change their own role"))
+	}
+
+	var update struct {
+		Role middleware.Role `json:"role"`
+	}
+	if err := validate.DecodeJSON(w, r, &update); err != nil {
+		return err
+	}
+	if !update.Role.Valid() {
+		return derror.BadRequest(fmt.Errorf("invalid role %q", update.Role))
+	}
+
+	const q = "UPDATE users SET role = $2 WHERE id = $1 RETURNING id, username, role"
+	row, err := s.dbClient.QueryRow(r.Context(), q, id, update.Role)
+	if err != nil {
+		return err
+	}
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.Role); errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("user %d not found", id))
+	} else if err != nil {
+		return err
+	}
+	s.roles.Invalidate(id)
+	return json.NewEncoder(w).Encode(user)
 }
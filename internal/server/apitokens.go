@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/internal/validate"
+)
+
+// maxAPITokenNameLength matches the name column of api_tokens.
+const maxAPITokenNameLength = 100
+
+// apiTokensQuery selects the user $1's API tokens that haven't been revoked
+// or expired, newest first.
+const apiTokensQuery = `
+SELECT token_id, name, scope, created_at, last_used_at, expires_at
+FROM api_tokens
+WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+ORDER BY created_at DESC, token_id DESC`
+
+// apiTokenStore implements middleware.APITokenStore using the api_tokens
+// table.
+type apiTokenStore struct {
+	dbClient *pg.Client
+}
+
+// APIToken returns the token if it hasn't been revoked or expired. Like
+// sessions, it also records when the token was last used, at most every few
+// minutes.
+func (st apiTokenStore) APIToken(ctx context.Context, token string) (middleware.APIToken, error) {
+	hash := sha256.Sum256([]byte(token))
+	const q = `
+	WITH active AS (
+		SELECT token_id, user_id, scope, last_used_at FROM api_tokens
+		WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+	), used AS (
+		UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP
+		FROM active
+		WHERE api_tokens.token_id = active.token_id
+			AND (active.last_used_at IS NULL OR active.last_used_at < CURRENT_TIMESTAMP - INTERVAL '5 minutes')
+	)
+	SELECT token_id, user_id, scope FROM active`
+	row, err := st.dbClient.QueryRow(ctx, q, hash[:])
+	if err != nil {
+		return middleware.APIToken{}, err
+	}
+	var t middleware.APIToken
+	if err := row.Scan(&t.ID, &t.UserID, &t.Scope); errors.Is(err, pg.ErrNoRows) {
+		return middleware.APIToken{}, errors.New("unknown API token")
+	} else if err != nil {
+		return middleware.APIToken{}, err
+	}
+	return t, nil
+}
+
+// sessionOnly rejects requests authorized with an API token. It's used for
+// routes that manage credentials, so a leaked token can't be used to take
+// over the account or to mint a more privileged token.
+func sessionOnly(f func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if middleware.UsingAPIToken(r) {
+			return derror.Forbidden(errors.New("API tokens can't be used to manage account credentials"))
+		}
+		return f(w, r)
+	}
+}
+
+func (s *Server) apiHandleGetMeTokens(w http.ResponseWriter, r *http.Request) error {
+	tokens, err := pg.QueryRowsToStruct[APIToken](r.Context(), s.dbClient, apiTokensQuery, r.Context().Value(middleware.CtxUserKey))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(tokens)
+}
+
+// apiHandlePostMeTokens creates an API token for the user. The response is
+// the only time the token itself is shown, since only its hash is stored.
+func (s *Server) apiHandlePostMeTokens(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Name      string     `json:"name"`
+		Scope     string     `json:"scope"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := validate.DecodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	scope := middleware.Permission(req.Scope)
+	var errs validate.Errors
+	errs.Required("name", req.Name)
+	errs.MaxLength("name", req.Name, maxAPITokenNameLength)
+	errs.Check(middleware.ValidScope(scope), "scope", "must be %q, %q or %q", middleware.PermRead, middleware.PermPost, middleware.PermAdmin)
+	errs.Check(req.ExpiresAt == nil || req.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	if role, _ := r.Context().Value(middleware.CtxRoleKey).(middleware.Role); !role.Can(scope) {
+		return derror.Forbidden(fmt.Errorf("role %q can't create tokens with the %q scope", role, scope))
+	}
+
+	token := middleware.APITokenPrefix + rand.Text()
+	hash := sha256.Sum256([]byte(token))
+	const q = `
+	INSERT INTO api_tokens (token_hash, user_id, name, scope, expires_at)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING token_id, name, scope, created_at, last_used_at, expires_at`
+	created, err := pg.QueryRowsToStruct[APIToken](r.Context(), s.dbClient, q, hash[:], r.Context().Value(middleware.CtxUserKey), req.Name, req.Scope, req.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if len(created) != 1 {
+		return fmt.Errorf("inserting API token returned %d rows", len(created))
+	}
+
+	resp := struct {
+		APIToken
+		Token string `json:"token"`
+	}{created[0], token}
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// apiHandleDeleteMeToken revokes one of the user's API tokens.
+func (s *Server) apiHandleDeleteMeToken(w http.ResponseWriter, r *http.Request) error {
+	tokenID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid token id %q", r.PathValue("id")))
+	}
+	const q = `
+	UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP
+	WHERE token_id = $1 AND user_id = $2 AND revoked_at IS NULL
+	RETURNING token_id`
+	row, err := s.dbClient.QueryRow(r.Context(), q, tokenID, r.Context().Value(middleware.CtxUserKey))
+	if err != nil {
+		return err
+	}
+	if err := row.Scan(&tokenID); errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("API token %d not found", tokenID))
+	} else if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/jessesomerville/yodahunters/internal/envconfig"
+	"github.com/jessesomerville/yodahunters/internal/log"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// retiredKeyGrace is how long a retired JWT secret is still accepted, long
+// enough for every access token signed with it to expire.
+const retiredKeyGrace = middleware.AccessTokenTTL + middleware.ClockSkew
+
+// pgKeyStore implements middleware.KeyStore using the jwt_keys table. The
+// current secret is generated the first time it's needed, so every server
+// using the same database shares it.
+type pgKeyStore struct {
+	dbClient *pg.Client
+}
+
+// Keyring implements middleware.KeyStore. It returns the current secret,
+// generating one if there isn't one yet, and the recently retired secrets.
+func (st pgKeyStore) Keyring(ctx context.Context) (*middleware.Keyring, error) {
+	secret := make([]byte, middleware.MinKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	// If another server generated the current secret first, the unique index
+	// on current secrets makes this a no-op.
+	const insert = "INSERT INTO jwt_keys (secret) VALUES ($1) ON CONFLICT DO NOTHING"
+	if err := st.dbClient.Exec(ctx, insert, secret); err != nil {
+		return nil, err
+	}
+
+	const q = `
+	SELECT secret, retired_at IS NULL AS current
+	FROM jwt_keys
+	WHERE retired_at IS NULL OR retired_at > CURRENT_TIMESTAMP - make_interval(secs => $1)
+	ORDER BY current DESC, retired_at DESC`
+	keys, err := pg.QueryRowsToStruct[struct {
+		Secret  []byte `db:"secret"`
+		Current bool   `db:"current"`
+	}](ctx, st.dbClient, q, retiredKeyGrace.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || !keys[0].Current {
+		return nil, errors.New("jwt_keys has no current secret")
+	}
+	var previous [][]byte
+	for _, k := range keys[1:] {
+		previous = append(previous, k.Secret)
+	}
+	return middleware.NewKeyring(keys[0].Secret, previous...)
+}
+
+// loadJWTKeys returns the keys JWTs are signed with from the store chosen by
+// YODAHUNTERS_JWT_KEY_STORE. Outside of dev mode the server refuses to start
+// without a durable secret, since a random one would log everyone out every
+// time it restarts.
+func loadJWTKeys(ctx context.Context, dbClient *pg.Client, devmode bool) (*middleware.Keyring, error) {
+	var store middleware.KeyStore
+	switch name := envconfig.GetEnvOrDefault("YODAHUNTERS_JWT_KEY_STORE", "env"); name {
+	case "env":
+		store = middleware.EnvKeyStore{Current: "YODAHUNTERS_JWT_SECRET", Previous: "YODAHUNTERS_JWT_PREVIOUS_SECRETS"}
+	case "file":
+		store = middleware.FileKeyStore{Path: envconfig.GetEnvOrDefault("YODAHUNTERS_JWT_KEY_FILE", "")}
+	case "postgres":
+		store = pgKeyStore{dbClient}
+	default:
+		return nil, fmt.Errorf("unknown JWT key store %q", name)
+	}
+
+	keys, err := store.Keyring(ctx)
+	if err == nil {
+		return keys, nil
+	}
+	if !devmode {
+		return nil, fmt.Errorf("loading JWT secret: %w", err)
+	}
+	log.Warnf(ctx, "Falling back to ephemeral JWT secret: %v", err)
+	return middleware.NewEphemeralKeyring()
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins are throttled per username and per IP address. After a few
+// free failures each further failure doubles how long the next attempt has
+// to wait, up to a maximum, which effectively locks the account or address
+// out temporarily. A successful login resets the count for the username.
+const (
+	accountFreeFailures = 3
+	accountMaxBackoff   = 15 * time.Minute
+	accountWindow       = 24 * time.Hour
+
+	ipFreeFailures = 20
+	ipMaxBackoff   = time.Hour
+	ipWindow       = time.Hour
+)
+
+// The reasons recorded for failed login attempts. An attempt is pending
+// while the password is checked, and counts as a failure until it's
+// finished.
+const (
+	loginPending       = "pending"
+	loginUnknownUser   = "unknown_user"
+	loginWrongPassword = "wrong_password"
+	loginThrottled     = "throttled"
+)
+
+// errInvalidCredentials is returned for both unknown usernames and wrong
+// passwords so the response doesn't reveal which usernames exist.
+var errInvalidCredentials = derror.Unauthorized(errors.New("invalid credentials"))
+
+// dummyPasswordHash is checked against when the username doesn't exist so
+// that unknown usernames take as long to reject as wrong passwords.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// loginBackoff returns how long to wait after the last failed attempt before
+// allowing another, given the number of recent failures.
+func loginBackoff(failures, free int, maxBackoff time.Duration) time.Duration {
+	if failures < free {
+		return 0
+	}
+	exp := failures - free
+	if exp >= 32 {
+		return maxBackoff
+	}
+	return min(time.Second<<exp, maxBackoff)
+}
+
+// loginRetryAfter returns how long the client has to wait before trying to log
+// in as the username, or 0 if they can try now.
+func loginRetryAfter(ctx context.Context, querier pg.Querier, username, ip string) (time.Duration, error) {
+	const q = `
+	WITH account AS (
+		SELECT COUNT(*) AS failures, MAX(created_at) AS last_failure
+		FROM login_attempts
+		WHERE username = $1 AND NOT succeeded AND reason <> $5 AND created_at > $3
+			AND created_at > COALESCE(
+				(SELECT MAX(created_at) FROM login_attempts WHERE username = $1 AND succeeded),
+				'-infinity')
+	), ip AS (
+		SELECT COUNT(*) AS failures, MAX(created_at) AS last_failure
+		FROM login_attempts
+		WHERE ip_address = $2 AND NOT succeeded AND reason <> $5 AND created_at > $4
+	)
+	SELECT account.failures, account.last_failure, ip.failures, ip.last_failure
+	FROM account, ip`
+	now := time.Now()
+	row, err := querier.QueryRow(ctx, q, username, ip, now.Add(-accountWindow), now.Add(-ipWindow), loginThrottled)
+	if err != nil {
+		return 0, err
+	}
+	var accountFailures, ipFailures int
+	var accountLast, ipLast *time.Time
+	if err := row.Scan(&accountFailures, &accountLast, &ipFailures, &ipLast); err != nil {
+		return 0, err
+	}
+
+	var retryAfter time.Duration
+	if accountLast != nil {
+		retryAfter = max(retryAfter, accountLast.Add(loginBackoff(accountFailures, accountFreeFailures, accountMaxBackoff)).Sub(now))
+	}
+	if ipLast != nil {
+		retryAfter = max(retryAfter, ipLast.Add(loginBackoff(ipFailures, ipFreeFailures, ipMaxBackoff)).Sub(now))
+	}
+	return retryAfter, nil
+}
+
+// auditUsername returns the username as it's stored in the audit trail.
+// Usernames are at most 100 characters, so anything longer can only be a
+// failed attempt and is stored truncated.
+func auditUsername(username string) string {
+	if chars := []rune(username); len(chars) > maxUsernameLength {
+		return string(chars[:maxUsernameLength])
+	}
+	return username
+}
+
+// insertLoginAttempt adds a login attempt to the audit trail and returns its
+// ID. userID is 0 if the username doesn't belong to an account.
+func insertLoginAttempt(r *http.Request, querier pg.Querier, username string, userID int, succeeded bool, reason string) (int64, error) {
+	const q = `
+	INSERT INTO login_attempts (username, user_id, ip_address, user_agent, succeeded, reason)
+	VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)
+	RETURNING attempt_id`
+	row, err := querier.QueryRow(r.Context(), q, auditUsername(username), userID, middleware.ClientIP(r), r.UserAgent(), succeeded, reason)
+	if err != nil {
+		return 0, err
+	}
+	var attemptID int64
+	err = row.Scan(&attemptID)
+	return attemptID, err
+}
+
+// recordLoginAttempt adds a finished login attempt to the audit trail.
+func (s *Server) recordLoginAttempt(r *http.Request, username string, userID int, succeeded bool, reason string) error {
+	_, err := insertLoginAttempt(r, s.dbClient, username, userID, succeeded, reason)
+	return err
+}
+
+// startLoginAttempt records a pending attempt to log in as the username and
+// returns its ID, which the result is recorded with by finishLoginAttempt. If
+// the client has to wait before trying again, the attempt is recorded as
+// throttled instead and an error is returned, setting the Retry-After header
+// on the response.
+//
+// Attempts for the same username or from the same IP address are checked one
+// at a time, and a pending attempt counts as a failure, so concurrent guesses
+// can't all get in before any of them has failed.
+func (s *Server) startLoginAttempt(w http.ResponseWriter, r *http.Request, username string) (int64, error) {
+	username = auditUsername(username)
+	ip := middleware.ClientIP(r)
+	var attemptID int64
+	var retryAfter time.Duration
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		// The username lock is always taken first so two attempts can't
+		// deadlock.
+		if err := tx.Exec(r.Context(), "SELECT pg_advisory_xact_lock(1, hashtext($1))", username); err != nil {
+			return err
+		}
+		if err := tx.Exec(r.Context(), "SELECT pg_advisory_xact_lock(2, hashtext($1))", ip); err != nil {
+			return err
+		}
+		var err error
+		retryAfter, err = loginRetryAfter(r.Context(), tx, username, ip)
+		if err != nil {
+			return err
+		}
+		reason := loginPending
+		if retryAfter > 0 {
+			reason = loginThrottled
+		}
+		attemptID, err = insertLoginAttempt(r, tx, username, 0, false, reason)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return 0, &derror.ServerError{Status: http.StatusTooManyRequests, Err: errors.New("too many failed login attempts, try again later")}
+	}
+	return attemptID, nil
+}
+
+// finishLoginAttempt records the result of an attempt started by
+// startLoginAttempt. userID is 0 if the username doesn't belong to an account.
+func (s *Server) finishLoginAttempt(ctx context.Context, attemptID int64, userID int, succeeded bool, reason string) error {
+	const q = "UPDATE login_attempts SET user_id = NULLIF($2, 0), succeeded = $3, reason = $4 WHERE attempt_id = $1"
+	return s.dbClient.Exec(ctx, q, attemptID, userID, succeeded, reason)
+}
+
+// loginAttemptsQuery selects a page of the login audit trail, newest first.
+// Only attempts for the username $1 and from the IP address $2 are selected
+// unless they're NULL, and only failures if $3 is set. $4 and $5 are the
+// offset and limit.
+const loginAttemptsQuery = `
+SELECT attempt_id, username, COALESCE(user_id, 0) AS user_id, ip_address, user_agent, succeeded, reason, created_at
+FROM login_attempts
+WHERE ($1::text IS NULL OR username = $1)
+	AND ($2::text IS NULL OR ip_address = $2)
+	AND (NOT $3 OR NOT succeeded)
+ORDER BY created_at DESC, attempt_id DESC
+OFFSET $4 LIMIT $5`
+
+// loginAttemptsFilter holds the filters for the login audit trail. Optional
+// filters are nil when they weren't provided.
+type loginAttemptsFilter struct {
+	Username   *string
+	IPAddress  *string
+	FailedOnly bool
+}
+
+// parseLoginAttemptsFilter reads the audit trail filters from the URL query
+// parameters: username, ip, and failed=true to only show failures.
+func parseLoginAttemptsFilter(r *http.Request) loginAttemptsFilter {
+	query := r.URL.Query()
+	var filter loginAttemptsFilter
+	if v := query.Get("username"); v != "" {
+		filter.Username = &v
+	}
+	if v := query.Get("ip"); v != "" {
+		filter.IPAddress = &v
+	}
+	filter.FailedOnly = query.Get("failed") == "true"
+	return filter
+}
+
+func (s *Server) listLoginAttempts(ctx context.Context, filter loginAttemptsFilter, page middleware.Page) ([]LoginAttempt, error) {
+	return pg.QueryRowsToStruct[LoginAttempt](ctx, s.dbClient, loginAttemptsQuery,
+		filter.Username, filter.IPAddress, filter.FailedOnly, page.Size*(page.Number-1), page.Size)
+}
+
+// apiHandleGetLoginAttempts returns a page of the login audit trail.
+func (s *Server) apiHandleGetLoginAttempts(w http.ResponseWriter, r *http.Request) error {
+	page := r.Context().Value(middleware.CtxPageKey).(middleware.Page)
+	attempts, err := s.listLoginAttempts(r.Context(), parseLoginAttemptsFilter(r), page)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(attempts)
+}
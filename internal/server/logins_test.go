@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures, free int
+		maxBackoff     time.Duration
+		want           time.Duration
+	}{
+		{failures: 0, free: 3, maxBackoff: time.Minute, want: 0},
+		{failures: 2, free: 3, maxBackoff: time.Minute, want: 0},
+		{failures: 3, free: 3, maxBackoff: time.Minute, want: time.Second},
+		{failures: 4, free: 3, maxBackoff: time.Minute, want: 2 * time.Second},
+		{failures: 8, free: 3, maxBackoff: time.Minute, want: 32 * time.Second},
+		{failures: 9, free: 3, maxBackoff: time.Minute, want: time.Minute},
+		{failures: 0, free: 0, maxBackoff: time.Minute, want: time.Second},
+		// The shift would overflow without the cap.
+		{failures: 35, free: 3, maxBackoff: time.Minute, want: time.Minute},
+		{failures: 1000, free: 3, maxBackoff: time.Minute, want: time.Minute},
+		{failures: 19, free: ipFreeFailures, maxBackoff: ipMaxBackoff, want: 0},
+		{failures: 40, free: ipFreeFailures, maxBackoff: ipMaxBackoff, want: ipMaxBackoff},
+		{failures: 13, free: accountFreeFailures, maxBackoff: accountMaxBackoff, want: accountMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures, tt.free, tt.maxBackoff); got != tt.want {
+			t.Errorf("loginBackoff(%d, %d, %v) = %v, want %v", tt.failures, tt.free, tt.maxBackoff, got, tt.want)
+		}
+	}
+}
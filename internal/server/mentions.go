@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/templates"
+)
+
+// maxMentions is how many users a post can mention, so a post can't be used
+// to notify everyone.
+const maxMentions = 10
+
+// mentionedUsernames returns the usernames mentioned in a post's body, in the
+// order they're first mentioned.
+func mentionedUsernames(body string) []string {
+	names := templates.Mentions(body, maxMentions)
+	// A nil slice would be a NULL array, which matches nothing in
+	// saveMentions' DELETE.
+	if names == nil {
+		names = []string{}
+	}
+	return names
+}
+
+// saveThreadMentions stores the users mentioned in a thread's opening post,
+// replacing the ones stored when it was last saved. It returns the IDs of the
+// users who weren't mentioned in it before.
+func saveThreadMentions(ctx context.Context, tx *pg.Tx, threadID int, body string) ([]int, error) {
+	return saveMentions(ctx, tx, "thread_id", threadID, body)
+}
+
+// saveCommentMentions is saveThreadMentions for a comment.
+func saveCommentMentions(ctx context.Context, tx *pg.Tx, commentID int, body string) ([]int, error) {
+	return saveMentions(ctx, tx, "comment_id", commentID, body)
+}
+
+// saveMentions stores the mentions in body of the post with the ID in column.
+// Mentions that are still in the post keep the user they were resolved to
+// when they were first saved.
+func saveMentions(ctx context.Context, tx *pg.Tx, column string, id int, body string) ([]int, error) {
+	names := mentionedUsernames(body)
+	if err := tx.Exec(ctx, "DELETE FROM mentions WHERE "+column+" = $1 AND username <> ALL($2::text[])", id, names); err != nil {
+		return nil, err
+	}
+	q := `
+	INSERT INTO mentions (user_id, ` + column + `, username)
+	SELECT id, $1, username FROM users WHERE username = ANY($2::text[])
+	ON CONFLICT DO NOTHING
+	RETURNING user_id`
+	rows, err := tx.Query(ctx, q, id, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
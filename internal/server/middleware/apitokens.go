@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CtxAPITokenKey is used to set and retrieve the ID of the API token a
+// request was authorized with.
+const CtxAPITokenKey ctxKey = "apiTokenID"
+
+// APITokenPrefix starts every personal API token so they're easy to
+// recognize, e.g. by secret scanners.
+const APITokenPrefix = "yh_"
+
+// An APIToken is a personal access token a user created for scripts and bots.
+type APIToken struct {
+	ID     int
+	UserID int
+	// Scope is the most privileged permission the token grants, one of
+	// PermRead, PermPost or PermAdmin. It caps the role of the user the
+	// token belongs to, it doesn't grant anything the user can't do.
+	Scope Permission
+}
+
+// An APITokenStore looks up personal API tokens.
+type APITokenStore interface {
+	// APIToken returns the token if it exists and hasn't been revoked or
+	// expired.
+	APIToken(ctx context.Context, token string) (APIToken, error)
+}
+
+// scopeRoles maps each API token scope to the most privileged role it
+// allows acting as.
+var scopeRoles = map[Permission]Role{
+	PermRead:  RoleReadOnly,
+	PermPost:  RoleMember,
+	PermAdmin: RoleAdmin,
+}
+
+// ValidScope reports whether p can be used as an API token scope.
+func ValidScope(p Permission) bool {
+	_, ok := scopeRoles[p]
+	return ok
+}
+
+// CapRole returns the role if the scope allows it, otherwise the most
+// privileged role the scope allows.
+func CapRole(role Role, scope Permission) Role {
+	limit, ok := scopeRoles[scope]
+	if !ok {
+		return ""
+	}
+	if role.AtLeast(limit) {
+		return limit
+	}
+	return role
+}
+
+// bearerToken returns the token in the request's Authorization header and
+// whether it had one.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authorizeAPIToken returns the API token in the request's Authorization
+// header.
+func authorizeAPIToken(r *http.Request, auth Auth, token string) (APIToken, error) {
+	if auth.APITokens == nil {
+		return APIToken{}, errors.New("API tokens are not accepted")
+	}
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return APIToken{}, errors.New("malformed API token")
+	}
+	return auth.APITokens.APIToken(r.Context(), token)
+}
+
+// UsingAPIToken reports whether the request was authorized with an API token
+// rather than a login session.
+func UsingAPIToken(r *http.Request) bool {
+	_, ok := r.Context().Value(CtxAPITokenKey).(int)
+	return ok
+}
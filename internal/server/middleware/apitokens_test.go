@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeAPITokenStore map[string]APIToken
+
+func (f fakeAPITokenStore) APIToken(_ context.Context, token string) (APIToken, error) {
+	t, ok := f[token]
+	if !ok {
+		return APIToken{}, errors.New("unknown API token")
+	}
+	return t, nil
+}
+
+func TestCapRole(t *testing.T) {
+	tests := []struct {
+		role  Role
+		scope Permission
+		want  Role
+	}{
+		{RoleAdmin, PermAdmin, RoleAdmin},
+		{RoleAdmin, PermPost, RoleMember},
+		{RoleModerator, PermPost, RoleMember},
+		{RoleMember, PermAdmin, RoleMember},
+		{RoleMember, PermRead, RoleReadOnly},
+		{RoleReadOnly, PermPost, RoleReadOnly},
+		{RoleAdmin, PermModerate, ""},
+	}
+	for _, tt := range tests {
+		if got := CapRole(tt.role, tt.scope); got != tt.want {
+			t.Errorf("CapRole(%q, %q) = %q, want %q", tt.role, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizationHandler_APIToken(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	tokens := fakeAPITokenStore{
+		"yh_POST": {ID: 1, UserID: 42, Scope: PermPost},
+		"yh_READ": {ID: 2, UserID: 42, Scope: PermRead},
+	}
+	roles := &fakeRoleStore{roles: map[int]Role{42: RoleModerator}}
+	tests := []struct {
+		name     string
+		header   string
+		store    APITokenStore
+		wantRole Role
+	}{
+		{name: "post scope", header: "Bearer yh_POST", store: tokens, wantRole: RoleMember},
+		{name: "read scope", header: "bearer yh_READ", store: tokens, wantRole: RoleReadOnly},
+		{name: "unknown token", header: "Bearer yh_BOGUS", store: tokens},
+		{name: "missing prefix", header: "Bearer POST", store: fakeAPITokenStore{"POST": tokens["yh_POST"]}},
+		{name: "tokens not accepted", header: "Bearer yh_POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			var gotRole Role
+			var gotTokenID int
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				gotRole = r.Context().Value(CtxRoleKey).(Role)
+				gotTokenID, _ = r.Context().Value(CtxAPITokenKey).(int)
+			})
+			handler := AuthorizationHandler(next, Auth{Keys: secret, Roles: roles, APITokens: tt.store})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", tt.header)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if called != (tt.wantRole != "") {
+				t.Fatalf("next called = %t, want %t", called, tt.wantRole != "")
+			}
+			if !called {
+				if rr.Code != http.StatusUnauthorized {
+					t.Errorf("got status %d, want %d", rr.Code, http.StatusUnauthorized)
+				}
+				return
+			}
+			if gotRole != tt.wantRole {
+				t.Errorf("got role %q, want %q", gotRole, tt.wantRole)
+			}
+			if gotTokenID == 0 {
+				t.Error("expected the API token ID in the context")
+			}
+		})
+	}
+}
+
+func TestAuthorize_APIToken(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer yh_TOKEN")
+
+	tokens := fakeAPITokenStore{"yh_TOKEN": {ID: 1, UserID: 42, Scope: PermRead}}
+	userID, err := Authorize(req, Auth{Keys: secret, APITokens: tokens})
+	if err != nil {
+		t.Fatalf("Authorize returned error: %v", err)
+	}
+	if userID != 42 {
+		t.Errorf("got userID %d, want 42", userID)
+	}
+}
+
+// A read-scoped token can't change anything, even though the user's role
+// could.
+func TestChain_ReadScopedAPIToken(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	tokens := fakeAPITokenStore{"yh_READ": {ID: 1, UserID: 42, Scope: PermRead}}
+	roles := &fakeRoleStore{roles: map[int]Role{42: RoleMember}}
+	auth := Auth{Keys: secret, Roles: roles, APITokens: tokens}
+	tests := []struct {
+		perm       Permission
+		wantStatus int
+	}{
+		{PermRead, http.StatusOK},
+		{PermPost, http.StatusForbidden},
+		{PermModerate, http.StatusForbidden},
+		{PermAdmin, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		var called bool
+		handler := Chain(func(w http.ResponseWriter, r *http.Request) error {
+			called = true
+			return nil
+		}, auth, tt.perm)
+
+		req := httptest.NewRequest(http.MethodPost, "/me", nil)
+		req.Header.Set("Authorization", "Bearer yh_READ")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%q route: got status %d, want %d", tt.perm, rr.Code, tt.wantStatus)
+		}
+		if called != (tt.wantStatus == http.StatusOK) {
+			t.Errorf("%q route: handler called = %t", tt.perm, called)
+		}
+	}
+}
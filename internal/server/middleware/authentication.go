@@ -1,12 +1,13 @@
 package middleware
 
 import (
-	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -14,12 +15,16 @@ import (
 type joseHeader struct {
 	Alg string `json:"alg"`
 	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
 }
 
 type jwsPayload struct {
-	UserID  int  `json:"user_id"`
-	IsAdmin bool `json:"is_admin"`
-	Exp     int  `json:"exp"`
+	UserID    int    `json:"user_id"`
+	IsAdmin   bool   `json:"is_admin"`
+	Exp       int    `json:"exp"`
+	IssuedAt  int    `json:"iat,omitempty"`
+	NotBefore int    `json:"nbf,omitempty"`
+	JTI       string `json:"jti,omitempty"`
 }
 
 // JWT is a struct that holds the relevant data for handling JWTs.
@@ -30,29 +35,106 @@ type JWT struct {
 	Raw       string
 }
 
-// GenerateJWT takes a user id and the signing secret and generates a JWT.
-// with the following structure:
+// AccessTokenTTL is how long a JWT is valid for. Access tokens are short-lived
+// since they're renewed with a refresh token once they expire.
+const AccessTokenTTL = 15 * time.Minute
+
+// ClockSkew is how far the clocks of the servers issuing and verifying a JWT
+// can be off from each other when checking its exp, nbf and iat claims.
+const ClockSkew = 30 * time.Second
+
+// jwtAlg is the only algorithm JWTs are signed with. Tokens with any other
+// alg header, including "none", are rejected.
+const jwtAlg = "HS256"
+
+// MinKeySize is the minimum length of a secret in a [Keyring].
+const MinKeySize = 32
+
+// A Keyring holds the secrets JWTs are signed with. New tokens are signed
+// with the current secret, and tokens signed with any of the secrets are
+// accepted, so the secret can be rotated without logging everyone out: the
+// old secret is kept as a previous secret until the tokens signed with it
+// have expired.
 //
-//	Header: {"alg":"HS256", "typ":"JWT"}
-//	Claims: {"user_id": user_id, "exp": [current time + 12hrs]}
-func GenerateJWT(userID int, isAdmin bool, secret []byte) (JWT, error) {
+// Each secret is identified by a key ID derived from it, which is set as the
+// kid header of the tokens it signs.
+type Keyring struct {
+	current string
+	secrets map[string][]byte
+}
+
+// NewKeyring returns a Keyring that signs tokens with the current secret and
+// also accepts tokens signed with the previous secrets.
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{secrets: make(map[string][]byte)}
+	for i, secret := range append([][]byte{current}, previous...) {
+		if len(secret) < MinKeySize {
+			return nil, fmt.Errorf("JWT secret %d is %d bytes, it must be at least %d", i, len(secret), MinKeySize)
+		}
+		kid := keyID(secret)
+		if i == 0 {
+			k.current = kid
+		}
+		k.secrets[kid] = secret
+	}
+	return k, nil
+}
+
+// keyID returns the ID of the secret: a truncated hash of it, which doesn't
+// reveal anything about the secret but stays the same across restarts and
+// servers using the same secret.
+func keyID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// CurrentKeyID returns the ID of the secret new tokens are signed with.
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// sign returns the HS256 signature of the message with the secret.
+func sign(secret []byte, message string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+// GenerateJWT takes a user id and the signing keys and generates a JWT
+// for a new session with the following structure:
+//
+//	Header: {"alg":"HS256", "typ":"JWT", "kid": [current key ID]}
+//	Claims: {"user_id": user_id, "exp": [current time + 15min], "iat": [current time], "nbf": [current time], "jti": [random ID]}
+//
+// The jti claim identifies the session the JWT is issued for.
+func GenerateJWT(userID int, isAdmin bool, keys *Keyring) (JWT, error) {
+	return GenerateSessionJWT(rand.Text(), userID, isAdmin, keys)
+}
+
+// GenerateSessionJWT generates a JWT like [GenerateJWT] for an existing
+// session, e.g. when the access token for the session is refreshed.
+func GenerateSessionJWT(sessionID string, userID int, isAdmin bool, keys *Keyring) (JWT, error) {
+	now := time.Now()
 	// Set the header and payload
 	jwt := JWT{
 		Header: joseHeader{
-			Alg: "HS256",
+			Alg: jwtAlg,
 			Typ: "JWT",
+			Kid: keys.current,
 		},
 		Payload: jwsPayload{
-			UserID:  userID,
-			IsAdmin: isAdmin,
-			Exp:     int((time.Now().Add(12 * time.Hour)).Unix()),
+			UserID:    userID,
+			IsAdmin:   isAdmin,
+			Exp:       int(now.Add(AccessTokenTTL).Unix()),
+			IssuedAt:  int(now.Unix()),
+			NotBefore: int(now.Unix()),
+			JTI:       sessionID,
 		},
 		Signature: nil,
 		Raw:       "",
 	}
 
 	// Sign the JWT
-	h := hmac.New(sha256.New, secret)
 	headerJSON, err := json.Marshal(jwt.Header)
 	if err != nil {
 		return JWT{}, err
@@ -63,8 +145,7 @@ func GenerateJWT(userID int, isAdmin bool, secret []byte) (JWT, error) {
 	}
 
 	message := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payloadJSON)
-	h.Write([]byte(message))
-	jwt.Signature = h.Sum(nil)
+	jwt.Signature = sign(keys.secrets[keys.current], message)
 	jwt.Raw = message + "." + base64.RawURLEncoding.EncodeToString(jwt.Signature)
 	return jwt, nil
 }
@@ -114,16 +195,45 @@ func (j *JWT) String() string {
 	return j.Raw
 }
 
-// IsValid verifies that the JWT data supplied in the struct is
-// was signed by the secret supplied, and that the JWT has not expired.
-func (j *JWT) IsValid(secret []byte) (bool, error) {
+// Verify checks that the JWT was signed with HS256 by one of the keys and
+// that it's currently valid according to its exp, nbf and iat claims,
+// allowing for [ClockSkew]. It returns an error describing why the JWT was
+// rejected if it isn't valid.
+func (j *JWT) Verify(keys *Keyring, now time.Time) error {
+	// The algorithm is fixed rather than taken from the header, so a token
+	// can't pick a weaker algorithm or none at all.
+	if j.Header.Alg != jwtAlg {
+		return fmt.Errorf("unexpected JWT algorithm %q", j.Header.Alg)
+	}
+	if j.Header.Typ != "" && j.Header.Typ != "JWT" {
+		return fmt.Errorf("unexpected JWT type %q", j.Header.Typ)
+	}
+	secret, ok := keys.secrets[j.Header.Kid]
+	if !ok {
+		return fmt.Errorf("JWT signed with unknown key %q", j.Header.Kid)
+	}
 	signatureStart := strings.LastIndex(j.Raw, ".")
-	headerPayload := j.Raw[:signatureStart]
+	if signatureStart < 0 {
+		return errors.New("malformed JWT")
+	}
+	if !hmac.Equal(j.Signature, sign(secret, j.Raw[:signatureStart])) {
+		return errors.New("invalid JWT signature")
+	}
 
-	h := hmac.New(sha256.New, secret)
-	h.Write([]byte(headerPayload))
-	if bytes.Equal(j.Signature, h.Sum(nil)) && (int(time.Now().Unix()) < j.Payload.Exp) {
-		return true, nil
+	if !now.Before(time.Unix(int64(j.Payload.Exp), 0).Add(ClockSkew)) {
+		return errors.New("JWT has expired")
 	}
-	return false, nil
+	if j.Payload.NotBefore != 0 && now.Add(ClockSkew).Before(time.Unix(int64(j.Payload.NotBefore), 0)) {
+		return errors.New("JWT isn't valid yet")
+	}
+	if j.Payload.IssuedAt != 0 && now.Add(ClockSkew).Before(time.Unix(int64(j.Payload.IssuedAt), 0)) {
+		return errors.New("JWT was issued in the future")
+	}
+	return nil
+}
+
+// IsValid reports whether the JWT was signed by one of the keys and is
+// currently valid. See [JWT.Verify] for why a JWT was rejected.
+func (j *JWT) IsValid(keys *Keyring) (bool, error) {
+	return j.Verify(keys, time.Now()) == nil, nil
 }
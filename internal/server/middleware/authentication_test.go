@@ -11,7 +11,7 @@ import (
 )
 
 func TestGenerateJWT(t *testing.T) {
-	secret := []byte("test-secret-key-for-jwt-testing!")
+	secret := testKeyring(t, "test-secret-key-for-jwt-testing!")
 
 	tests := []struct {
 		name    string
@@ -44,8 +44,8 @@ func TestGenerateJWT(t *testing.T) {
 				t.Errorf("Payload.IsAdmin = %v, want %v", jwt.Payload.IsAdmin, tt.isAdmin)
 			}
 
-			// Exp should be roughly 12 hours from now.
-			expectedExp := int(time.Now().Add(12 * time.Hour).Unix())
+			// Exp should be roughly AccessTokenTTL from now.
+			expectedExp := int(time.Now().Add(AccessTokenTTL).Unix())
 			if abs(jwt.Payload.Exp-expectedExp) > 5 {
 				t.Errorf("Payload.Exp = %d, want approximately %d", jwt.Payload.Exp, expectedExp)
 			}
@@ -76,7 +76,7 @@ func TestGenerateJWT(t *testing.T) {
 }
 
 func TestParseJWT(t *testing.T) {
-	secret := []byte("test-secret-key-for-jwt-testing!")
+	secret := testKeyring(t, "test-secret-key-for-jwt-testing!")
 
 	// Generate a valid token to use as the base valid case.
 	validJWT, err := GenerateJWT(7, false, secret)
@@ -164,13 +164,13 @@ func TestParseJWT(t *testing.T) {
 }
 
 func TestJWTIsValid(t *testing.T) {
-	secret := []byte("test-secret-key-for-jwt-testing!")
-	wrongSecret := []byte("wrong-secret-key-for-testing!!!!")
+	secret := testKeyring(t, "test-secret-key-for-jwt-testing!")
+	wrongSecret := testKeyring(t, "wrong-secret-key-for-testing!!!!")
 
 	tests := []struct {
 		name      string
 		setupJWT  func(t *testing.T) JWT
-		secret    []byte
+		secret    *Keyring
 		wantValid bool
 	}{
 		{
@@ -224,8 +224,138 @@ func TestJWTIsValid(t *testing.T) {
 	}
 }
 
+func TestJWTVerify(t *testing.T) {
+	const secret = "test-secret-key-for-jwt-testing!"
+	keys := testKeyring(t, secret)
+	kid := keys.CurrentKeyID()
+	now := time.Now()
+	exp := int(now.Add(AccessTokenTTL).Unix())
+
+	tests := []struct {
+		name    string
+		header  joseHeader
+		payload jwsPayload
+		secret  string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp, IssuedAt: int(now.Unix()), NotBefore: int(now.Unix())},
+			secret:  secret,
+		},
+		{
+			name:    "alg none",
+			header:  joseHeader{Alg: "none", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp},
+			secret:  secret,
+			wantErr: true,
+		},
+		{
+			name:    "alg HS512",
+			header:  joseHeader{Alg: "HS512", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp},
+			secret:  secret,
+			wantErr: true,
+		},
+		{
+			name:    "no kid",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT"},
+			payload: jwsPayload{UserID: 1, Exp: exp},
+			secret:  secret,
+			wantErr: true,
+		},
+		{
+			name:    "kid of another key",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp},
+			secret:  "wrong-secret-key-for-testing!!!!",
+			wantErr: true,
+		},
+		{
+			name:    "expired within clock skew",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: int(now.Add(-ClockSkew / 2).Unix())},
+			secret:  secret,
+		},
+		{
+			name:    "expired beyond clock skew",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: int(now.Add(-2 * ClockSkew).Unix())},
+			secret:  secret,
+			wantErr: true,
+		},
+		{
+			name:    "not before within clock skew",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp, NotBefore: int(now.Add(ClockSkew / 2).Unix())},
+			secret:  secret,
+		},
+		{
+			name:    "not valid yet",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp, NotBefore: int(now.Add(2 * ClockSkew).Unix())},
+			secret:  secret,
+			wantErr: true,
+		},
+		{
+			name:    "issued in the future",
+			header:  joseHeader{Alg: "HS256", Typ: "JWT", Kid: kid},
+			payload: jwsPayload{UserID: 1, Exp: exp, IssuedAt: int(now.Add(2 * ClockSkew).Unix())},
+			secret:  secret,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwt := buildJWT(t, tt.header, tt.payload, []byte(tt.secret))
+			err := jwt.Verify(keys, now)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("Verify() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKeys := testKeyring(t, "old-secret-key-for-jwt-testing!!")
+	oldJWT, err := GenerateJWT(1, false, oldKeys)
+	if err != nil {
+		t.Fatalf("GenerateJWT() returned error: %v", err)
+	}
+
+	newKeys, err := NewKeyring([]byte("new-secret-key-for-jwt-testing!!"), []byte("old-secret-key-for-jwt-testing!!"))
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+	if err := oldJWT.Verify(newKeys, time.Now()); err != nil {
+		t.Errorf("Verify() of a JWT signed with the previous secret = %v, want nil", err)
+	}
+
+	newJWT, err := GenerateJWT(1, false, newKeys)
+	if err != nil {
+		t.Fatalf("GenerateJWT() returned error: %v", err)
+	}
+	if newJWT.Header.Kid == oldJWT.Header.Kid {
+		t.Errorf("JWTs signed with different secrets have the same kid %q", newJWT.Header.Kid)
+	}
+	if err := newJWT.Verify(oldKeys, time.Now()); err == nil {
+		t.Error("Verify() of a JWT signed with a secret that isn't in the keyring = nil, want error")
+	}
+}
+
+func TestNewKeyring_ShortSecret(t *testing.T) {
+	if _, err := NewKeyring([]byte("too-short")); err == nil {
+		t.Error("NewKeyring() with a short secret = nil, want error")
+	}
+	if _, err := NewKeyring([]byte("test-secret-key-for-jwt-testing!"), []byte("too-short")); err == nil {
+		t.Error("NewKeyring() with a short previous secret = nil, want error")
+	}
+}
+
 func TestJWTString(t *testing.T) {
-	secret := []byte("test-secret-key-for-jwt-testing!")
+	secret := testKeyring(t, "test-secret-key-for-jwt-testing!")
 
 	jwt, err := GenerateJWT(5, true, secret)
 	if err != nil {
@@ -243,17 +373,34 @@ func TestJWTString(t *testing.T) {
 	}
 }
 
+// testKeyring returns a keyring with the single secret.
+func testKeyring(t *testing.T, secret string) *Keyring {
+	t.Helper()
+	keys, err := NewKeyring([]byte(secret))
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+	return keys
+}
+
 // buildExpiredJWT manually constructs a JWT with an expiration in the past,
-// properly signed with the given secret.
-func buildExpiredJWT(t *testing.T, userID int, isAdmin bool, secret []byte) JWT {
+// properly signed with the current key.
+func buildExpiredJWT(t *testing.T, userID int, isAdmin bool, keys *Keyring) JWT {
 	t.Helper()
 
-	header := joseHeader{Alg: "HS256", Typ: "JWT"}
+	header := joseHeader{Alg: "HS256", Typ: "JWT", Kid: keys.CurrentKeyID()}
 	payload := jwsPayload{
 		UserID:  userID,
 		IsAdmin: isAdmin,
 		Exp:     int(time.Now().Add(-1 * time.Hour).Unix()), // expired 1 hour ago
 	}
+	return buildJWT(t, header, payload, keys.secrets[keys.CurrentKeyID()])
+}
+
+// buildJWT manually constructs a JWT with the header and payload, signed
+// with HS256 using the secret regardless of the header's alg.
+func buildJWT(t *testing.T, header joseHeader, payload jwsPayload, secret []byte) JWT {
+	t.Helper()
 
 	headerJSON, err := json.Marshal(header)
 	if err != nil {
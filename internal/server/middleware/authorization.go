@@ -1,50 +1,85 @@
 package middleware
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
 )
 
+// A SessionStore keeps track of the sessions JWTs are issued for so they can
+// be revoked before they expire.
+type SessionStore interface {
+	// SessionActive reports whether the session with the given ID belongs to
+	// the user and hasn't been revoked or expired.
+	SessionActive(ctx context.Context, sessionID string, userID int) (bool, error)
+}
+
+// Auth holds everything needed to authorize a request.
+type Auth struct {
+	// Keys are the keys used to sign and verify JWTs.
+	Keys *Keyring
+	// Sessions is used to check that the session a JWT was issued for is
+	// still active. If it's nil, sessions aren't checked.
+	Sessions SessionStore
+	// Refresher is used to issue new tokens when the access token is missing
+	// or has expired. If it's nil, expired access tokens aren't refreshed.
+	Refresher TokenRefresher
+	// SecureCookies sets the Secure attribute on refreshed token cookies.
+	SecureCookies bool
+	// Roles is used to look up a user's role. If it's nil, users are members,
+	// or admins if the is_admin claim in the JWT is set.
+	Roles RoleStore
+	// APITokens is used to look up personal API tokens sent in the
+	// Authorization header. If it's nil, API tokens aren't accepted.
+	APITokens APITokenStore
+}
+
 // Authorize takes a request, verifies that it contains a valid
-// JWT, then returns the user id for that the user in the JWT.
-func Authorize(r *http.Request, secret []byte) (int, error) {
-	accessToken, err := r.Cookie("access_token")
-	if err != nil {
-		return -1, err
-	}
-	jwt, err := ParseJWT(accessToken.Value)
-	if err != nil {
-		return -1, err
+// JWT or API token, then returns the user id for that the user in the JWT.
+func Authorize(r *http.Request, auth Auth) (int, error) {
+	if raw, ok := bearerToken(r); ok {
+		token, err := authorizeAPIToken(r, auth, raw)
+		if err != nil {
+			return -1, err
+		}
+		return token.UserID, nil
 	}
-	valid, err := jwt.IsValid(secret)
+	jwt, err := authorize(r, auth)
 	if err != nil {
 		return -1, err
 	}
-	if !valid {
-		return -1, errors.New("invalid JWT")
-	}
-
 	return jwt.Payload.UserID, nil
 }
 
-// IsAdmin checks the is_admin flag in the JWT to see if a user is
-// an admin.
-func IsAdmin(r *http.Request, secret []byte) (bool, error) {
+// authorize returns the JWT in the request's access token cookie if it was
+// signed with one of the keys, hasn't expired and its session is still active.
+func authorize(r *http.Request, auth Auth) (JWT, error) {
 	accessToken, err := r.Cookie("access_token")
 	if err != nil {
-		return false, err
+		return JWT{}, err
 	}
 	jwt, err := ParseJWT(accessToken.Value)
 	if err != nil {
-		return false, err
-	}
-	valid, err := jwt.IsValid(secret)
-	if err != nil {
-		return false, err
+		return JWT{}, err
 	}
-	if !valid {
-		return false, errors.New("invalid JWT")
+	if err := jwt.Verify(auth.Keys, time.Now()); err != nil {
+		return JWT{}, err
 	}
 
-	return jwt.Payload.IsAdmin, nil
+	if auth.Sessions != nil {
+		// Tokens issued before sessions were tracked can't be revoked, so
+		// they aren't accepted either.
+		if jwt.Payload.JTI == "" {
+			return JWT{}, errors.New("JWT has no session ID")
+		}
+		active, err := auth.Sessions.SessionActive(r.Context(), jwt.Payload.JTI, jwt.Payload.UserID)
+		if err != nil {
+			return JWT{}, err
+		}
+		if !active {
+			return JWT{}, errors.New("session is no longer active")
+		}
+	}
+	return jwt, nil
 }
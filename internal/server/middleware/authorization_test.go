@@ -1,13 +1,14 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 )
 
 func TestAuthorize_ValidCookie(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
+	secret := testKeyring(t, "12345678901234567890123456789012")
 	jwt, err := GenerateJWT(42, false, secret)
 	if err != nil {
 		t.Fatalf("GenerateJWT: %v", err)
@@ -16,7 +17,7 @@ func TestAuthorize_ValidCookie(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
 
-	userID, err := Authorize(req, secret)
+	userID, err := Authorize(req, Auth{Keys: secret})
 	if err != nil {
 		t.Fatalf("Authorize returned error: %v", err)
 	}
@@ -26,29 +27,29 @@ func TestAuthorize_ValidCookie(t *testing.T) {
 }
 
 func TestAuthorize_NoCookie(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
+	secret := testKeyring(t, "12345678901234567890123456789012")
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 
-	_, err := Authorize(req, secret)
+	_, err := Authorize(req, Auth{Keys: secret})
 	if err == nil {
 		t.Fatal("expected error when no cookie present")
 	}
 }
 
 func TestAuthorize_InvalidJWTString(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
+	secret := testKeyring(t, "12345678901234567890123456789012")
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: "access_token", Value: "not-a-valid-jwt"})
 
-	_, err := Authorize(req, secret)
+	_, err := Authorize(req, Auth{Keys: secret})
 	if err == nil {
 		t.Fatal("expected error for invalid JWT string")
 	}
 }
 
 func TestAuthorize_WrongSecret(t *testing.T) {
-	signingSecret := []byte("12345678901234567890123456789012")
-	wrongSecret := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	signingSecret := testKeyring(t, "12345678901234567890123456789012")
+	wrongSecret := testKeyring(t, "abcdefghijklmnopqrstuvwxyz123456")
 
 	jwt, err := GenerateJWT(7, false, signingSecret)
 	if err != nil {
@@ -58,34 +59,45 @@ func TestAuthorize_WrongSecret(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
 
-	_, err = Authorize(req, wrongSecret)
+	_, err = Authorize(req, Auth{Keys: wrongSecret})
 	if err == nil {
 		t.Fatal("expected error when verifying with wrong secret")
 	}
 }
 
-func TestIsAdmin_AdminUser(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
-	jwt, err := GenerateJWT(1, true, secret)
+type fakeSessionStore map[string]int
+
+func (f fakeSessionStore) SessionActive(_ context.Context, sessionID string, userID int) (bool, error) {
+	id, ok := f[sessionID]
+	return ok && id == userID, nil
+}
+
+func TestAuthorize_ActiveSession(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	jwt, err := GenerateJWT(42, false, secret)
 	if err != nil {
 		t.Fatalf("GenerateJWT: %v", err)
 	}
+	if jwt.Payload.JTI == "" {
+		t.Fatal("GenerateJWT did not set a jti")
+	}
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
 
-	isAdmin, err := IsAdmin(req, secret)
+	sessions := fakeSessionStore{jwt.Payload.JTI: 42}
+	userID, err := Authorize(req, Auth{Keys: secret, Sessions: sessions})
 	if err != nil {
-		t.Fatalf("IsAdmin returned error: %v", err)
+		t.Fatalf("Authorize returned error: %v", err)
 	}
-	if !isAdmin {
-		t.Error("expected isAdmin to be true")
+	if userID != 42 {
+		t.Errorf("got userID %d, want 42", userID)
 	}
 }
 
-func TestIsAdmin_NonAdminUser(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
-	jwt, err := GenerateJWT(1, false, secret)
+func TestAuthorize_RevokedSession(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	jwt, err := GenerateJWT(42, false, secret)
 	if err != nil {
 		t.Fatalf("GenerateJWT: %v", err)
 	}
@@ -93,21 +105,25 @@ func TestIsAdmin_NonAdminUser(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
 
-	isAdmin, err := IsAdmin(req, secret)
-	if err != nil {
-		t.Fatalf("IsAdmin returned error: %v", err)
-	}
-	if isAdmin {
-		t.Error("expected isAdmin to be false")
+	_, err = Authorize(req, Auth{Keys: secret, Sessions: fakeSessionStore{}})
+	if err == nil {
+		t.Fatal("expected error for revoked session")
 	}
 }
 
-func TestIsAdmin_NoCookie(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
+func TestAuthorize_SessionOfOtherUser(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	jwt, err := GenerateJWT(42, false, secret)
+	if err != nil {
+		t.Fatalf("GenerateJWT: %v", err)
+	}
+
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
 
-	_, err := IsAdmin(req, secret)
+	sessions := fakeSessionStore{jwt.Payload.JTI: 7}
+	_, err = Authorize(req, Auth{Keys: secret, Sessions: sessions})
 	if err == nil {
-		t.Fatal("expected error when no cookie present")
+		t.Fatal("expected error for session belonging to another user")
 	}
 }
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client that made the request. The
+// server runs behind a reverse proxy on the same host, so for requests from a
+// loopback address the address the proxy appended to X-Forwarded-For is used
+// instead. The header is ignored for any other request since clients can set
+// it to anything.
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if addr := net.ParseIP(ip); addr == nil || !addr.IsLoopback() {
+		return ip
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return ip
+	}
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	if last := strings.TrimSpace(hops[len(hops)-1]); net.ParseIP(last) != nil {
+		return last
+	}
+	return ip
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "direct connection",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded header ignored from non-loopback address",
+			remoteAddr: "203.0.113.7:51234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "proxy on loopback",
+			remoteAddr: "127.0.0.1:40000",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "proxy on IPv6 loopback",
+			remoteAddr: "[::1]:40000",
+			forwarded:  []string{"2001:db8::1"},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "last hop is used",
+			remoteAddr: "127.0.0.1:40000",
+			forwarded:  []string{"10.0.0.1, 198.51.100.1", "198.51.100.2"},
+			want:       "198.51.100.2",
+		},
+		{
+			name:       "invalid forwarded address",
+			remoteAddr: "127.0.0.1:40000",
+			forwarded:  []string{"not-an-ip"},
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "loopback without proxy",
+			remoteAddr: "127.0.0.1:40000",
+			want:       "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/log"
+)
+
+// CtxCSRFKey is used to set and retrieve the CSRF token.
+const CtxCSRFKey ctxKey = "csrfToken"
+
+// CSRFHeader is the header scripts send the CSRF token in.
+const CSRFHeader = "X-CSRF-Token"
+
+// csrfCookieMaxAge is how long the CSRF cookie lasts, which matches the
+// longest a login can last without being refreshed.
+const csrfCookieMaxAge = int(RefreshTokenTTL / time.Second)
+
+// CSRFHandler protects against cross-site request forgery using the
+// double-submit cookie pattern. Every client gets a random token in a
+// cookie, and requests that can change state (anything but GET, HEAD,
+// OPTIONS and TRACE) must also send the token in the X-CSRF-Token header.
+// Another site can make the browser send the cookie but can't read it to
+// set the header. The token is added to the request context so pages can
+// pass it to their scripts. Requests with an Authorization header aren't
+// checked, since browsers never add one on their own.
+func CSRFHandler(next http.Handler, secure bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if c, err := r.Cookie("csrf_token"); err == nil {
+			token = c.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if token == "" {
+				token = rand.Text()
+				http.SetCookie(w, &http.Cookie{
+					Name:     "csrf_token",
+					Value:    token,
+					MaxAge:   csrfCookieMaxAge,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   secure,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+		default:
+			if _, ok := bearerToken(r); ok {
+				break
+			}
+			header := r.Header.Get(CSRFHeader)
+			if token == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+				log.Errorf(r.Context(), "CSRF token check failed for %s %s", r.Method, r.URL.Path)
+				WriteError(w, r, derror.Forbidden(errors.New("invalid CSRF token")))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), CtxCSRFKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CSRFToken returns the CSRF token CSRFHandler added to the request context.
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(CtxCSRFKey).(string)
+	return token
+}
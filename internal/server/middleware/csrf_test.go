@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	const token = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	tests := []struct {
+		name       string
+		method     string
+		cookie     string
+		header     string
+		authHeader string
+		wantCalled bool
+		wantToken  string
+		wantCookie bool
+	}{
+		{name: "GET without cookie", method: "GET", wantCalled: true, wantCookie: true},
+		{name: "GET with cookie", method: "GET", cookie: token, wantCalled: true, wantToken: token},
+		{name: "POST with matching header", method: "POST", cookie: token, header: token, wantCalled: true, wantToken: token},
+		{name: "DELETE with matching header", method: "DELETE", cookie: token, header: token, wantCalled: true, wantToken: token},
+		{name: "POST without header", method: "POST", cookie: token},
+		{name: "POST with wrong header", method: "POST", cookie: token, header: "ZYXWVUTSRQPONMLKJIHGFEDCBA"},
+		{name: "POST without cookie", method: "POST", header: token},
+		{name: "POST without either", method: "POST"},
+		{name: "POST with API token", method: "POST", authHeader: "Bearer yh_TOKEN", wantCalled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			var gotToken string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				gotToken = CSRFToken(r)
+			})
+
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "csrf_token", Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(CSRFHeader, tt.header)
+			}
+			if tt.authHeader != "" {
+				r.Header.Set("Authorization", tt.authHeader)
+			}
+			w := httptest.NewRecorder()
+			CSRFHandler(next, true).ServeHTTP(w, r)
+
+			if called != tt.wantCalled {
+				t.Fatalf("next called = %t, want %t", called, tt.wantCalled)
+			}
+			if !called && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+
+			var cookie *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "csrf_token" {
+					cookie = c
+				}
+			}
+			if (cookie != nil) != tt.wantCookie {
+				t.Fatalf("set cookie = %v, want cookie set %t", cookie, tt.wantCookie)
+			}
+			if cookie != nil {
+				if cookie.Value == "" || gotToken != cookie.Value {
+					t.Errorf("context token = %q, want the new cookie's value %q", gotToken, cookie.Value)
+				}
+				if !cookie.HttpOnly || !cookie.Secure {
+					t.Errorf("cookie HttpOnly = %t, Secure = %t, want both set", cookie.HttpOnly, cookie.Secure)
+				}
+			} else if called && gotToken != tt.wantToken {
+				t.Errorf("context token = %q, want %q", gotToken, tt.wantToken)
+			}
+		})
+	}
+}
@@ -1,23 +1,128 @@
 package middleware
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/jessesomerville/yodahunters/internal/derror"
 	"github.com/jessesomerville/yodahunters/internal/log"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/validate"
 )
 
+// ctxErrorsKey is used to set and retrieve how errors are written for a
+// request.
+const ctxErrorsKey ctxKey = "errors"
+
+// An ErrorPage writes the HTML page for an error on a browser route.
+type ErrorPage func(w http.ResponseWriter, r *http.Request, serr *derror.ServerError) error
+
+// errorConfig is how errors are written for a request.
+type errorConfig struct {
+	// api is set for API requests, which get problem details instead of an
+	// HTML page.
+	api  bool
+	page ErrorPage
+}
+
+// Problem is a problem details object (RFC 7807), the body of error
+// responses from API routes.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Errors are the problems with the request's fields, if it was
+	// rejected because of them.
+	Errors validate.Errors `json:"errors,omitempty"`
+}
+
+// ErrorResponses sets how errors are written for the requests served by
+// next: requests for paths under apiPrefix get problem details, and other
+// requests get the error page. Without it, errors are written as plain text.
+func ErrorResponses(next http.Handler, apiPrefix string, page ErrorPage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := errorConfig{api: strings.HasPrefix(r.URL.Path, apiPrefix), page: page}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxErrorsKey, cfg)))
+	})
+}
+
 // ErrorHandler handles responding to requests with error messages.
 func ErrorHandler(f func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			var serr *derror.ServerError
-			if !errors.As(err, &serr) {
-				serr = &derror.ServerError{Status: http.StatusInternalServerError, Err: err}
-			}
+			serr := toServerError(err)
 			log.Errorf(r.Context(), "returning %d (%s) for error %v", serr.Status, http.StatusText(serr.Status), err)
-			http.Error(w, serr.Err.Error(), serr.Status)
+			writeError(w, r, serr)
 		}
 	}
 }
+
+// WriteError responds to the request with the error, as problem details for
+// API requests and as an HTML page otherwise. Errors that aren't a
+// [derror.ServerError] are internal server errors, unless they're a database
+// error that maps to a status.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, toServerError(err))
+}
+
+// toServerError returns the error as a ServerError, mapping invalid fields
+// to 422s, missing rows to 404s and unique violations to 409s.
+func toServerError(err error) *derror.ServerError {
+	var serr *derror.ServerError
+	var fieldErrs validate.Errors
+	switch {
+	case errors.As(err, &serr):
+		return serr
+	case errors.As(err, &fieldErrs):
+		return derror.Unprocessable(fieldErrs)
+	case errors.Is(err, pg.ErrNoRows):
+		return derror.NotFound(errors.New("not found"))
+	case pg.IsUniqueViolation(err):
+		return derror.Conflict(errors.New("already exists"))
+	default:
+		return &derror.ServerError{Status: http.StatusInternalServerError, Err: err}
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, serr *derror.ServerError) {
+	cfg, ok := r.Context().Value(ctxErrorsKey).(errorConfig)
+	if !ok {
+		http.Error(w, serr.Err.Error(), serr.Status)
+		return
+	}
+
+	// The details of internal errors are logged, not shown.
+	if serr.Status >= http.StatusInternalServerError {
+		serr = &derror.ServerError{Status: serr.Status, Err: errors.New(http.StatusText(serr.Status))}
+	}
+	if !cfg.api {
+		if cfg.page != nil {
+			err := cfg.page(w, r, serr)
+			if err == nil {
+				return
+			}
+			log.Errorf(r.Context(), "rendering error page: %v", err)
+		}
+		http.Error(w, serr.Err.Error(), serr.Status)
+		return
+	}
+
+	problem := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(serr.Status),
+		Status: serr.Status,
+		Detail: serr.Err.Error(),
+	}
+	if problem.Detail == problem.Title {
+		problem.Detail = ""
+	}
+	errors.As(serr.Err, &problem.Errors)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(serr.Status)
+	json.NewEncoder(w).Encode(problem)
+}
@@ -1,13 +1,19 @@
 package middleware
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/validate"
 )
 
 func TestErrorHandler(t *testing.T) {
@@ -71,3 +77,127 @@ func TestErrorHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorResponses(t *testing.T) {
+	page := func(w http.ResponseWriter, r *http.Request, serr *derror.ServerError) error {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(serr.Status)
+		fmt.Fprintf(w, "<p>%s</p>", serr.Err)
+		return nil
+	}
+	tests := []struct {
+		name        string
+		path        string
+		err         error
+		page        ErrorPage
+		wantStatus  int
+		wantType    string
+		wantProblem Problem
+		wantBody    string
+	}{
+		{
+			name:        "API not found",
+			path:        "/api/threads/1",
+			err:         derror.NotFound(errors.New("thread 1 not found")),
+			wantStatus:  http.StatusNotFound,
+			wantType:    "application/problem+json",
+			wantProblem: Problem{Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Detail: "thread 1 not found"},
+		},
+		{
+			name:        "API unprocessable",
+			path:        "/api/threads",
+			err:         derror.Unprocessable(errors.New("title is too long")),
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantType:    "application/problem+json",
+			wantProblem: Problem{Type: "about:blank", Title: "Unprocessable Entity", Status: http.StatusUnprocessableEntity, Detail: "title is too long"},
+		},
+		{
+			name:       "API field errors",
+			path:       "/api/threads",
+			err:        validate.Errors{{Field: "title", Message: "is required"}},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantType:   "application/problem+json",
+			wantProblem: Problem{
+				Type:   "about:blank",
+				Title:  "Unprocessable Entity",
+				Status: http.StatusUnprocessableEntity,
+				Detail: "title is required",
+				Errors: validate.Errors{{Field: "title", Message: "is required"}},
+			},
+		},
+		{
+			name:        "API no rows",
+			path:        "/api/comments/1",
+			err:         fmt.Errorf("querying comment: %w", pg.ErrNoRows),
+			wantStatus:  http.StatusNotFound,
+			wantType:    "application/problem+json",
+			wantProblem: Problem{Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Detail: "not found"},
+		},
+		{
+			name:        "API unique violation",
+			path:        "/api/categories",
+			err:         &pgconn.PgError{Code: "23505", Message: `duplicate key value violates unique constraint "categories_title_key"`},
+			wantStatus:  http.StatusConflict,
+			wantType:    "application/problem+json",
+			wantProblem: Problem{Type: "about:blank", Title: "Conflict", Status: http.StatusConflict, Detail: "already exists"},
+		},
+		{
+			name:        "API internal error details are hidden",
+			path:        "/api/threads",
+			err:         errors.New("connection refused"),
+			wantStatus:  http.StatusInternalServerError,
+			wantType:    "application/problem+json",
+			wantProblem: Problem{Type: "about:blank", Title: "Internal Server Error", Status: http.StatusInternalServerError},
+		},
+		{
+			name:       "browser route gets the error page",
+			path:       "/threads/1",
+			err:        derror.NotFound(errors.New("thread 1 not found")),
+			page:       page,
+			wantStatus: http.StatusNotFound,
+			wantType:   "text/html; charset=utf-8",
+			wantBody:   "<p>thread 1 not found</p>",
+		},
+		{
+			name: "browser route falls back to plain text",
+			path: "/threads/1",
+			err:  derror.Forbidden(errors.New("forbidden")),
+			page: func(w http.ResponseWriter, r *http.Request, serr *derror.ServerError) error {
+				return errors.New("template is broken")
+			},
+			wantStatus: http.StatusForbidden,
+			wantType:   "text/plain; charset=utf-8",
+			wantBody:   "forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := ErrorResponses(ErrorHandler(func(w http.ResponseWriter, r *http.Request) error {
+				return tt.err
+			}), "/api/", tt.page)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if tt.wantType != "application/problem+json" {
+				if body := strings.TrimSpace(w.Body.String()); body != tt.wantBody {
+					t.Errorf("body = %q, want %q", body, tt.wantBody)
+				}
+				return
+			}
+			var got Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantProblem) {
+				t.Errorf("problem = %+v, want %+v", got, tt.wantProblem)
+			}
+		})
+	}
+}
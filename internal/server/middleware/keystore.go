@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNoKey is returned by a [KeyStore] that has no secret to sign JWTs with.
+var ErrNoKey = errors.New("no JWT secret configured")
+
+// A KeyStore loads the secrets JWTs are signed with. Secrets have to outlive
+// the server, since restarting it with a different secret logs everyone out.
+type KeyStore interface {
+	// Keyring returns a keyring with the current secret and the previous
+	// secrets that are still accepted.
+	Keyring(ctx context.Context) (*Keyring, error)
+}
+
+// EnvKeyStore loads the secrets from environment variables.
+type EnvKeyStore struct {
+	// Current is the name of the variable holding the current secret.
+	Current string
+	// Previous is the name of the variable holding a comma separated list
+	// of previous secrets. It's optional.
+	Previous string
+}
+
+// Keyring returns the secrets in the environment variables, or ErrNoKey if
+// the current secret isn't set.
+func (st EnvKeyStore) Keyring(ctx context.Context) (*Keyring, error) {
+	current := os.Getenv(st.Current)
+	if current == "" {
+		return nil, fmt.Errorf("%w: %s isn't set", ErrNoKey, st.Current)
+	}
+	var previous [][]byte
+	if st.Previous != "" {
+		for secret := range strings.SplitSeq(os.Getenv(st.Previous), ",") {
+			if secret != "" {
+				previous = append(previous, []byte(secret))
+			}
+		}
+	}
+	return NewKeyring([]byte(current), previous...)
+}
+
+// FileKeyStore loads the secrets from a file with one secret per line. The
+// first secret is the current one, and the rest are previous secrets. Empty
+// lines and lines starting with # are ignored.
+type FileKeyStore struct {
+	Path string
+}
+
+// Keyring returns the secrets in the file, or ErrNoKey if it doesn't have
+// any.
+func (st FileKeyStore) Keyring(ctx context.Context) (*Keyring, error) {
+	f, err := os.Open(st.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var secrets [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, []byte(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", st.Path, err)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%w: %s has no secrets", ErrNoKey, st.Path)
+	}
+	return NewKeyring(secrets[0], secrets[1:]...)
+}
+
+// NewEphemeralKeyring returns a keyring with a random secret. Since the
+// secret is lost when the server exits, it should only be used during
+// development.
+func NewEphemeralKeyring() (*Keyring, error) {
+	secret := make([]byte, MinKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewKeyring(secret)
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	currentSecret  = "current-secret-for-jwt-testing!!"
+	previousSecret = "previous-secret-for-jwt-testing!"
+)
+
+func TestEnvKeyStore(t *testing.T) {
+	tests := []struct {
+		name         string
+		current      string
+		previous     string
+		wantErr      bool
+		wantNoKey    bool
+		wantPrevious bool
+	}{
+		{name: "current only", current: currentSecret},
+		{name: "with previous", current: currentSecret, previous: previousSecret + ",", wantPrevious: true},
+		{name: "unset", wantErr: true, wantNoKey: true},
+		{name: "short secret", current: "too-short", wantErr: true},
+		{name: "short previous secret", current: currentSecret, previous: "too-short", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_JWT_SECRET", tt.current)
+			t.Setenv("TEST_JWT_PREVIOUS_SECRETS", tt.previous)
+			keys, err := EnvKeyStore{Current: "TEST_JWT_SECRET", Previous: "TEST_JWT_PREVIOUS_SECRETS"}.Keyring(context.Background())
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("Keyring() = %v, want error: %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrNoKey) != tt.wantNoKey {
+				t.Errorf("Keyring() = %v, want ErrNoKey: %v", err, tt.wantNoKey)
+			}
+			if err != nil {
+				return
+			}
+			checkKeyring(t, keys, tt.wantPrevious)
+		})
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	tests := []struct {
+		name         string
+		contents     string
+		wantErr      bool
+		wantNoKey    bool
+		wantPrevious bool
+	}{
+		{name: "current only", contents: currentSecret + "\n"},
+		{name: "with previous", contents: "# rotated 2026-10-18\n" + currentSecret + "\n\n" + previousSecret + "\n", wantPrevious: true},
+		{name: "empty", contents: "# no secrets yet\n", wantErr: true, wantNoKey: true},
+		{name: "short secret", contents: "too-short\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jwt-secrets")
+			if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := FileKeyStore{Path: path}.Keyring(context.Background())
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("Keyring() = %v, want error: %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrNoKey) != tt.wantNoKey {
+				t.Errorf("Keyring() = %v, want ErrNoKey: %v", err, tt.wantNoKey)
+			}
+			if err != nil {
+				return
+			}
+			checkKeyring(t, keys, tt.wantPrevious)
+		})
+	}
+}
+
+func TestFileKeyStore_MissingFile(t *testing.T) {
+	_, err := FileKeyStore{Path: filepath.Join(t.TempDir(), "missing")}.Keyring(context.Background())
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Keyring() = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+// checkKeyring checks that the keyring signs JWTs with currentSecret, and
+// that it accepts JWTs signed with previousSecret only if wantPrevious is
+// set.
+func checkKeyring(t *testing.T, keys *Keyring, wantPrevious bool) {
+	t.Helper()
+	if want := testKeyring(t, currentSecret).CurrentKeyID(); keys.CurrentKeyID() != want {
+		t.Errorf("CurrentKeyID() = %q, want %q", keys.CurrentKeyID(), want)
+	}
+	jwt, err := GenerateJWT(1, false, testKeyring(t, previousSecret))
+	if err != nil {
+		t.Fatalf("GenerateJWT() returned error: %v", err)
+	}
+	if valid, _ := jwt.IsValid(keys); valid != wantPrevious {
+		t.Errorf("IsValid() of a JWT signed with the previous secret = %v, want %v", valid, wantPrevious)
+	}
+}
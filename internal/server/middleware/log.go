@@ -25,6 +25,6 @@ func reqToLogAttr(r *http.Request) slog.Attr {
 		slog.String("method", r.Method),
 		slog.String("path", r.URL.Path),
 		slog.Int64("content-length", r.ContentLength),
-		slog.String("ip", r.RemoteAddr),
+		slog.String("ip", ClientIP(r)),
 	)
 }
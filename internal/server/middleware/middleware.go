@@ -3,8 +3,10 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
+	"github.com/jessesomerville/yodahunters/internal/derror"
 	"github.com/jessesomerville/yodahunters/internal/log"
 )
 
@@ -19,29 +21,80 @@ const CtxPageKey ctxKey = "page"
 // CtxAdminKey is used to set and retrieve the admin flag.
 const CtxAdminKey ctxKey = "isAdmin"
 
+// CtxSessionKey is used to set and retrieve the ID of the session the
+// request's JWT was issued for.
+const CtxSessionKey ctxKey = "sessionID"
+
 // AuthorizationHandler verifies that a request has a valid access token in the
 // cookie, retrieves the user_id set in the access token, and adds the user_id
-// to the request context.
-func AuthorizationHandler(next http.HandlerFunc, secret []byte) http.HandlerFunc {
+// to the request context. If the access token is missing or invalid and the
+// request has a refresh token, new tokens are issued transparently. Requests
+// with an API token in the Authorization header are authorized with that
+// instead, and get a 401 rather than a redirect when it isn't valid.
+func AuthorizationHandler(next http.HandlerFunc, auth Auth) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := Authorize(r, secret)
+		if raw, ok := bearerToken(r); ok {
+			token, err := authorizeAPIToken(r, auth, raw)
+			if err != nil {
+				log.Errorf(r.Context(), "API token authorization failed: %v", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="yodahunters"`)
+				WriteError(w, r, derror.Unauthorized(errors.New("invalid API token")))
+				return
+			}
+			role, err := lookupRole(r.Context(), auth, token.UserID, false)
+			if err != nil {
+				log.Errorf(r.Context(), "Role lookup failed: %v", err)
+				WriteError(w, r, err)
+				return
+			}
+			role = CapRole(role, token.Scope)
+			ctx := context.WithValue(r.Context(), CtxUserKey, token.UserID)
+			ctx = context.WithValue(ctx, CtxAdminKey, role == RoleAdmin)
+			ctx = context.WithValue(ctx, CtxRoleKey, role)
+			ctx = context.WithValue(ctx, CtxAPITokenKey, token.ID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		jwt, err := authorize(r, auth)
+		if err != nil && auth.Refresher != nil {
+			jwt, err = refresh(w, r, auth)
+			if errors.Is(err, ErrRefreshTokenReused) {
+				log.Warnf(r.Context(), "Refresh token reused, the session has been revoked")
+			}
+		}
 		if err != nil {
 			log.Errorf(r.Context(), "Authorization Failed!")
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		isAdmin, err := IsAdmin(r, secret)
+		role, err := lookupRole(r.Context(), auth, jwt.Payload.UserID, jwt.Payload.IsAdmin)
 		if err != nil {
-			log.Errorf(r.Context(), "Admin authorization Failed!")
-			http.Redirect(w, r, "/", http.StatusFound)
+			log.Errorf(r.Context(), "Role lookup failed: %v", err)
+			WriteError(w, r, err)
 			return
 		}
-		ctx := context.WithValue(r.Context(), CtxUserKey, userID)
-		ctx = context.WithValue(ctx, CtxAdminKey, isAdmin)
+		ctx := context.WithValue(r.Context(), CtxUserKey, jwt.Payload.UserID)
+		ctx = context.WithValue(ctx, CtxAdminKey, role == RoleAdmin)
+		ctx = context.WithValue(ctx, CtxRoleKey, role)
+		ctx = context.WithValue(ctx, CtxSessionKey, jwt.Payload.JTI)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// lookupRole returns the user's role. The role is looked up rather than
+// trusted from the JWT so privilege changes apply without waiting for the
+// token to expire.
+func lookupRole(ctx context.Context, auth Auth, userID int, isAdmin bool) (Role, error) {
+	if auth.Roles != nil {
+		return auth.Roles.Role(ctx, userID)
+	}
+	if isAdmin {
+		return RoleAdmin, nil
+	}
+	return RoleMember, nil
+}
+
 // PageHandler checks the URL for query parameters related to paging
 // and makes them available in the request context.
 func PageHandler(next http.HandlerFunc) http.HandlerFunc {
@@ -55,27 +108,8 @@ func PageHandler(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// AdminHandler adds the is_admin flag stored in the JWT
-// to the request context.
-func AdminHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if isAdmin := r.Context().Value(CtxAdminKey); !(isAdmin).(bool) {
-			log.Errorf(r.Context(), "Admin authorization Failed!")
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}
-}
-
 // Chain links all the middleware handlers together to make it convenient to call them all
-// in a row.
-func Chain(f func(w http.ResponseWriter, r *http.Request) error, jwtSecret []byte) http.HandlerFunc {
-	return AuthorizationHandler(PageHandler(ErrorHandler(f)), jwtSecret)
-}
-
-// AdminChain includes an additional check for the is_admin flag stored in the JWT for a request.
-// This chain is for endpoints that should only be accessible to Admins.
-func AdminChain(f func(w http.ResponseWriter, r *http.Request) error, jwtSecret []byte) http.HandlerFunc {
-	return AuthorizationHandler(PageHandler(AdminHandler(ErrorHandler(f))), jwtSecret)
+// in a row. Only users whose role has the permission can access the route.
+func Chain(f func(w http.ResponseWriter, r *http.Request) error, auth Auth, perm Permission) http.HandlerFunc {
+	return AuthorizationHandler(PageHandler(RequirePermission(perm, ErrorHandler(f))), auth)
 }
@@ -2,13 +2,14 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 )
 
 func TestAuthorizationHandler_ValidJWT(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
+	secret := testKeyring(t, "12345678901234567890123456789012")
 	jwt, err := GenerateJWT(42, true, secret)
 	if err != nil {
 		t.Fatalf("GenerateJWT: %v", err)
@@ -24,7 +25,7 @@ func TestAuthorizationHandler_ValidJWT(t *testing.T) {
 		capturedIsAdmin = r.Context().Value(CtxAdminKey).(bool)
 	})
 
-	handler := AuthorizationHandler(next, secret)
+	handler := AuthorizationHandler(next, Auth{Keys: secret})
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
@@ -44,14 +45,14 @@ func TestAuthorizationHandler_ValidJWT(t *testing.T) {
 }
 
 func TestAuthorizationHandler_NoCookie(t *testing.T) {
-	secret := []byte("12345678901234567890123456789012")
+	secret := testKeyring(t, "12345678901234567890123456789012")
 	called := false
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
 	})
 
-	handler := AuthorizationHandler(next, secret)
+	handler := AuthorizationHandler(next, Auth{Keys: secret})
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	rr := httptest.NewRecorder()
@@ -70,94 +71,152 @@ func TestAuthorizationHandler_NoCookie(t *testing.T) {
 	}
 }
 
-func TestPageHandler_Defaults(t *testing.T) {
-	var capturedPage any
-	called := false
+func TestAuthorizationHandler_RolesOverrideJWT(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	jwt, err := GenerateJWT(42, true, secret)
+	if err != nil {
+		t.Fatalf("GenerateJWT: %v", err)
+	}
 
+	capturedIsAdmin := true
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		called = true
-		capturedPage = r.Context().Value(CtxPageKey)
+		capturedIsAdmin = r.Context().Value(CtxAdminKey).(bool)
 	})
-
-	handler := PageHandler(next)
+	roles := &fakeRoleStore{roles: map[int]Role{42: RoleMember}}
+	handler := AuthorizationHandler(next, Auth{Keys: secret, Roles: roles})
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: jwt.Raw})
 	rr := httptest.NewRecorder()
 
 	handler.ServeHTTP(rr, req)
 
-	if !called {
-		t.Fatal("next handler was not called")
+	if capturedIsAdmin {
+		t.Error("expected isAdmin from the RoleStore (false) to override the JWT claim")
 	}
-	if capturedPage == nil {
-		t.Fatal("page data was not set in context")
+}
+
+type fakeRefresher struct {
+	tokens Tokens
+	err    error
+}
+
+func (f fakeRefresher) Refresh(_ context.Context, refreshToken string) (Tokens, error) {
+	if refreshToken != "good-refresh-token" {
+		return Tokens{}, errors.New("invalid refresh token")
 	}
+	return f.tokens, f.err
 }
 
-func TestPageHandler_WithQueryParams(t *testing.T) {
-	var capturedPage any
+func TestAuthorizationHandler_Refresh(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	jwt, err := GenerateJWT(42, false, secret)
+	if err != nil {
+		t.Fatalf("GenerateJWT: %v", err)
+	}
+	refresher := fakeRefresher{tokens: Tokens{Access: jwt, Refresh: "next-refresh-token"}}
 
+	var capturedUserID int
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		capturedPage = r.Context().Value(CtxPageKey)
+		capturedUserID = r.Context().Value(CtxUserKey).(int)
 	})
+	handler := AuthorizationHandler(next, Auth{Keys: secret, Refresher: refresher})
 
-	handler := PageHandler(next)
-
-	req := httptest.NewRequest(http.MethodGet, "/?page=3", nil)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: buildExpiredJWT(t, 42, false, secret).Raw})
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: "good-refresh-token"})
 	rr := httptest.NewRecorder()
 
 	handler.ServeHTTP(rr, req)
 
-	if capturedPage == nil {
-		t.Fatal("page data was not set in context")
+	if capturedUserID != 42 {
+		t.Fatalf("got userID %d, want 42", capturedUserID)
+	}
+	cookies := make(map[string]string)
+	for _, c := range rr.Result().Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	if cookies["access_token"] != jwt.Raw {
+		t.Errorf("access_token cookie = %q, want the refreshed JWT", cookies["access_token"])
+	}
+	if cookies["refresh_token"] != "next-refresh-token" {
+		t.Errorf("refresh_token cookie = %q, want %q", cookies["refresh_token"], "next-refresh-token")
+	}
+}
+
+func TestAuthorizationHandler_RefreshFails(t *testing.T) {
+	secret := testKeyring(t, "12345678901234567890123456789012")
+	tests := []struct {
+		name      string
+		cookie    string
+		refresher fakeRefresher
+	}{
+		{name: "unknown token", cookie: "bad-refresh-token"},
+		{name: "reused token", cookie: "good-refresh-token", refresher: fakeRefresher{err: ErrRefreshTokenReused}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			handler := AuthorizationHandler(next, Auth{Keys: secret, Refresher: tt.refresher})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: "refresh_token", Value: tt.cookie})
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if called {
+				t.Fatal("next handler should not have been called")
+			}
+			if loc := rr.Header().Get("Location"); loc != "/login" {
+				t.Errorf("got redirect location %q, want /login", loc)
+			}
+		})
 	}
 }
 
-func TestAdminHandler_IsAdmin(t *testing.T) {
+func TestPageHandler_Defaults(t *testing.T) {
+	var capturedPage any
 	called := false
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
+		capturedPage = r.Context().Value(CtxPageKey)
 	})
 
-	handler := AdminHandler(next)
+	handler := PageHandler(next)
 
-	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
-	ctx := context.WithValue(req.Context(), CtxAdminKey, true)
-	req = req.WithContext(ctx)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	rr := httptest.NewRecorder()
 
 	handler.ServeHTTP(rr, req)
 
 	if !called {
-		t.Fatal("next handler was not called for admin user")
+		t.Fatal("next handler was not called")
+	}
+	if capturedPage == nil {
+		t.Fatal("page data was not set in context")
 	}
 }
 
-func TestAdminHandler_NotAdmin(t *testing.T) {
-	called := false
+func TestPageHandler_WithQueryParams(t *testing.T) {
+	var capturedPage any
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		called = true
+		capturedPage = r.Context().Value(CtxPageKey)
 	})
 
-	handler := AdminHandler(next)
+	handler := PageHandler(next)
 
-	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
-	ctx := context.WithValue(req.Context(), CtxAdminKey, false)
-	req = req.WithContext(ctx)
+	req := httptest.NewRequest(http.MethodGet, "/?page=3", nil)
 	rr := httptest.NewRecorder()
 
 	handler.ServeHTTP(rr, req)
 
-	if called {
-		t.Fatal("next handler should not have been called for non-admin")
-	}
-	if rr.Code != http.StatusFound {
-		t.Errorf("got status %d, want %d", rr.Code, http.StatusFound)
-	}
-	loc := rr.Header().Get("Location")
-	if loc != "/" {
-		t.Errorf("got redirect location %q, want /", loc)
+	if capturedPage == nil {
+		t.Fatal("page data was not set in context")
 	}
 }
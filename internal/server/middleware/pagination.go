@@ -5,6 +5,10 @@ import (
 	"strconv"
 )
 
+// DefaultPageSize is the page size used when the request doesn't set one.
+// Links to a comment on a thread page assume it.
+const DefaultPageSize = 20
+
 // A Page holds the metadata for pagination.
 type Page struct {
 	Size   int
@@ -15,7 +19,7 @@ type Page struct {
 // the requested URL.
 func GetPageData(r *http.Request) (Page, error) {
 	page := Page{
-		Size:   20,
+		Size:   DefaultPageSize,
 		Number: 1,
 	}
 	sizeParam := r.URL.Query().Get("page_size")
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/log"
+)
+
+// CtxRoleKey is used to set and retrieve the user's role.
+const CtxRoleKey ctxKey = "role"
+
+// A Role determines what a user is allowed to do.
+type Role string
+
+// The roles a user can have, from most to least privileged.
+const (
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleReadOnly  Role = "read-only"
+)
+
+// A Permission is the right to perform a kind of action.
+type Permission string
+
+// The permissions required by routes.
+const (
+	// PermRead allows viewing the forum and managing your own account.
+	PermRead Permission = "read"
+	// PermPost allows creating threads and comments and editing your own.
+	PermPost Permission = "post"
+	// PermModerate allows pinning, locking, moving and merging threads and
+	// editing or deleting anyone's posts.
+	PermModerate Permission = "moderate"
+	// PermAdmin allows managing categories, registration keys and users.
+	PermAdmin Permission = "admin"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin:     {PermRead, PermPost, PermModerate, PermAdmin},
+	RoleModerator: {PermRead, PermPost, PermModerate},
+	RoleMember:    {PermRead, PermPost},
+	RoleReadOnly:  {PermRead},
+}
+
+// roleRanks orders the roles for [Role.AtLeast].
+var roleRanks = map[Role]int{
+	RoleReadOnly:  1,
+	RoleMember:    2,
+	RoleModerator: 3,
+	RoleAdmin:     4,
+}
+
+// Valid reports whether r is one of the defined roles.
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Can reports whether the role has the permission.
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
+
+// AtLeast reports whether the role is as privileged as other or more. It's
+// used for per-category restrictions, e.g. only letting moderators and
+// admins create threads in an announcements category.
+func (r Role) AtLeast(other Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
+// RequirePermission only lets requests through if the role set in the
+// request context by AuthorizationHandler has the permission.
+func RequirePermission(p Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(CtxRoleKey).(Role)
+		if !role.Can(p) {
+			log.Errorf(r.Context(), "Permission %q denied for role %q", p, role)
+			WriteError(w, r, derror.Forbidden(fmt.Errorf("permission %q denied", p)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
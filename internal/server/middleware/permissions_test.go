@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleAdmin, PermAdmin, true},
+		{RoleAdmin, PermModerate, true},
+		{RoleModerator, PermModerate, true},
+		{RoleModerator, PermAdmin, false},
+		{RoleMember, PermPost, true},
+		{RoleMember, PermModerate, false},
+		{RoleReadOnly, PermRead, true},
+		{RoleReadOnly, PermPost, false},
+		{Role("bogus"), PermRead, false},
+		{Role(""), PermRead, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Can(tt.perm); got != tt.want {
+			t.Errorf("Role(%q).Can(%q) = %v, want %v", tt.role, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role, other Role
+		want        bool
+	}{
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleModerator, true},
+		{RoleMember, RoleModerator, false},
+		{RoleReadOnly, RoleMember, false},
+		{RoleMember, RoleReadOnly, true},
+		{Role("bogus"), RoleReadOnly, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.AtLeast(tt.other); got != tt.want {
+			t.Errorf("Role(%q).AtLeast(%q) = %v, want %v", tt.role, tt.other, got, tt.want)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       any
+		wantCalled bool
+	}{
+		{name: "allowed", role: RoleModerator, wantCalled: true},
+		{name: "denied", role: RoleMember, wantCalled: false},
+		{name: "no role", role: nil, wantCalled: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			handler := RequirePermission(PermModerate, next)
+
+			req := httptest.NewRequest(http.MethodPost, "/threads/1/lock", nil)
+			if tt.role != nil {
+				req = req.WithContext(context.WithValue(req.Context(), CtxRoleKey, tt.role))
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if called != tt.wantCalled {
+				t.Fatalf("next called = %v, want %v", called, tt.wantCalled)
+			}
+			if !tt.wantCalled && rr.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", rr.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
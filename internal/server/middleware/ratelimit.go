@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/log"
+)
+
+// A RateLimit is a token bucket. Clients can make Burst requests at once, and
+// get another request every Every after that.
+type RateLimit struct {
+	// Name identifies the limit. Routes sharing a name share buckets.
+	Name  string
+	Burst int
+	Every time.Duration
+}
+
+// Take returns how many tokens are left after taking one from a bucket that
+// had tokens in it elapsed ago. If the bucket doesn't have a whole token it's
+// left as is and retryAfter is how long until it does.
+func (l RateLimit) Take(tokens float64, elapsed time.Duration) (left float64, retryAfter time.Duration) {
+	tokens = min(float64(l.Burst), tokens+float64(elapsed)/float64(l.Every))
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) * float64(l.Every))
+}
+
+// FullAfter returns how long it takes a bucket with tokens in it to refill
+// completely. A full bucket is the same as one that doesn't exist, so stores
+// can forget about buckets after this long.
+func (l RateLimit) FullAfter(tokens float64) time.Duration {
+	return time.Duration((float64(l.Burst) - tokens) * float64(l.Every))
+}
+
+// A RateLimitStore holds the token buckets for rate limits.
+type RateLimitStore interface {
+	// Take takes a token from the bucket for the key, returning how long
+	// until one is available if the bucket is empty.
+	Take(ctx context.Context, key string, limit RateLimit) (retryAfter time.Duration, err error)
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps the buckets in memory,
+// so they're reset when the server restarts.
+type MemoryRateLimitStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		now:     time.Now,
+		buckets: make(map[string]memoryBucket),
+	}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	// Buckets that have refilled are dropped every so often so the map
+	// doesn't grow forever.
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = memoryBucket{tokens: float64(limit.Burst), updated: now}
+	}
+	left, retryAfter := limit.Take(b.tokens, now.Sub(b.updated))
+	s.buckets[key] = memoryBucket{tokens: left, updated: now, full: now.Add(limit.FullAfter(left))}
+	return retryAfter, nil
+}
+
+// RateLimitHandler limits how often each client can make requests to next.
+// Clients are identified by the user ID set by AuthorizationHandler, or by
+// their IP address for requests that aren't authorized. Requests over the
+// limit get a 429 response with a Retry-After header. If the store fails the
+// request is let through.
+func RateLimitHandler(store RateLimitStore, limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := limit.Name + ":ip:" + ClientIP(r)
+		if userID, ok := r.Context().Value(CtxUserKey).(int); ok {
+			key = fmt.Sprintf("%s:user:%d", limit.Name, userID)
+		}
+		retryAfter, err := store.Take(r.Context(), key, limit)
+		if err != nil {
+			log.Errorf(r.Context(), "Rate limit lookup for %q failed: %v", key, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			WriteError(w, r, &derror.ServerError{Status: http.StatusTooManyRequests, Err: errors.New("too many requests, try again later")})
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// RateLimitedChain is Chain with a rate limit applied to each user.
+func RateLimitedChain(f func(w http.ResponseWriter, r *http.Request) error, auth Auth, perm Permission, store RateLimitStore, limit RateLimit) http.HandlerFunc {
+	return AuthorizationHandler(PageHandler(RequirePermission(perm, RateLimitHandler(store, limit, ErrorHandler(f)))), auth)
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	limit := RateLimit{Name: "test", Burst: 3, Every: 10 * time.Second}
+	tests := []struct {
+		name           string
+		tokens         float64
+		elapsed        time.Duration
+		wantLeft       float64
+		wantRetryAfter time.Duration
+	}{
+		{name: "full", tokens: 3, wantLeft: 2},
+		{name: "last token", tokens: 1, wantLeft: 0},
+		{name: "empty", tokens: 0, wantLeft: 0, wantRetryAfter: 10 * time.Second},
+		{name: "partly refilled", tokens: 0, elapsed: 4 * time.Second, wantLeft: 0.4, wantRetryAfter: 6 * time.Second},
+		{name: "refilled", tokens: 0, elapsed: 10 * time.Second, wantLeft: 0},
+		{name: "refill capped at burst", tokens: 2, elapsed: time.Hour, wantLeft: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left, retryAfter := limit.Take(tt.tokens, tt.elapsed)
+			if diff := left - tt.wantLeft; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("Take() left = %v, want %v", left, tt.wantLeft)
+			}
+			if retryAfter != tt.wantRetryAfter {
+				t.Errorf("Take() retryAfter = %v, want %v", retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	limit := RateLimit{Name: "test", Burst: 2, Every: time.Minute}
+	ctx := context.Background()
+
+	take := func(key string) time.Duration {
+		t.Helper()
+		retryAfter, err := store.Take(ctx, key, limit)
+		if err != nil {
+			t.Fatalf("Take(%q) returned error: %v", key, err)
+		}
+		return retryAfter
+	}
+
+	// The burst is allowed, then the client has to wait.
+	for i := range 2 {
+		if got := take("a"); got != 0 {
+			t.Fatalf("Take(a) #%d retryAfter = %v, want 0", i, got)
+		}
+	}
+	if got := take("a"); got != time.Minute {
+		t.Errorf("Take(a) over the limit retryAfter = %v, want %v", got, time.Minute)
+	}
+	// Other keys have their own bucket.
+	if got := take("b"); got != 0 {
+		t.Errorf("Take(b) retryAfter = %v, want 0", got)
+	}
+
+	now = now.Add(time.Minute)
+	if got := take("a"); got != 0 {
+		t.Errorf("Take(a) after refilling retryAfter = %v, want 0", got)
+	}
+
+	// Full buckets are dropped.
+	now = now.Add(time.Hour)
+	take("c")
+	if _, ok := store.buckets["a"]; ok {
+		t.Error("bucket a wasn't dropped after refilling")
+	}
+	if _, ok := store.buckets["c"]; !ok {
+		t.Error("bucket c was dropped before refilling")
+	}
+}
+
+type fakeRateLimitStore struct {
+	keys       []string
+	retryAfter time.Duration
+	err        error
+}
+
+func (f *fakeRateLimitStore) Take(_ context.Context, key string, _ RateLimit) (time.Duration, error) {
+	f.keys = append(f.keys, key)
+	return f.retryAfter, f.err
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	limit := RateLimit{Name: "comment", Burst: 1, Every: time.Second}
+	tests := []struct {
+		name           string
+		userID         any
+		retryAfter     time.Duration
+		err            error
+		wantKey        string
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "user allowed", userID: 7, wantKey: "comment:user:7", wantStatus: http.StatusOK},
+		{name: "anonymous allowed", wantKey: "comment:ip:203.0.113.7", wantStatus: http.StatusOK},
+		{name: "limited", userID: 7, retryAfter: 1500 * time.Millisecond, wantKey: "comment:user:7", wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+		{name: "store error fails open", userID: 7, err: errors.New("db down"), wantKey: "comment:user:7", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeRateLimitStore{retryAfter: tt.retryAfter, err: tt.err}
+			handler := RateLimitHandler(store, limit, func(w http.ResponseWriter, r *http.Request) {})
+
+			r := httptest.NewRequest("POST", "/comments", nil)
+			r.RemoteAddr = "203.0.113.7:1234"
+			if tt.userID != nil {
+				r = r.WithContext(context.WithValue(r.Context(), CtxUserKey, tt.userID))
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if len(store.keys) != 1 || store.keys[0] != tt.wantKey {
+				t.Errorf("store keys = %q, want [%q]", store.keys, tt.wantKey)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
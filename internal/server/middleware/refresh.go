@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RefreshTokenTTL is how long a refresh token is valid for. Every refresh
+// issues a new refresh token, so a session only ends once it has gone unused
+// for this long.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// ErrRefreshTokenReused is returned by a [TokenRefresher] when a refresh
+// token that was already exchanged is presented again. Refresh tokens are
+// single-use, so this means the token was most likely stolen.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// Tokens are the credentials issued for a session.
+type Tokens struct {
+	// Access is the short-lived JWT used to authorize requests.
+	Access JWT
+	// Refresh is the single-use token exchanged for new Tokens once the
+	// access token expires. It's empty if the refresh token wasn't rotated.
+	Refresh string
+	// RefreshExpires is when the refresh token expires.
+	RefreshExpires time.Time
+}
+
+// A TokenRefresher exchanges refresh tokens for new tokens.
+type TokenRefresher interface {
+	// Refresh redeems the refresh token and returns new tokens for the same
+	// session.
+	Refresh(ctx context.Context, refreshToken string) (Tokens, error)
+}
+
+// SetAuthCookies sets the cookies holding the tokens on the response.
+// Secure should only be false when the site is served over plain HTTP
+// during development.
+func SetAuthCookies(w http.ResponseWriter, tokens Tokens, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    tokens.Access.Raw,
+		Expires:  time.Unix(int64(tokens.Access.Payload.Exp), 0),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if tokens.Refresh == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    tokens.Refresh,
+		Expires:  tokens.RefreshExpires,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearAuthCookies removes the cookies set by [SetAuthCookies].
+func ClearAuthCookies(w http.ResponseWriter, secure bool) {
+	for _, name := range []string{"access_token", "refresh_token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			MaxAge:   -1,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// refresh exchanges the request's refresh token cookie for new tokens and
+// sets them on the response.
+func refresh(w http.ResponseWriter, r *http.Request, auth Auth) (JWT, error) {
+	refreshToken, err := r.Cookie("refresh_token")
+	if err != nil {
+		return JWT{}, err
+	}
+	tokens, err := auth.Refresher.Refresh(r.Context(), refreshToken.Value)
+	if err != nil {
+		ClearAuthCookies(w, auth.SecureCookies)
+		return JWT{}, err
+	}
+	SetAuthCookies(w, tokens, auth.SecureCookies)
+	return tokens.Access, nil
+}
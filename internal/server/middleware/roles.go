@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A RoleStore looks up a user's privileges.
+type RoleStore interface {
+	// Role returns the user's role.
+	Role(ctx context.Context, userID int) (Role, error)
+}
+
+// RoleCache is a RoleStore that caches the results of another RoleStore for
+// a short time so privileges don't have to be looked up on every request.
+type RoleCache struct {
+	store RoleStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu      sync.Mutex
+	entries map[int]roleCacheEntry
+}
+
+type roleCacheEntry struct {
+	role    Role
+	expires time.Time
+}
+
+// NewRoleCache returns a RoleCache that caches lookups from store for ttl.
+func NewRoleCache(store RoleStore, ttl time.Duration) *RoleCache {
+	return &RoleCache{
+		store:   store,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[int]roleCacheEntry),
+	}
+}
+
+// Role returns the user's role, using the cached result if it hasn't
+// expired.
+func (c *RoleCache) Role(ctx context.Context, userID int) (Role, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.role, nil
+	}
+
+	role, err := c.store.Role(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.entries[userID] = roleCacheEntry{role: role, expires: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return role, nil
+}
+
+// Invalidate removes the cached result for the user so the next lookup sees
+// any change to their privileges.
+func (c *RoleCache) Invalidate(userID int) {
+	c.mu.Lock()
+	delete(c.entries, userID)
+	c.mu.Unlock()
+}
+
+// InvalidateAll removes every cached result, for changes that can affect
+// everyone's privileges.
+func (c *RoleCache) InvalidateAll() {
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeRoleStore struct {
+	roles   map[int]Role
+	lookups int
+}
+
+func (f *fakeRoleStore) Role(_ context.Context, userID int) (Role, error) {
+	f.lookups++
+	if role, ok := f.roles[userID]; ok {
+		return role, nil
+	}
+	return RoleMember, nil
+}
+
+func TestRoleCache(t *testing.T) {
+	store := &fakeRoleStore{roles: map[int]Role{1: RoleAdmin}}
+	cache := NewRoleCache(store, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	role := func(userID int) Role {
+		t.Helper()
+		got, err := cache.Role(ctx, userID)
+		if err != nil {
+			t.Fatalf("Role(%d) returned error: %v", userID, err)
+		}
+		return got
+	}
+
+	if got := role(1); got != RoleAdmin {
+		t.Errorf("Role(1) = %q, want %q", got, RoleAdmin)
+	}
+	if got := role(2); got != RoleMember {
+		t.Errorf("Role(2) = %q, want %q", got, RoleMember)
+	}
+	if store.lookups != 2 {
+		t.Errorf("got %d lookups, want 2", store.lookups)
+	}
+
+	// Changes aren't seen until the cached result expires.
+	store.roles[1] = RoleMember
+	if got := role(1); got != RoleAdmin {
+		t.Errorf("Role(1) = %q before the TTL expired, want cached %q", got, RoleAdmin)
+	}
+	now = now.Add(2 * time.Minute)
+	if got := role(1); got != RoleMember {
+		t.Errorf("Role(1) = %q after the TTL expired, want %q", got, RoleMember)
+	}
+
+	// Invalidate makes the change visible immediately.
+	store.roles[2] = RoleModerator
+	cache.Invalidate(2)
+	if got := role(2); got != RoleModerator {
+		t.Errorf("Role(2) = %q after Invalidate, want %q", got, RoleModerator)
+	}
+	if store.lookups != 4 {
+		t.Errorf("got %d lookups, want 4", store.lookups)
+	}
+
+	// InvalidateAll makes every change visible immediately.
+	store.roles[1] = RoleReadOnly
+	store.roles[2] = RoleMember
+	cache.InvalidateAll()
+	if got := role(1); got != RoleReadOnly {
+		t.Errorf("Role(1) = %q after InvalidateAll, want %q", got, RoleReadOnly)
+	}
+	if got := role(2); got != RoleMember {
+		t.Errorf("Role(2) = %q after InvalidateAll, want %q", got, RoleMember)
+	}
+	if store.lookups != 6 {
+		t.Errorf("got %d lookups, want 6", store.lookups)
+	}
+}
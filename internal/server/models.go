@@ -3,53 +3,168 @@ package server
 // TODO.
 import (
 	"errors"
+	"fmt"
+	"io/fs"
 	"time"
 
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/internal/validate"
+	"github.com/jessesomerville/yodahunters/static"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// The lengths of the VARCHAR columns that are set from requests.
+const (
+	maxUsernameLength      = 100
+	maxEmailLength         = 255
+	maxThreadTitleLength   = 100
+	maxCategoryTitleLength = 255
+)
+
+// maxPasswordLength is the longest password bcrypt can hash.
+const maxPasswordLength = 72
+
 // User is a struct for managing users in the app.
 // PasswordHash is omitted completely from JSON since it should never be returned.
 // Password can be supplied on registration, but it won't be saved in the DB so
 // we shouldn't have to worry about it getting marshaled accidentally.
 type User struct {
-	ID           int       `json:"id,omitempty" db:"id"`
-	Username     string    `json:"username,omitempty" db:"username"`
-	Email        string    `json:"email,omitempty" db:"email"`
-	Password     string    `json:"password,omitempty"`
-	PasswordHash []byte    `json:"-" db:"pw_hash"`
-	Bio          string    `json:"bio,omitempty" db:"bio"`
-	Avatar       int       `json:"avatar,omitempty" db:"avatar"`
-	IsAdmin      bool      `json:"-" db:"is_admin"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	ID           int        `json:"id,omitempty" db:"id"`
+	Username     string     `json:"username,omitempty" db:"username"`
+	Email        string     `json:"email,omitempty" db:"email"`
+	Password     string     `json:"password,omitempty"`
+	PasswordHash []byte     `json:"-" db:"pw_hash"`
+	Bio          string     `json:"bio,omitempty" db:"bio"`
+	Avatar       int        `json:"avatar,omitempty" db:"avatar"`
+	IsAdmin      bool       `json:"-" db:"is_admin"`
+	Role         string     `json:"role,omitempty" db:"role"`
+	BannedAt     *time.Time `json:"banned_at,omitempty" db:"banned_at"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
 }
 
 // Thread is a struct that holds all the data needed for thread functionality.
 type Thread struct {
-	ID         int       `json:"thread_id,omitempty" db:"thread_id"`
-	Title      string    `json:"title" db:"title"`
-	Body       string    `json:"body" db:"body"`
-	AuthorID   int       `json:"author_id,omitempty" db:"author_id"`
-	CategoryID int       `json:"category_id,omitempty" db:"category_id"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	ID         int        `json:"thread_id,omitempty" db:"thread_id"`
+	Title      string     `json:"title" db:"title"`
+	Body       string     `json:"body" db:"body"`
+	AuthorID   int        `json:"author_id,omitempty" db:"author_id"`
+	CategoryID int        `json:"category_id,omitempty" db:"category_id"`
+	Pinned     bool       `json:"pinned" db:"pinned"`
+	Locked     bool       `json:"locked" db:"locked"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	EditedAt   *time.Time `json:"edited_at,omitempty" db:"edited_at"`
 }
 
 // Category is a struct for managing categories in the app.
+// MinThreadRole and MinCommentRole are the least privileged roles that can
+// create threads and comment in the category.
 type Category struct {
-	ID          int       `json:"category_id,omitempty" db:"category_id"`
-	Title       string    `json:"title" db:"title"`
-	Description string    `json:"description" db:"description"`
-	AuthorID    int       `json:"author_id,omitempty" db:"author_id"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID             int             `json:"category_id,omitempty" db:"category_id"`
+	Title          string          `json:"title" db:"title"`
+	Description    string          `json:"description" db:"description"`
+	AuthorID       int             `json:"author_id,omitempty" db:"author_id"`
+	MinThreadRole  middleware.Role `json:"min_thread_role" db:"min_thread_role"`
+	MinCommentRole middleware.Role `json:"min_comment_role" db:"min_comment_role"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
 }
 
 // A Comment is a post responding to a thread.
 type Comment struct {
-	ID        int       `json:"comment_id,omitempty" db:"comment_id"`
-	ThreadID  int       `json:"thread_id,omitempty" db:"thread_id"`
-	AuthorID  int       `json:"author_id,omitempty" db:"author_id"`
-	Body      string    `json:"body" db:"body"`
-	ReplyID   int       `json:"reply_id,omitempty" db:"reply_id"`
+	ID        int        `json:"comment_id,omitempty" db:"comment_id"`
+	ThreadID  int        `json:"thread_id,omitempty" db:"thread_id"`
+	AuthorID  int        `json:"author_id,omitempty" db:"author_id"`
+	Body      string     `json:"body" db:"body"`
+	ReplyID   int        `json:"reply_id,omitempty" db:"reply_id"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty" db:"edited_at"`
+}
+
+// A Revision is a previous version of a thread or comment, saved when the
+// post was edited. Title is empty for comment revisions.
+type Revision struct {
+	ID         int       `json:"revision_id" db:"revision_id"`
+	Title      string    `json:"title,omitempty" db:"title"`
+	Body       string    `json:"body" db:"body"`
+	EditorID   int       `json:"editor_id" db:"editor_id"`
+	EditorName string    `json:"editor_name" db:"editor_name"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// A RegistrationKey lets new users create an account. A key can be redeemed
+// MaxUses times, until ExpiresAt if it's set. UsedBy holds the IDs of the
+// users who registered with the key, and UsedByNames their usernames.
+type RegistrationKey struct {
+	Key         string     `json:"reg_key" db:"reg_key"`
+	MaxUses     int        `json:"max_uses" db:"max_uses"`
+	UseCount    int        `json:"use_count" db:"use_count"`
+	Status      string     `json:"status" db:"status"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	CreatedBy   *int       `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UsedBy      []int      `json:"used_by" db:"used_by"`
+	UsedByNames []string   `json:"used_by_names" db:"used_by_names"`
+}
+
+// A Session is a login on one of a user's devices. Current is set for the
+// session the request listing the sessions was made with.
+type Session struct {
+	ID         string    `json:"session_id" db:"session_id"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	IPAddress  string    `json:"ip_address" db:"ip_address"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at"`
+	Current    bool      `json:"current" db:"current"`
+}
+
+// An APIToken is a personal access token as shown to the user it belongs to.
+// The token itself is only ever shown once, when it's created.
+type APIToken struct {
+	ID         int        `json:"token_id" db:"token_id"`
+	Name       string     `json:"name" db:"name"`
+	Scope      string     `json:"scope" db:"scope"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+}
+
+// A UserIdentity is an account with an OpenID Connect provider that's linked
+// to a user, which they can log in with.
+type UserIdentity struct {
+	ID          int        `json:"identity_id" db:"identity_id"`
+	Issuer      string     `json:"issuer" db:"issuer"`
+	Email       string     `json:"email" db:"email"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty" db:"last_login_at"`
+}
+
+// A Notification tells a user about a post that involves them. Kind is why
+// they were notified, one of the notify* constants, and ActorID is the user
+// who wrote the post. CommentID is 0 for mentions in a thread's opening post,
+// and Position is the comment's index in its thread, for linking to its page.
+type Notification struct {
+	ID          int        `json:"notification_id" db:"notification_id"`
+	Kind        string     `json:"kind" db:"kind"`
+	ActorID     int        `json:"actor_id" db:"actor_id"`
+	ActorName   string     `json:"actor_name" db:"actor_name"`
+	ThreadID    int        `json:"thread_id" db:"thread_id"`
+	ThreadTitle string     `json:"thread_title" db:"thread_title"`
+	CommentID   int        `json:"comment_id,omitempty" db:"comment_id"`
+	Position    int        `json:"-" db:"position"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	ReadAt      *time.Time `json:"read_at,omitempty" db:"read_at"`
+}
+
+// A LoginAttempt is an entry in the audit trail of logins. UserID is 0 when
+// the username didn't belong to an account.
+type LoginAttempt struct {
+	ID        int64     `json:"attempt_id" db:"attempt_id"`
+	Username  string    `json:"username" db:"username"`
+	UserID    int       `json:"user_id,omitempty" db:"user_id"`
+	IPAddress string    `json:"ip_address" db:"ip_address"`
+	UserAgent string    `json:"user_agent" db:"user_agent"`
+	Succeeded bool      `json:"succeeded" db:"succeeded"`
+	Reason    string    `json:"reason,omitempty" db:"reason"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
@@ -97,6 +212,23 @@ type CommentView struct {
 	CreatedAt           time.Time `db:"created_at"`
 }
 
+// A SearchResult is a thread or comment matching a full-text search.
+// Snippet is an excerpt of the post body with the matched terms wrapped
+// in the markers defined by the templates package.
+type SearchResult struct {
+	Kind       string    `json:"kind" db:"kind"`
+	ThreadID   int       `json:"thread_id" db:"thread_id"`
+	CommentID  int       `json:"comment_id,omitempty" db:"comment_id"`
+	Title      string    `json:"title" db:"title"`
+	AuthorID   int       `json:"author_id" db:"author_id"`
+	Username   string    `json:"username" db:"username"`
+	CategoryID int       `json:"category_id" db:"category_id"`
+	Rank       float32   `json:"rank" db:"rank"`
+	Snippet    string    `json:"snippet" db:"snippet"`
+	PageNumber int       `json:"page_number" db:"page_number"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
 // GeneratePasswordHash adds a hashed password to a User struct if  there is a
 // password in the struct, and a password hash is not already present.
 func (u *User) GeneratePasswordHash() error {
@@ -117,3 +249,75 @@ func (u *User) GeneratePasswordHash() error {
 	u.Password = ""
 	return nil
 }
+
+// Validate checks the fields a user registers with.
+func (u User) Validate() error {
+	var errs validate.Errors
+	errs.Required("username", u.Username)
+	errs.MaxLength("username", u.Username, maxUsernameLength)
+	errs.Check(emailRegex.MatchString(u.Email), "email", "must be a valid email address")
+	errs.MaxLength("email", u.Email, maxEmailLength)
+	checkNewPassword(&errs, "password", u.Password)
+	checkAvatar(&errs, u.Avatar)
+	return errs.Err()
+}
+
+// checkAvatar checks that there's a profile picture for the avatar number.
+func checkAvatar(errs *validate.Errors, avatar int) {
+	_, err := fs.Stat(static.FS, fmt.Sprintf("img/pfps/profile_pic_%03d.png", avatar))
+	errs.Check(avatar >= 0 && err == nil, "avatar", "must be one of the profile pictures")
+}
+
+// newThreadRequest is the body of a request to create a thread. It only has
+// the fields the author can set, so requests setting any others are
+// rejected.
+type newThreadRequest struct {
+	Title      string `json:"title"`
+	Body       string `json:"body"`
+	CategoryID int    `json:"category_id"`
+}
+
+// Validate checks the fields a thread is created with. Whether the category
+// exists is checked when the thread is inserted.
+func (t newThreadRequest) Validate() error {
+	var errs validate.Errors
+	checkThreadTitle(&errs, t.Title)
+	errs.Required("body", t.Body)
+	errs.Check(t.CategoryID > 0, "category_id", "is required")
+	return errs.Err()
+}
+
+func checkThreadTitle(errs *validate.Errors, title string) {
+	errs.Required("title", title)
+	errs.MaxLength("title", title, maxThreadTitleLength)
+}
+
+// newCommentRequest is the body of a request to create a comment. It only
+// has the fields the author can set, so requests setting any others are
+// rejected.
+type newCommentRequest struct {
+	ThreadID int    `json:"thread_id"`
+	Body     string `json:"body"`
+	ReplyID  int    `json:"reply_id"`
+}
+
+// Validate checks the fields a comment is created with. Whether the thread
+// and the comment being replied to exist is checked when the comment is
+// inserted.
+func (c newCommentRequest) Validate() error {
+	var errs validate.Errors
+	errs.Check(c.ThreadID > 0, "thread_id", "is required")
+	errs.Required("body", c.Body)
+	errs.Check(c.ReplyID >= 0, "reply_id", "must be a comment ID")
+	return errs.Err()
+}
+
+// Validate checks the fields a category is created with.
+func (c Category) Validate() error {
+	var errs validate.Errors
+	errs.Required("title", c.Title)
+	errs.MaxLength("title", c.Title, maxCategoryTitleLength)
+	errs.Check(c.MinThreadRole.Valid(), "min_thread_role", "must be a role")
+	errs.Check(c.MinCommentRole.Valid(), "min_comment_role", "must be a role")
+	return errs.Err()
+}
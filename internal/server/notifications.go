@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// The reasons a user is notified about a post. A post that's a reason for
+// more than one only notifies them once, for the first that applies.
+const (
+	// notifyReply is for a comment replying to one of theirs.
+	notifyReply = "reply"
+	// notifyThreadComment is for a comment on a thread they started.
+	notifyThreadComment = "thread_comment"
+	// notifyMention is for a post that mentions them with @username.
+	notifyMention = "mention"
+)
+
+// notifyCommentQuery notifies the users involved in the new comment $1 by
+// the user $2 on the thread $3: the author of the comment $4 it replies to,
+// the thread's author and the users with the IDs in $5 that it mentions.
+const notifyCommentQuery = `
+INSERT INTO notifications (user_id, kind, actor_id, thread_id, comment_id)
+SELECT DISTINCT ON (user_id) user_id, kind, $2, $3, $1
+FROM (
+	SELECT author_id AS user_id, '` + notifyReply + `' AS kind, 1 AS priority FROM comments WHERE comment_id = $4
+	UNION ALL
+	SELECT author_id, '` + notifyThreadComment + `', 2 FROM threads WHERE thread_id = $3
+	UNION ALL
+	SELECT unnest($5::int[]), '` + notifyMention + `', 3
+) AS recipients
+WHERE user_id <> $2
+ORDER BY user_id, priority`
+
+// notifyComment notifies the users involved in a comment that's just been
+// posted, including the mentioned users with the IDs.
+func notifyComment(ctx context.Context, tx *pg.Tx, c Comment, mentioned []int) error {
+	return tx.Exec(ctx, notifyCommentQuery, c.ID, c.AuthorID, c.ThreadID, c.ReplyID, mentioned)
+}
+
+// notifyMentionsQuery notifies the users with the IDs in $1 that the user $2
+// mentioned them in the thread $3, or in its comment $4 if that's set. Users
+// who've already been notified about the post aren't notified again.
+const notifyMentionsQuery = `
+INSERT INTO notifications (user_id, kind, actor_id, thread_id, comment_id)
+SELECT mentioned.user_id, '` + notifyMention + `', $2, $3, $4
+FROM unnest($1::int[]) AS mentioned (user_id)
+WHERE mentioned.user_id <> $2 AND NOT EXISTS (
+	SELECT 1 FROM notifications
+	WHERE notifications.user_id = mentioned.user_id
+		AND notifications.comment_id IS NOT DISTINCT FROM $4::int
+		AND ($4::int IS NOT NULL OR notifications.thread_id = $3)
+)`
+
+// notifyMentions notifies the users with the IDs that they've been mentioned
+// in a post. commentID is nil for a thread's opening post.
+func notifyMentions(ctx context.Context, tx *pg.Tx, actorID, threadID int, commentID *int, mentioned []int) error {
+	if len(mentioned) == 0 {
+		return nil
+	}
+	return tx.Exec(ctx, notifyMentionsQuery, mentioned, actorID, threadID, commentID)
+}
+
+// notificationsFrom joins notifications to the posts they're about, leaving
+// out the ones about posts that have since been deleted. A comment that was
+// moved to another thread by a merge is looked for in the thread it's in now.
+const notificationsFrom = `
+FROM notifications
+LEFT JOIN comments ON notifications.comment_id = comments.comment_id
+JOIN threads ON COALESCE(comments.thread_id, notifications.thread_id) = threads.thread_id
+JOIN users ON notifications.actor_id = users.id
+WHERE threads.deleted_at IS NULL AND comments.deleted_at IS NULL`
+
+// notificationsQuery selects a page of the user $1's notifications, newest
+// first, only selecting unread ones if $2 is set. $3 and $4 are the offset
+// and limit.
+const notificationsQuery = `
+SELECT notifications.notification_id, notifications.kind, notifications.actor_id, users.username AS actor_name,
+	threads.thread_id, threads.title AS thread_title, COALESCE(notifications.comment_id, 0) AS comment_id,
+	(SELECT COUNT(*) FROM comments AS earlier WHERE earlier.thread_id = threads.thread_id AND earlier.created_at < comments.created_at) AS position,
+	notifications.created_at, notifications.read_at
+` + notificationsFrom + `
+	AND notifications.user_id = $1 AND (NOT $2 OR notifications.read_at IS NULL)
+ORDER BY notifications.created_at DESC, notifications.notification_id DESC
+OFFSET $3 LIMIT $4`
+
+func (s *Server) listNotifications(ctx context.Context, userID int, unreadOnly bool, page middleware.Page) ([]Notification, error) {
+	return pg.QueryRowsToStruct[Notification](ctx, s.dbClient, notificationsQuery, userID, unreadOnly, page.Size*(page.Number-1), page.Size)
+}
+
+// unreadNotifications returns how many unread notifications the user has.
+func (s *Server) unreadNotifications(ctx context.Context, userID int) (int, error) {
+	row, err := s.dbClient.QueryRow(ctx, "SELECT COUNT(*)"+notificationsFrom+" AND notifications.user_id = $1 AND notifications.read_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = row.Scan(&count)
+	return count, err
+}
+
+// apiHandleGetNotifications returns a page of the user's notifications, only
+// the unread ones if the unread query parameter is true.
+func (s *Server) apiHandleGetNotifications(w http.ResponseWriter, r *http.Request) error {
+	page := r.Context().Value(middleware.CtxPageKey).(middleware.Page)
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	notifications, err := s.listNotifications(r.Context(), userID, r.URL.Query().Get("unread") == "true", page)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(notifications)
+}
+
+// apiHandlePostNotificationRead marks one of the user's notifications as
+// read.
+func (s *Server) apiHandlePostNotificationRead(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid notification ID %q", r.PathValue("id")))
+	}
+	const q = `
+	UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+	WHERE notification_id = $1 AND user_id = $2
+	RETURNING notification_id`
+	row, err := s.dbClient.QueryRow(r.Context(), q, id, r.Context().Value(middleware.CtxUserKey))
+	if err != nil {
+		return err
+	}
+	if err := row.Scan(&id); errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("notification %d not found", id))
+	} else if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiHandlePostNotificationsRead marks all of the user's notifications as
+// read.
+func (s *Server) apiHandlePostNotificationsRead(w http.ResponseWriter, r *http.Request) error {
+	const q = "UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND read_at IS NULL"
+	if err := s.dbClient.Exec(r.Context(), q, r.Context().Value(middleware.CtxUserKey)); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
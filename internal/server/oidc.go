@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/log"
+	"github.com/jessesomerville/yodahunters/internal/oidc"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// oidcLoginTTL is how long users have to log in with the provider before
+// they have to start over.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcCookiePath limits the state cookie to the OIDC login routes.
+const oidcCookiePath = "/login/oidc"
+
+// loginOIDC is the reason recorded for successful logins with the OIDC
+// provider, to tell them apart from password logins in the audit trail.
+const loginOIDC = "oidc"
+
+// identitiesQuery selects the external identities linked to the user $1.
+const identitiesQuery = `
+SELECT identity_id, issuer, email, created_at, last_login_at
+FROM user_identities
+WHERE user_id = $1
+ORDER BY created_at`
+
+// oidcLogin is a login waiting for the provider to redirect back. Logins
+// with a registration key create an account, and logins with a user ID link
+// the identity to that user's account.
+type oidcLogin struct {
+	nonce      string
+	verifier   string
+	regKey     *string
+	linkUserID *int
+	expiresAt  time.Time
+}
+
+// oidcError is returned when logging in with the provider fails. The details
+// are logged rather than shown to the user.
+var oidcError = derror.Unauthorized(errors.New("logging in with the identity provider failed"))
+
+// handleOIDCLogin sends the user to the provider to log in. If the reg_key
+// query parameter is set and the user doesn't have an account yet, one is
+// created with the registration key.
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	var regKey *string
+	if v := r.URL.Query().Get("reg_key"); v != "" {
+		row, err := s.dbClient.QueryRow(r.Context(), checkRegKeyQuery, v)
+		if err != nil {
+			return err
+		}
+		var usable bool
+		if err := row.Scan(&usable); err != nil {
+			return err
+		}
+		if !usable {
+			return derror.Forbidden(errors.New("invalid registration key"))
+		}
+		regKey = &v
+	}
+	return s.startOIDCLogin(w, r, oidcLogin{regKey: regKey})
+}
+
+// handleOIDCLink sends a logged in user to the provider to link their
+// identity there to their account.
+func (s *Server) handleOIDCLink(w http.ResponseWriter, r *http.Request) error {
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	return s.startOIDCLogin(w, r, oidcLogin{linkUserID: &userID})
+}
+
+// startOIDCLogin stores the login and redirects to the provider. The state
+// is also set in a cookie so the login can only be finished in the browser
+// it was started in.
+func (s *Server) startOIDCLogin(w http.ResponseWriter, r *http.Request, login oidcLogin) error {
+	state := rand.Text()
+	login.nonce = rand.Text()
+	login.verifier = oidc.NewVerifier()
+	authURL, err := s.oidcProvider.AuthCodeURL(r.Context(), state, login.nonce, login.verifier)
+	if err != nil {
+		log.Errorf(r.Context(), "OIDC discovery failed: %v", err)
+		return &derror.ServerError{Status: http.StatusBadGateway, Err: errors.New("the identity provider is unavailable")}
+	}
+
+	hash := sha256.Sum256([]byte(state))
+	err = s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		// Logins that were never finished are cleaned up here since it's
+		// the only place they're created.
+		if err := tx.Exec(r.Context(), "DELETE FROM oidc_login_states WHERE expires_at < CURRENT_TIMESTAMP"); err != nil {
+			return err
+		}
+		const q = `
+		INSERT INTO oidc_login_states (state_hash, nonce, code_verifier, reg_key, link_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+		return tx.Exec(r.Context(), q, hash[:], login.nonce, login.verifier, login.regKey, login.linkUserID, time.Now().Add(oidcLoginTTL))
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		Path:     oidcCookiePath,
+		HttpOnly: true,
+		Secure:   !s.devmode,
+		// The provider redirects back with a top-level GET, which Lax
+		// cookies are sent with.
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback finishes logging in with the provider. The identity is
+// linked to the logged in user if that's what the login was started for.
+// Otherwise the user the identity is linked to is logged in, or a new
+// account is created if the login was started with a registration key.
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.Errorf(r.Context(), "OIDC provider returned error %q: %s", e, query.Get("error_description"))
+		return oidcError
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie("oidc_state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return derror.BadRequest(errors.New("login state doesn't match, try logging in again"))
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_state", Path: oidcCookiePath, MaxAge: -1, HttpOnly: true, Secure: !s.devmode})
+
+	// Each login can only be finished once.
+	hash := sha256.Sum256([]byte(state))
+	const q = `
+	DELETE FROM oidc_login_states WHERE state_hash = $1
+	RETURNING nonce, code_verifier, reg_key, link_user_id, expires_at`
+	row, err := s.dbClient.QueryRow(r.Context(), q, hash[:])
+	if err != nil {
+		return err
+	}
+	var login oidcLogin
+	if err := row.Scan(&login.nonce, &login.verifier, &login.regKey, &login.linkUserID, &login.expiresAt); errors.Is(err, pg.ErrNoRows) {
+		return derror.BadRequest(errors.New("unknown login, try logging in again"))
+	} else if err != nil {
+		return err
+	}
+	if time.Now().After(login.expiresAt) {
+		return derror.BadRequest(errors.New("login expired, try logging in again"))
+	}
+
+	idToken, err := s.oidcProvider.Exchange(r.Context(), query.Get("code"), login.verifier)
+	if err != nil {
+		log.Errorf(r.Context(), "OIDC code exchange failed: %v", err)
+		return oidcError
+	}
+	claims, err := s.oidcProvider.Verify(r.Context(), idToken, login.nonce)
+	if err != nil {
+		log.Errorf(r.Context(), "OIDC ID token verification failed: %v", err)
+		return oidcError
+	}
+
+	if login.linkUserID != nil {
+		if err := s.linkIdentity(r.Context(), *login.linkUserID, claims); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/users/edit", http.StatusFound)
+		return nil
+	}
+
+	const loginQuery = `
+	UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP, email = $3
+	FROM users
+	WHERE user_identities.user_id = users.id AND issuer = $1 AND subject = $2
+	RETURNING users.id, users.username, users.is_admin, users.totp_enabled_at IS NOT NULL`
+	row, err = s.dbClient.QueryRow(r.Context(), loginQuery, claims.Issuer, claims.Subject, claims.Email)
+	if err != nil {
+		return err
+	}
+	var (
+		userID             int
+		username           string
+		isAdmin, twoFactor bool
+	)
+	err = row.Scan(&userID, &username, &isAdmin, &twoFactor)
+	if errors.Is(err, pg.ErrNoRows) {
+		if login.regKey == nil {
+			return derror.Forbidden(errors.New("no account is linked to this identity, register with a registration key or link it from your profile first"))
+		}
+		userID, username, err = s.registerIdentity(r.Context(), *login.regKey, claims)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := s.recordLoginAttempt(r, username, userID, true, loginOIDC); err != nil {
+		return err
+	}
+
+	// Users with two-factor authentication still have to enter a code,
+	// which the login page asks for when it's given a challenge.
+	if twoFactor {
+		challenge, err := s.startTwoFactorChallenge(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/login?challenge="+url.QueryEscape(challenge), http.StatusFound)
+		return nil
+	}
+	if _, err := s.startSession(w, r, userID, isAdmin); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// linkIdentity links the identity to the user's account, unless it's linked
+// to another account or the user already linked a different identity from
+// the same provider.
+func (s *Server) linkIdentity(ctx context.Context, userID int, claims oidc.Claims) error {
+	return s.dbClient.WithSerializableTx(ctx, func(tx *pg.Tx) error {
+		const q = "SELECT user_id, subject FROM user_identities WHERE issuer = $1 AND (subject = $2 OR user_id = $3)"
+		row, err := tx.QueryRow(ctx, q, claims.Issuer, claims.Subject, userID)
+		if err != nil {
+			return err
+		}
+		var linkedUserID int
+		var subject string
+		if err := row.Scan(&linkedUserID, &subject); err == nil {
+			switch {
+			case linkedUserID == userID && subject == claims.Subject:
+				return nil
+			case linkedUserID == userID:
+				return derror.Conflict(errors.New("your account is already linked to another identity from this provider, unlink it first"))
+			default:
+				return derror.Conflict(errors.New("this identity is already linked to another account"))
+			}
+		} else if !errors.Is(err, pg.ErrNoRows) {
+			return err
+		}
+		const insert = "INSERT INTO user_identities (issuer, subject, user_id, email) VALUES ($1, $2, $3, $4)"
+		return tx.Exec(ctx, insert, claims.Issuer, claims.Subject, userID, claims.Email)
+	})
+}
+
+// registerIdentity creates an account for the identity with the
+// registration key, the same way apiHandleRegister does. The provider has to
+// have verified the user's email address. The account has no password, but
+// the user can set one with the forgot password flow.
+func (s *Server) registerIdentity(ctx context.Context, regKey string, claims oidc.Claims) (int, string, error) {
+	if claims.Email == "" || !bool(claims.EmailVerified) || !emailRegex.MatchString(claims.Email) {
+		return 0, "", derror.Forbidden(errors.New("the identity provider didn't share a verified email address"))
+	}
+
+	var userID int
+	var username string
+	err := s.dbClient.WithSerializableTx(ctx, func(tx *pg.Tx) error {
+		const lockRegKey = "SELECT reg_key FROM registration_keys WHERE reg_key = $1 AND " + regKeyUsable + " FOR UPDATE"
+		row, err := tx.QueryRow(ctx, lockRegKey, regKey)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&regKey); errors.Is(err, pg.ErrNoRows) {
+			return derror.Forbidden(errors.New("invalid registration key"))
+		} else if err != nil {
+			return err
+		}
+
+		// Accounts aren't linked by email address automatically, since
+		// that would let anyone who can get the provider to vouch for an
+		// address take over the account.
+		const checkEmailExists = "SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)"
+		row, err = tx.QueryRow(ctx, checkEmailExists, claims.Email)
+		if err != nil {
+			return err
+		}
+		var emailExists bool
+		if err := row.Scan(&emailExists); err != nil {
+			return err
+		}
+		if emailExists {
+			return derror.Conflict(fmt.Errorf("an account with email %s already exists, log in and link this identity from your profile instead", claims.Email))
+		}
+
+		username, err = availableUsername(ctx, tx, identityUsername(claims))
+		if err != nil {
+			return err
+		}
+		const insertUser = "INSERT INTO users (username, email, pw_hash) VALUES ($1, $2, '') RETURNING id"
+		row, err = tx.QueryRow(ctx, insertUser, username, claims.Email)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&userID); err != nil {
+			return err
+		}
+		const insertIdentity = `
+		INSERT INTO user_identities (issuer, subject, user_id, email, last_login_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)`
+		if err := tx.Exec(ctx, insertIdentity, claims.Issuer, claims.Subject, userID, claims.Email); err != nil {
+			return err
+		}
+		return tx.Exec(ctx, redeemRegKeyQuery, userID, regKey)
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, username, nil
+}
+
+// identityUsername picks a username for a new account from the identity's
+// claims, keeping only characters that are safe in a username.
+func identityUsername(claims oidc.Claims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return -1
+	}, name)
+	// Leave room for a number to be added if the name is taken.
+	if len(name) > maxUsernameLength-10 {
+		name = name[:maxUsernameLength-10]
+	}
+	if name == "" {
+		name = "user"
+	}
+	return name
+}
+
+// availableUsername returns the name, or the name followed by the lowest
+// number that makes it unique.
+func availableUsername(ctx context.Context, tx *pg.Tx, name string) (string, error) {
+	const q = "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)"
+	for i := 1; i <= 1000; i++ {
+		candidate := name
+		if i > 1 {
+			candidate += strconv.Itoa(i)
+		}
+		row, err := tx.QueryRow(ctx, q, candidate)
+		if err != nil {
+			return "", err
+		}
+		var taken bool
+		if err := row.Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", derror.Conflict(fmt.Errorf("no username like %q is available", name))
+}
+
+func (s *Server) apiHandleGetMeIdentities(w http.ResponseWriter, r *http.Request) error {
+	identities, err := pg.QueryRowsToStruct[UserIdentity](r.Context(), s.dbClient, identitiesQuery, r.Context().Value(middleware.CtxUserKey))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(identities)
+}
+
+// apiHandleDeleteMeIdentity unlinks an external identity from the user's
+// account. Accounts created with the identity provider don't have a password,
+// so they have to set one first to still be able to log in.
+func (s *Server) apiHandleDeleteMeIdentity(w http.ResponseWriter, r *http.Request) error {
+	identityID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return derror.BadRequest(fmt.Errorf("invalid identity id %q", r.PathValue("id")))
+	}
+	const q = `
+	WITH account AS (
+		SELECT pw_hash <> '' AS has_password FROM users WHERE id = $2
+	), unlinked AS (
+		DELETE FROM user_identities
+		WHERE identity_id = $1 AND user_id = $2
+			AND ((SELECT has_password FROM account)
+				OR EXISTS(SELECT 1 FROM user_identities WHERE user_id = $2 AND identity_id <> $1))
+		RETURNING identity_id
+	)
+	SELECT EXISTS(SELECT 1 FROM unlinked), EXISTS(SELECT 1 FROM user_identities WHERE identity_id = $1 AND user_id = $2)`
+	row, err := s.dbClient.QueryRow(r.Context(), q, identityID, r.Context().Value(middleware.CtxUserKey))
+	if err != nil {
+		return err
+	}
+	var unlinked, exists bool
+	if err := row.Scan(&unlinked, &exists); err != nil {
+		return err
+	}
+	if !exists {
+		return derror.NotFound(fmt.Errorf("identity %d not found", identityID))
+	}
+	if !unlinked {
+		return derror.Conflict(errors.New("set a password before unlinking your only way to log in"))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/log"
+	"github.com/jessesomerville/yodahunters/internal/mail"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/validate"
+)
+
+const (
+	// passwordResetTTL is how long a password reset link is valid for.
+	passwordResetTTL = time.Hour
+	// minPasswordLength is the minimum length of a new password.
+	minPasswordLength = 8
+	// mailTimeout bounds how long sending an email in the background can take.
+	mailTimeout = time.Minute
+)
+
+// errInvalidResetToken is returned for reset tokens that don't exist, have
+// expired or have already been used.
+var errInvalidResetToken = derror.BadRequest(errors.New("invalid or expired password reset token"))
+
+// checkNewPassword checks that a new password in the field is acceptable.
+func checkNewPassword(errs *validate.Errors, field, password string) {
+	errs.Check(len(password) >= minPasswordLength, field, "must be at least %d characters", minPasswordLength)
+	errs.Check(len(password) <= maxPasswordLength, field, "must be at most %d bytes", maxPasswordLength)
+}
+
+// sendMail sends the message in the background so the response doesn't
+// depend on how long the mail server takes, or whether an email was sent at
+// all. Errors are only logged.
+func (s *Server) sendMail(ctx context.Context, msg mail.Message) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	go func() {
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			log.Errorf(ctx, "Failed to send email %q: %v", msg.Subject, err)
+		}
+	}()
+}
+
+// apiHandleForgotPassword emails a password reset link to the user with the
+// given email address. It always succeeds so it can't be used to find out
+// which email addresses have accounts.
+func (s *Server) apiHandleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	token := rand.Text()
+	hash := sha256.Sum256([]byte(token))
+	var username string
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		row, err := tx.QueryRow(r.Context(), "SELECT id, username FROM users WHERE email = $1", data.Email)
+		if err != nil {
+			return err
+		}
+		var userID int
+		if err := row.Scan(&userID, &username); err != nil {
+			return err
+		}
+		// Only the most recent link works.
+		const expireOld = "UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL"
+		if err := tx.Exec(r.Context(), expireOld, userID); err != nil {
+			return err
+		}
+		const insertToken = "INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)"
+		return tx.Exec(r.Context(), insertToken, hash[:], userID, time.Now().Add(passwordResetTTL))
+	})
+	if errors.Is(err, pg.ErrNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	link := s.baseURL + "/password/reset?" + url.Values{"token": {token}}.Encode()
+	s.sendMail(r.Context(), mail.Message{
+		To:      data.Email,
+		Subject: "Reset your yodahunters password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password for your account. If it was you, follow this link to choose a new password:\n\n"+
+			"%s\n\n"+
+			"The link expires in %v. If you didn't ask to reset your password you can ignore this email.\n",
+			username, link, passwordResetTTL),
+	})
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiHandleResetPassword sets a new password using a token from a password
+// reset email. The token can only be used once, and all of the user's
+// sessions are revoked so anyone logged in with the old password is logged
+// out.
+func (s *Server) apiHandleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+	var errs validate.Errors
+	checkNewPassword(&errs, "password", data.Password)
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	u := User{Password: data.Password}
+	if err := u.GeneratePasswordHash(); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(data.Token))
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		const q = `
+		SELECT user_id FROM password_reset_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		FOR UPDATE`
+		row, err := tx.QueryRow(r.Context(), q, hash[:])
+		if err != nil {
+			return err
+		}
+		var userID int
+		if err := row.Scan(&userID); errors.Is(err, pg.ErrNoRows) {
+			return errInvalidResetToken
+		} else if err != nil {
+			return err
+		}
+
+		const useToken = "UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1"
+		if err := tx.Exec(r.Context(), useToken, hash[:]); err != nil {
+			return err
+		}
+		if err := tx.Exec(r.Context(), "UPDATE users SET pw_hash = $2 WHERE id = $1", userID, u.PasswordHash); err != nil {
+			return err
+		}
+		return tx.Exec(r.Context(), revokeUserSessionsQuery, userID)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
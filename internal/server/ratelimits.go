@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/log"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// The rate limits for routes that create content, send emails or check
+// passwords. Each client can make a burst of requests, then has to wait
+// between requests.
+var (
+	threadRateLimit   = middleware.RateLimit{Name: "thread", Burst: 5, Every: time.Minute}
+	commentRateLimit  = middleware.RateLimit{Name: "comment", Burst: 10, Every: 10 * time.Second}
+	editRateLimit     = middleware.RateLimit{Name: "edit", Burst: 20, Every: 10 * time.Second}
+	accountRateLimit  = middleware.RateLimit{Name: "account", Burst: 5, Every: time.Minute}
+	loginRateLimit    = middleware.RateLimit{Name: "login", Burst: 10, Every: 10 * time.Second}
+	registerRateLimit = middleware.RateLimit{Name: "register", Burst: 5, Every: 10 * time.Minute}
+	mailRateLimit     = middleware.RateLimit{Name: "mail", Burst: 3, Every: 10 * time.Minute}
+)
+
+// rateLimitPruneInterval is how often refilled buckets are deleted from the
+// database.
+const rateLimitPruneInterval = 10 * time.Minute
+
+// pgRateLimitStore implements middleware.RateLimitStore using the
+// rate_limit_buckets table so limits survive restarts.
+type pgRateLimitStore struct {
+	dbClient *pg.Client
+}
+
+// Take implements middleware.RateLimitStore. The bucket's row is locked while
+// it's updated so concurrent requests can't take the same token.
+func (st pgRateLimitStore) Take(ctx context.Context, key string, limit middleware.RateLimit) (time.Duration, error) {
+	var retryAfter time.Duration
+	err := st.dbClient.WithTx(ctx, func(tx *pg.Tx) error {
+		const insert = `
+		INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at, full_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		ON CONFLICT (bucket_key) DO NOTHING`
+		if err := tx.Exec(ctx, insert, key, float64(limit.Burst)); err != nil {
+			return err
+		}
+		// CURRENT_TIMESTAMP is when the transaction started, which can be
+		// before a concurrent transaction that held the lock updated the
+		// bucket, so the clock is read instead and never goes backwards.
+		const q = "SELECT tokens, updated_at, GREATEST(clock_timestamp(), updated_at) FROM rate_limit_buckets WHERE bucket_key = $1 FOR UPDATE"
+		row, err := tx.QueryRow(ctx, q, key)
+		if err != nil {
+			return err
+		}
+		var tokens float64
+		var updatedAt, now time.Time
+		if err := row.Scan(&tokens, &updatedAt, &now); err != nil {
+			return err
+		}
+
+		var left float64
+		left, retryAfter = limit.Take(tokens, now.Sub(updatedAt))
+		const update = "UPDATE rate_limit_buckets SET tokens = $2, updated_at = $3, full_at = $4 WHERE bucket_key = $1"
+		return tx.Exec(ctx, update, key, left, now, now.Add(limit.FullAfter(left)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return retryAfter, nil
+}
+
+// pruneRateLimits deletes refilled buckets from the database every
+// rateLimitPruneInterval until ctx is done.
+func (st pgRateLimitStore) pruneRateLimits(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			const q = "DELETE FROM rate_limit_buckets WHERE full_at < CURRENT_TIMESTAMP"
+			if err := st.dbClient.Exec(ctx, q); err != nil {
+				log.Errorf(ctx, "Pruning rate limit buckets failed: %v", err)
+			}
+		}
+	}
+}
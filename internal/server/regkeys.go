@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+
+	"github.com/jessesomerville/yodahunters/internal/pg"
+)
+
+// regKeyUsable is the condition a registration key has to meet to be
+// redeemed: it hasn't been used up and it hasn't expired.
+const regKeyUsable = `use_count < max_uses AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)`
+
+// checkRegKeyQuery selects whether the registration key $1 can be redeemed.
+const checkRegKeyQuery = `SELECT EXISTS(SELECT 1 FROM registration_keys WHERE reg_key = $1 AND ` + regKeyUsable + `)`
+
+// redeemRegKeyQuery uses up one redemption of the registration key $2 for
+// the user $1. It returns no rows if the key can't be redeemed.
+const redeemRegKeyQuery = `
+WITH redeemed AS (
+	UPDATE registration_keys
+	SET use_count = use_count + 1, used = use_count + 1 >= max_uses, used_by = $1
+	WHERE reg_key = $2 AND ` + regKeyUsable + `
+	RETURNING reg_key
+)
+INSERT INTO registration_key_uses (reg_key, user_id)
+SELECT reg_key, $1 FROM redeemed
+RETURNING reg_key`
+
+// registrationKeysQuery selects every registration key along with who used
+// it, newest first.
+const registrationKeysQuery = `
+SELECT keys.reg_key, keys.max_uses, keys.use_count, keys.expires_at, keys.created_by, keys.created_at,
+	CASE
+		WHEN keys.use_count >= keys.max_uses THEN 'used'
+		WHEN keys.expires_at <= CURRENT_TIMESTAMP THEN 'expired'
+		ELSE 'active'
+	END AS status,
+	COALESCE(array_agg(users.id ORDER BY uses.used_at) FILTER (WHERE users.id IS NOT NULL), '{}') AS used_by,
+	COALESCE(array_agg(users.username ORDER BY uses.used_at) FILTER (WHERE users.id IS NOT NULL), '{}') AS used_by_names
+FROM registration_keys AS keys
+LEFT JOIN registration_key_uses AS uses ON keys.reg_key = uses.reg_key
+LEFT JOIN users ON uses.user_id = users.id
+GROUP BY keys.reg_key
+ORDER BY keys.created_at DESC, keys.reg_key`
+
+// mintRegKeysQuery creates $4 registration keys that can each be used $1
+// times, expire at $2 and were created by the user $3.
+const mintRegKeysQuery = `
+INSERT INTO registration_keys (max_uses, expires_at, created_by)
+SELECT $1, $2, $3 FROM generate_series(1, $4)
+RETURNING reg_key, max_uses, use_count, expires_at, created_by, created_at,
+	'active' AS status, '{}'::int[] AS used_by, '{}'::text[] AS used_by_names`
+
+// revokeRegKeyQuery deletes the registration key $1 if it hasn't been used.
+// It selects whether the key was revoked and whether it still exists.
+const revokeRegKeyQuery = `
+WITH revoked AS (DELETE FROM registration_keys WHERE reg_key = $1 AND use_count = 0 RETURNING reg_key)
+SELECT EXISTS(SELECT 1 FROM revoked), EXISTS(SELECT 1 FROM registration_keys WHERE reg_key = $1)`
+
+// listRegistrationKeys returns every registration key, newest first.
+func listRegistrationKeys(ctx context.Context, q pg.Querier) ([]RegistrationKey, error) {
+	return pg.QueryRowsToStruct[RegistrationKey](ctx, q, registrationKeysQuery)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// roleCacheTTL is how long a user's privileges are cached for. Changes made
+// through the API invalidate the cache immediately, so this only bounds how
+// long changes made directly in the database take to apply.
+const roleCacheTTL = 30 * time.Second
+
+// roleStore implements middleware.RoleStore using the users table.
+type roleStore struct {
+	dbClient *pg.Client
+}
+
+// Role returns the user's role. Users that don't exist (e.g. deleted since
+// their token was issued) and banned users are treated as read-only, and
+// admins without two-factor authentication are treated as members when it's
+// required.
+func (st roleStore) Role(ctx context.Context, userID int) (middleware.Role, error) {
+	const q = `
+	SELECT CASE
+		WHEN banned_at IS NOT NULL THEN 'read-only'
+		WHEN role = 'admin' AND totp_enabled_at IS NULL
+			AND EXISTS(SELECT 1 FROM site_settings WHERE name = $2 AND value = 'true')
+		THEN 'member'
+		ELSE role
+	END
+	FROM users WHERE id = $1`
+	row, err := st.dbClient.QueryRow(ctx, q, userID, requireAdminTwoFactorSetting)
+	if err != nil {
+		return "", err
+	}
+	var role middleware.Role
+	if err := row.Scan(&role); errors.Is(err, pg.ErrNoRows) {
+		return middleware.RoleReadOnly, nil
+	} else if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// canComment reports whether a user with the role can comment on a thread in
+// a category that requires minRole to comment. Only moderators can comment
+// on locked threads.
+func canComment(role, minRole middleware.Role, locked bool) bool {
+	if !role.Can(middleware.PermPost) || !role.AtLeast(minRole) {
+		return false
+	}
+	return !locked || role.Can(middleware.PermModerate)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/internal/templates"
+)
+
+// searchParams holds the filters for a full-text search. Optional filters are
+// nil when they weren't provided so they can be passed straight to postgres as
+// NULL.
+type searchParams struct {
+	Query      string
+	CategoryID *int
+	Author     *string
+	From       *time.Time
+	To         *time.Time
+}
+
+// parseSearchParams reads the search filters from the URL query parameters:
+//
+//	q           - the search terms (websearch syntax, e.g. "yoda -jerky")
+//	category_id - only match posts in this category
+//	author      - only match posts by this username
+//	from, to    - only match posts created within [from, to], as YYYY-MM-DD
+func parseSearchParams(r *http.Request) (searchParams, error) {
+	query := r.URL.Query()
+	params := searchParams{Query: strings.TrimSpace(query.Get("q"))}
+
+	if v := query.Get("category_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return params, derror.BadRequest(fmt.Errorf("invalid category_id %q", v))
+		}
+		params.CategoryID = &id
+	}
+	if v := strings.TrimSpace(query.Get("author")); v != "" {
+		params.Author = &v
+	}
+	if v := query.Get("from"); v != "" {
+		from, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return params, derror.BadRequest(fmt.Errorf("invalid from date %q", v))
+		}
+		params.From = &from
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return params, derror.BadRequest(fmt.Errorf("invalid to date %q", v))
+		}
+		// Include everything posted on the "to" day.
+		to = to.AddDate(0, 0, 1)
+		params.To = &to
+	}
+	return params, nil
+}
+
+// searchMatches selects every thread and comment matching the search params.
+// The params are $1: query, $2: category_id, $3: author, $4: from, $5: to.
+const searchMatches = `
+WITH search AS (SELECT websearch_to_tsquery('english', $1) AS query)
+SELECT 'thread' AS kind, threads.thread_id, 0 AS comment_id, threads.title, threads.body,
+	threads.author_id, users.username, threads.category_id, threads.created_at,
+	ts_rank(threads.search_vector, search.query) AS rank
+FROM threads
+CROSS JOIN search
+JOIN users ON threads.author_id = users.id
+WHERE threads.search_vector @@ search.query
+	AND threads.deleted_at IS NULL
+	AND ($2::int IS NULL OR threads.category_id = $2)
+	AND ($3::text IS NULL OR users.username = $3)
+	AND ($4::timestamptz IS NULL OR threads.created_at >= $4)
+	AND ($5::timestamptz IS NULL OR threads.created_at < $5)
+UNION ALL
+SELECT 'comment' AS kind, comments.thread_id, comments.comment_id, threads.title, comments.body,
+	comments.author_id, users.username, threads.category_id, comments.created_at,
+	ts_rank(comments.search_vector, search.query) AS rank
+FROM comments
+CROSS JOIN search
+JOIN threads ON comments.thread_id = threads.thread_id
+JOIN users ON comments.author_id = users.id
+WHERE comments.search_vector @@ search.query
+	AND comments.deleted_at IS NULL
+	AND threads.deleted_at IS NULL
+	AND ($2::int IS NULL OR threads.category_id = $2)
+	AND ($3::text IS NULL OR users.username = $3)
+	AND ($4::timestamptz IS NULL OR comments.created_at >= $4)
+	AND ($5::timestamptz IS NULL OR comments.created_at < $5)`
+
+// searchHeadlineOpts configures the snippets generated by ts_headline. The
+// matched terms are wrapped in markers instead of HTML tags since the post
+// bodies haven't been escaped yet.
+var searchHeadlineOpts = fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15, MaxFragments=2",
+	templates.HighlightStart, templates.HighlightStop)
+
+// search runs a full-text search over threads and comments and returns one
+// page of results ordered by rank, along with the total number of matches.
+func (s *Server) search(ctx context.Context, params searchParams, page middleware.Page) ([]SearchResult, int, error) {
+	if params.Query == "" {
+		return []SearchResult{}, 0, nil
+	}
+	args := []any{params.Query, params.CategoryID, params.Author, params.From, params.To}
+
+	var total int
+	row, err := s.dbClient.QueryRow(ctx, `SELECT COUNT(*) FROM (`+searchMatches+`)`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := row.Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// The snippets are only generated for the rows on the requested page
+	// since ts_headline is relatively expensive. Comment results also get the
+	// page of the thread they're on (using the default page size) so they can
+	// be linked to directly.
+	q := `
+	SELECT kind, thread_id, comment_id, title, author_id, username, category_id, created_at, rank,
+		ts_headline('english', body, websearch_to_tsquery('english', $1), $6) AS snippet,
+		CASE WHEN kind = 'comment' THEN
+			(SELECT COUNT(*) FROM comments WHERE comments.thread_id = matches.thread_id AND comments.created_at < matches.created_at) / $9 + 1
+		ELSE 1 END AS page_number
+	FROM (` + searchMatches + `
+		ORDER BY rank DESC, created_at DESC
+		OFFSET $7 LIMIT $8) AS matches
+	ORDER BY rank DESC, created_at DESC`
+	args = append(args, searchHeadlineOpts, page.Size*(page.Number-1), page.Size, middleware.DefaultPageSize)
+	results, err := pg.QueryRowsToStruct[SearchResult](ctx, s.dbClient, q, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
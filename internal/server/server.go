@@ -4,17 +4,22 @@ package server
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/google/safehtml/template"
+	"github.com/jessesomerville/yodahunters/internal/derror"
 	"github.com/jessesomerville/yodahunters/internal/envconfig"
 	"github.com/jessesomerville/yodahunters/internal/log"
+	"github.com/jessesomerville/yodahunters/internal/mail"
+	"github.com/jessesomerville/yodahunters/internal/oidc"
 	"github.com/jessesomerville/yodahunters/internal/pg"
 	"github.com/jessesomerville/yodahunters/internal/server/middleware"
 	"github.com/jessesomerville/yodahunters/internal/templates"
+	"github.com/jessesomerville/yodahunters/migrations"
 	"github.com/jessesomerville/yodahunters/static"
 )
 
@@ -37,7 +42,19 @@ type Server struct {
 
 	dbClient *pg.Client
 
-	jwtSecret []byte
+	jwtKeys *middleware.Keyring
+	auth    middleware.Auth
+	roles   *middleware.RoleCache
+
+	mailer  mail.Mailer
+	baseURL string
+
+	// oidcProvider is the OpenID Connect provider users can log in with,
+	// or nil if none is configured. oidcName is shown on the login button.
+	oidcProvider *oidc.Provider
+	oidcName     string
+
+	rateLimits middleware.RateLimitStore
 
 	devmode bool
 }
@@ -51,67 +68,174 @@ func Run(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return err
 	}
-	dbname := envconfig.GetEnvOrDefault("YODAHUNTERS_DATABASE_NAME", "yodahunters-db")
-	dbClient, err := pg.NewClient(ctx, dbname)
+	dbClient, err := pg.NewClient(ctx, pg.DatabaseName())
 	if err != nil {
 		return err
 	}
 	defer dbClient.Close(ctx)
 
+	// Serving with an old schema would fail on the first request that uses
+	// anything newer, so the migrations must be applied first.
+	migrator, err := pg.NewMigrator(dbClient, migrations.FS)
+	if err != nil {
+		return err
+	}
+	if err := migrator.Check(ctx); errors.Is(err, pg.ErrSchemaBehind) {
+		return fmt.Errorf("%w: run the backend with -migrate=up to apply the migrations", err)
+	} else if err != nil {
+		return err
+	}
+
+	mailer, err := mail.NewFromEnv(cfg.DevMode)
+	if err != nil {
+		return err
+	}
+
 	s := &Server{
 		renderer: renderer,
 		tmplFS:   cfg.TemplateFS,
 		dbClient: dbClient,
+		mailer:   mailer,
+		baseURL:  strings.TrimSuffix(envconfig.GetEnvOrDefault("YODAHUNTERS_BASE_URL", "http://localhost:8080"), "/"),
 		devmode:  cfg.DevMode,
 	}
 
-	s.jwtSecret = []byte(envconfig.GetEnvOrDefault("YODAHUNTERS_JWT_SECRET", ""))
-	if len(s.jwtSecret) != 32 {
-		log.Warnf(ctx, "Falling back to ephemeral JWT secret due to invalid YODAHUNTERS_JWT_SECRET")
-		s.jwtSecret = make([]byte, 32)
-		n, err := rand.Read(s.jwtSecret)
-		if err != nil || n != 32 {
-			return fmt.Errorf("failed to generate JWT signing key: %v", err)
-		}
+	s.jwtKeys, err = loadJWTKeys(ctx, dbClient, cfg.DevMode)
+	if err != nil {
+		return err
+	}
+
+	if issuer := envconfig.GetEnvOrDefault("YODAHUNTERS_OIDC_ISSUER", ""); issuer != "" {
+		s.oidcProvider = oidc.NewProvider(oidc.Config{
+			Issuer:       issuer,
+			ClientID:     envconfig.GetEnvOrDefault("YODAHUNTERS_OIDC_CLIENT_ID", ""),
+			ClientSecret: envconfig.GetEnvOrDefault("YODAHUNTERS_OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  s.baseURL + "/login/oidc/callback",
+		})
+		s.oidcName = envconfig.GetEnvOrDefault("YODAHUNTERS_OIDC_NAME", "SSO")
+	}
+
+	switch store := envconfig.GetEnvOrDefault("YODAHUNTERS_RATE_LIMIT_STORE", "postgres"); store {
+	case "postgres":
+		rateLimits := pgRateLimitStore{dbClient}
+		go rateLimits.pruneRateLimits(ctx)
+		s.rateLimits = rateLimits
+	case "memory":
+		s.rateLimits = middleware.NewMemoryRateLimitStore()
+	default:
+		return fmt.Errorf("unknown rate limit store %q", store)
+	}
+
+	sessions := sessionStore{dbClient: dbClient, jwtKeys: s.jwtKeys}
+	s.roles = middleware.NewRoleCache(roleStore{dbClient}, roleCacheTTL)
+	s.auth = middleware.Auth{
+		Keys:          s.jwtKeys,
+		Sessions:      sessions,
+		Refresher:     sessions,
+		SecureCookies: !cfg.DevMode,
+		Roles:         s.roles,
+		APITokens:     apiTokenStore{dbClient},
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/", s.chain(s.handleHome))
+	mux.Handle("GET /{$}", s.chain(s.handleHome, middleware.PermRead))
+	mux.Handle("/", middleware.ErrorHandler(handleNotFound))
 	mux.Handle("GET /login", middleware.ErrorHandler(s.handleLogin))
 	mux.Handle("GET /register", middleware.ErrorHandler(s.handleRegister))
 	mux.Handle("GET /register/{regkey}", middleware.ErrorHandler(s.handleRegisterKey))
-	mux.Handle("GET /new_thread", s.chain(s.handleNewThread))
-	mux.Handle("GET /users/{id}", s.chain(s.handleUsers))
-	mux.Handle("GET /users/edit", s.chain(s.handleUsersEdit))
-	mux.Handle("GET /threads/{id}", s.chain(s.handleThread))
-	mux.Handle("GET /category/{id}", s.chain(s.handleCategory))
+	mux.Handle("GET /password/forgot", middleware.ErrorHandler(s.handleForgotPassword))
+	mux.Handle("GET /password/reset", middleware.ErrorHandler(s.handleResetPassword))
+	mux.Handle("GET /email/confirm", middleware.ErrorHandler(s.handleConfirmEmail))
+	mux.Handle("GET /new_thread", s.chain(s.handleNewThread, middleware.PermPost))
+	mux.Handle("GET /users/{id}", s.chain(s.handleUsers, middleware.PermRead))
+	mux.Handle("GET /users/edit", s.chain(s.handleUsersEdit, middleware.PermRead))
+	mux.Handle("GET /threads/{id}", s.chain(s.handleThread, middleware.PermRead))
+	mux.Handle("GET /category/{id}", s.chain(s.handleCategory, middleware.PermRead))
+	mux.Handle("GET /search", s.chain(s.handleSearch, middleware.PermRead))
+	mux.Handle("GET /notifications", s.chain(s.handleNotifications, middleware.PermRead))
+	mux.Handle("GET /admin/registration_keys", s.chain(s.handleRegistrationKeys, middleware.PermAdmin))
+	mux.Handle("GET /admin/login_attempts", s.chain(s.handleLoginAttempts, middleware.PermAdmin))
+	if s.oidcProvider != nil {
+		mux.Handle("GET /login/oidc", s.limited(s.handleOIDCLogin, loginRateLimit))
+		mux.Handle("GET /login/oidc/callback", s.limited(s.handleOIDCCallback, loginRateLimit))
+		mux.Handle("GET /login/oidc/link", s.chain(sessionOnly(s.handleOIDCLink), middleware.PermRead))
+	}
 
-	// TODO: Switch all the middleware to the full chain
 	apiMux := http.NewServeMux()
-	apiMux.Handle("GET /threads", s.chain(s.apiHandleGetThreads))
-	apiMux.Handle("GET /category/{id}", s.chain(s.getHandleGetThreadsByCategoryID))
-	apiMux.Handle("GET /threads/{id}", s.chain(s.apiHandleGetThreadByID))
-	apiMux.Handle("GET /threads/{id}/comments", s.chain(s.apiHandleGetCommentsByThreadID))
-	apiMux.Handle("POST /threads", s.chain(s.apiHandlePostThreads))
-	// TODO?: delete
+	apiMux.Handle("GET /threads", s.chain(s.apiHandleGetThreads, middleware.PermRead))
+	apiMux.Handle("GET /category/{id}", s.chain(s.getHandleGetThreadsByCategoryID, middleware.PermRead))
+	apiMux.Handle("GET /threads/{id}", s.chain(s.apiHandleGetThreadByID, middleware.PermRead))
+	apiMux.Handle("GET /threads/{id}/comments", s.chain(s.apiHandleGetCommentsByThreadID, middleware.PermRead))
+	apiMux.Handle("POST /threads", s.limitedChain(s.apiHandlePostThreads, middleware.PermPost, threadRateLimit))
+	apiMux.Handle("PATCH /threads/{id}", s.limitedChain(s.apiHandlePatchThread, middleware.PermPost, editRateLimit))
+	apiMux.Handle("DELETE /threads/{id}", s.chain(s.apiHandleDeleteThread, middleware.PermPost))
+	apiMux.Handle("GET /threads/{id}/revisions", s.chain(s.apiHandleGetThreadRevisions, middleware.PermRead))
+	apiMux.Handle("POST /threads/{id}/pin", s.chain(s.apiHandlePinThread, middleware.PermModerate))
+	apiMux.Handle("POST /threads/{id}/unpin", s.chain(s.apiHandleUnpinThread, middleware.PermModerate))
+	apiMux.Handle("POST /threads/{id}/lock", s.chain(s.apiHandleLockThread, middleware.PermModerate))
+	apiMux.Handle("POST /threads/{id}/unlock", s.chain(s.apiHandleUnlockThread, middleware.PermModerate))
+	apiMux.Handle("POST /threads/{id}/move", s.chain(s.apiHandleMoveThread, middleware.PermModerate))
+	apiMux.Handle("POST /threads/{id}/merge", s.chain(s.apiHandleMergeThread, middleware.PermModerate))
 
-	apiMux.HandleFunc("POST /categories", s.adminChain(s.apiHandlePostCategories))
-	apiMux.HandleFunc("GET /categories", s.chain(s.apiHandleGetCategories))
+	apiMux.HandleFunc("POST /categories", s.chain(s.apiHandlePostCategories, middleware.PermAdmin))
+	apiMux.HandleFunc("GET /categories", s.chain(s.apiHandleGetCategories, middleware.PermRead))
 
-	apiMux.Handle("POST /comments", s.chain(s.apiHandlePostComments))
-	apiMux.Handle("GET /comments/{id}", s.chain(s.apiHandleGetCommentByID))
+	apiMux.Handle("POST /comments", s.limitedChain(s.apiHandlePostComments, middleware.PermPost, commentRateLimit))
+	apiMux.Handle("GET /comments/{id}", s.chain(s.apiHandleGetCommentByID, middleware.PermRead))
+	apiMux.Handle("PATCH /comments/{id}", s.limitedChain(s.apiHandlePatchComment, middleware.PermPost, editRateLimit))
+	apiMux.Handle("DELETE /comments/{id}", s.chain(s.apiHandleDeleteComment, middleware.PermPost))
+	apiMux.Handle("GET /comments/{id}/revisions", s.chain(s.apiHandleGetCommentRevisions, middleware.PermRead))
 
-	apiMux.HandleFunc("POST /register", middleware.ErrorHandler(s.apiHandleRegister))
-	apiMux.HandleFunc("POST /login", middleware.ErrorHandler(s.apiHandleLogin))
+	apiMux.Handle("POST /registration_keys", s.chain(s.apiHandlePostRegistrationKeys, middleware.PermAdmin))
+	apiMux.Handle("GET /registration_keys", s.chain(s.apiHandleGetRegistrationKeys, middleware.PermAdmin))
+	apiMux.Handle("DELETE /registration_keys/{key}", s.chain(s.apiHandleDeleteRegistrationKey, middleware.PermAdmin))
+	apiMux.Handle("GET /login_attempts", s.chain(s.apiHandleGetLoginAttempts, middleware.PermAdmin))
 
-	apiMux.HandleFunc("GET /me", s.chain(s.apiHandleGetMe))
-	apiMux.HandleFunc("POST /me", s.chain(s.apiHandlePostMe))
+	apiMux.HandleFunc("POST /register", s.limited(s.apiHandleRegister, registerRateLimit))
+	apiMux.HandleFunc("POST /login", s.limited(s.apiHandleLogin, loginRateLimit))
+	apiMux.HandleFunc("POST /login/2fa", s.limited(s.apiHandleLoginTwoFactor, loginRateLimit))
+	apiMux.Handle("POST /logout", s.chain(s.apiHandleLogout, middleware.PermRead))
+	apiMux.HandleFunc("POST /password/forgot", s.limited(s.apiHandleForgotPassword, mailRateLimit))
+	apiMux.HandleFunc("POST /password/reset", s.limited(s.apiHandleResetPassword, accountRateLimit))
+	apiMux.HandleFunc("POST /email/confirm", s.limited(s.apiHandleConfirmEmail, accountRateLimit))
 
+	apiMux.Handle("GET /search", s.chain(s.apiHandleSearch, middleware.PermRead))
+
+	apiMux.Handle("GET /notifications", s.chain(s.apiHandleGetNotifications, middleware.PermRead))
+	apiMux.Handle("POST /notifications/read", s.chain(s.apiHandlePostNotificationsRead, middleware.PermRead))
+	apiMux.Handle("POST /notifications/{id}/read", s.chain(s.apiHandlePostNotificationRead, middleware.PermRead))
+
+	apiMux.HandleFunc("GET /me", s.chain(s.apiHandleGetMe, middleware.PermRead))
+	apiMux.HandleFunc("POST /me", s.chain(s.apiHandlePostMe, middleware.PermPost))
+	apiMux.Handle("POST /me/password", s.limitedChain(sessionOnly(s.apiHandlePostMePassword), middleware.PermRead, accountRateLimit))
+	apiMux.Handle("POST /me/email", s.limitedChain(sessionOnly(s.apiHandlePostMeEmail), middleware.PermRead, mailRateLimit))
+	apiMux.Handle("POST /me/2fa/setup", s.limitedChain(sessionOnly(s.apiHandlePostMeTwoFactorSetup), middleware.PermRead, accountRateLimit))
+	apiMux.Handle("POST /me/2fa/enable", s.limitedChain(sessionOnly(s.apiHandlePostMeTwoFactorEnable), middleware.PermRead, accountRateLimit))
+	apiMux.Handle("POST /me/2fa/disable", s.limitedChain(sessionOnly(s.apiHandlePostMeTwoFactorDisable), middleware.PermRead, accountRateLimit))
+	apiMux.Handle("POST /me/2fa/recovery_codes", s.limitedChain(sessionOnly(s.apiHandlePostMeRecoveryCodes), middleware.PermRead, accountRateLimit))
+	apiMux.Handle("GET /settings/2fa", s.chain(s.apiHandleGetTwoFactorSettings, middleware.PermAdmin))
+	apiMux.Handle("PUT /settings/2fa", s.chain(s.apiHandlePutTwoFactorSettings, middleware.PermAdmin))
+	apiMux.Handle("PUT /users/{id}/role", s.chain(s.apiHandlePutUserRole, middleware.PermAdmin))
+	apiMux.Handle("GET /me/sessions", s.chain(sessionOnly(s.apiHandleGetMeSessions), middleware.PermRead))
+	apiMux.Handle("DELETE /me/sessions/{id}", s.chain(sessionOnly(s.apiHandleDeleteMeSession), middleware.PermRead))
+	apiMux.Handle("GET /me/tokens", s.chain(sessionOnly(s.apiHandleGetMeTokens), middleware.PermRead))
+	apiMux.Handle("POST /me/tokens", s.limitedChain(sessionOnly(s.apiHandlePostMeTokens), middleware.PermRead, accountRateLimit))
+	apiMux.Handle("DELETE /me/tokens/{id}", s.chain(sessionOnly(s.apiHandleDeleteMeToken), middleware.PermRead))
+	apiMux.Handle("GET /me/identities", s.chain(sessionOnly(s.apiHandleGetMeIdentities), middleware.PermRead))
+	apiMux.Handle("DELETE /me/identities/{id}", s.chain(sessionOnly(s.apiHandleDeleteMeIdentity), middleware.PermRead))
+
+	apiMux.Handle("/", middleware.ErrorHandler(handleNotFound))
 	mux.Handle("/api/", http.StripPrefix("/api", apiMux))
 
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServerFS(static.FS)))
 
-	srv := &http.Server{Addr: cfg.Address, Handler: middleware.Logger(ctx, mux)}
+	// Every route is protected from CSRF, since the API authenticates with
+	// cookies. Requests using API tokens are exempt.
+	handler := middleware.CSRFHandler(mux, !cfg.DevMode)
+	// Errors from API routes are written as problem details, and errors
+	// from pages as an HTML page.
+	handler = middleware.ErrorResponses(handler, "/api/", s.serveErrorPage)
+	srv := &http.Server{Addr: cfg.Address, Handler: middleware.Logger(ctx, handler)}
 
 	log.Infof(ctx, "Serving site at %q\n", cfg.Address)
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
@@ -120,30 +244,85 @@ func Run(ctx context.Context, cfg Config) error {
 	return nil
 }
 
-func (s *Server) chain(f func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
-	return middleware.Chain(f, s.jwtSecret)
+// handleNotFound handles requests for paths that don't match any route.
+func handleNotFound(w http.ResponseWriter, r *http.Request) error {
+	return derror.NotFound(fmt.Errorf("nothing found at %s", r.URL.Path))
 }
 
-func (s *Server) adminChain(f func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
-	return middleware.AdminChain(f, s.jwtSecret)
+// chain wraps f in the full middleware chain, only allowing users whose role
+// has the permission.
+func (s *Server) chain(f func(http.ResponseWriter, *http.Request) error, perm middleware.Permission) http.HandlerFunc {
+	return middleware.Chain(f, s.auth, perm)
+}
+
+// limitedChain is chain with a rate limit applied to each user.
+func (s *Server) limitedChain(f func(http.ResponseWriter, *http.Request) error, perm middleware.Permission, limit middleware.RateLimit) http.HandlerFunc {
+	return middleware.RateLimitedChain(f, s.auth, perm, s.rateLimits, limit)
+}
+
+// limited applies a rate limit to each IP address for routes that don't
+// require authorization.
+func (s *Server) limited(f func(http.ResponseWriter, *http.Request) error, limit middleware.RateLimit) http.HandlerFunc {
+	return middleware.RateLimitHandler(s.rateLimits, limit, middleware.ErrorHandler(f))
 }
 
 func (s *Server) serveHTML(ctx context.Context, w http.ResponseWriter, tmpl string, data any) error {
+	buf, err := s.render(tmpl, data)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(buf)); err != nil {
+		log.Errorf(ctx, "serveHTML(w, %q, data): failed to write to http.ResponseWriter: %v", tmpl, err)
+	}
+	return nil
+}
+
+// render renders the template, reparsing the templates first in dev mode.
+func (s *Server) render(tmpl string, data any) ([]byte, error) {
 	renderer := s.renderer
 	if s.devmode {
 		var err error
 		renderer, err = templates.New(s.tmplFS)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return renderer.Render(tmpl, data)
+}
 
-	buf, err := renderer.Render(tmpl, data)
+// serveErrorPage implements middleware.ErrorPage for browser routes. The
+// page is rendered before anything is written, so if it fails the error can
+// still be written as plain text.
+func (s *Server) serveErrorPage(w http.ResponseWriter, r *http.Request, serr *derror.ServerError) error {
+	title := http.StatusText(serr.Status)
+	header := publicHeaderData(title, r)
+	if _, ok := r.Context().Value(middleware.CtxUserKey).(int); ok {
+		if h, err := s.newHeaderData(title, r); err == nil {
+			header = h
+		}
+	}
+	data := struct {
+		HeaderData HeaderData
+		Status     int
+		Title      string
+		Detail     string
+	}{
+		HeaderData: header,
+		Status:     serr.Status,
+		Title:      title,
+		Detail:     serr.Err.Error(),
+	}
+	if data.Detail == title {
+		data.Detail = ""
+	}
+	buf, err := s.render("error", data)
 	if err != nil {
 		return err
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(serr.Status)
 	if _, err := io.Copy(w, bytes.NewReader(buf)); err != nil {
-		log.Errorf(ctx, "serveHTML(w, %q, data): failed to write to http.ResponseWriter: %v", tmpl, err)
+		log.Errorf(r.Context(), "serveErrorPage: failed to write to http.ResponseWriter: %v", err)
 	}
 	return nil
 }
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+)
+
+// activeSessionsQuery selects the active sessions of the user $1, flagging the
+// session $2 as the current one.
+const activeSessionsQuery = `
+SELECT session_id, user_agent, ip_address, created_at, last_seen_at, expires_at, session_id = $2 AS current
+FROM sessions
+WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+ORDER BY last_seen_at DESC`
+
+// errBanned is returned when a banned user tries to log in.
+var errBanned = derror.Forbidden(errors.New("this account has been banned"))
+
+// revokeUserSessionsQuery revokes all of the user $1's sessions, logging them
+// out everywhere once their access tokens expire.
+const revokeUserSessionsQuery = "UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL"
+
+// refreshReuseGrace is how long after a refresh token is used that it can be
+// presented again without being treated as stolen. Browsers often send a few
+// requests at once when the access token has expired, which all carry the
+// same refresh token.
+const refreshReuseGrace = 10 * time.Second
+
+// sessionStore implements middleware.SessionStore and middleware.TokenRefresher
+// using the sessions and refresh_tokens tables.
+type sessionStore struct {
+	dbClient *pg.Client
+	jwtKeys  *middleware.Keyring
+}
+
+// SessionActive reports whether the session exists for the user and hasn't
+// been revoked or expired. It also records when the session was last seen,
+// at most every few minutes so not every request has to write to the DB.
+func (st sessionStore) SessionActive(ctx context.Context, sessionID string, userID int) (bool, error) {
+	const q = `
+	WITH active AS (
+		SELECT session_id, last_seen_at FROM sessions
+		WHERE session_id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	), seen AS (
+		UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP
+		FROM active
+		WHERE sessions.session_id = active.session_id AND active.last_seen_at < CURRENT_TIMESTAMP - INTERVAL '5 minutes'
+	)
+	SELECT EXISTS(SELECT 1 FROM active)`
+	row, err := st.dbClient.QueryRow(ctx, q, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	var active bool
+	if err := row.Scan(&active); err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token.
+// The refresh token is marked as used, and if it's presented again after the
+// grace period the whole session is revoked since the token must have been
+// stolen. Within the grace period only a new access token is issued.
+func (st sessionStore) Refresh(ctx context.Context, refreshToken string) (middleware.Tokens, error) {
+	hash := sha256.Sum256([]byte(refreshToken))
+
+	var tokens middleware.Tokens
+	var reused bool
+	err := st.dbClient.WithTx(ctx, func(tx *pg.Tx) error {
+		const q = `
+		SELECT refresh_tokens.session_id, refresh_tokens.expires_at, refresh_tokens.used_at,
+			sessions.revoked_at IS NOT NULL, sessions.user_id, users.is_admin
+		FROM refresh_tokens
+		JOIN sessions ON refresh_tokens.session_id = sessions.session_id
+		JOIN users ON sessions.user_id = users.id
+		WHERE refresh_tokens.token_hash = $1
+		FOR UPDATE OF refresh_tokens`
+		row, err := tx.QueryRow(ctx, q, hash[:])
+		if err != nil {
+			return err
+		}
+		var (
+			sessionID string
+			expiresAt time.Time
+			usedAt    *time.Time
+			revoked   bool
+			userID    int
+			isAdmin   bool
+		)
+		if err := row.Scan(&sessionID, &expiresAt, &usedAt, &revoked, &userID, &isAdmin); errors.Is(err, pg.ErrNoRows) {
+			return errors.New("unknown refresh token")
+		} else if err != nil {
+			return err
+		}
+		if revoked {
+			return errors.New("session has been revoked")
+		}
+
+		if usedAt != nil {
+			if time.Since(*usedAt) > refreshReuseGrace {
+				// The session is revoked in this transaction, so the reuse
+				// error is only returned once it has been committed.
+				reused = true
+				const revoke = "UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE session_id = $1"
+				return tx.Exec(ctx, revoke, sessionID)
+			}
+			tokens.Access, err = middleware.GenerateSessionJWT(sessionID, userID, isAdmin, st.jwtKeys)
+			return err
+		}
+		if time.Now().After(expiresAt) {
+			return errors.New("refresh token has expired")
+		}
+
+		const markUsed = "UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1"
+		if err := tx.Exec(ctx, markUsed, hash[:]); err != nil {
+			return err
+		}
+		tokens, err = issueTokens(ctx, tx, sessionID, userID, isAdmin, st.jwtKeys)
+		return err
+	})
+	if err != nil {
+		return middleware.Tokens{}, err
+	}
+	if reused {
+		return middleware.Tokens{}, middleware.ErrRefreshTokenReused
+	}
+	return tokens, nil
+}
+
+// issueTokens generates an access token and a new refresh token for the
+// session, and extends the session until the refresh token expires.
+func issueTokens(ctx context.Context, tx *pg.Tx, sessionID string, userID int, isAdmin bool, keys *middleware.Keyring) (middleware.Tokens, error) {
+	jwt, err := middleware.GenerateSessionJWT(sessionID, userID, isAdmin, keys)
+	if err != nil {
+		return middleware.Tokens{}, err
+	}
+	tokens := middleware.Tokens{
+		Access:         jwt,
+		Refresh:        rand.Text(),
+		RefreshExpires: time.Now().Add(middleware.RefreshTokenTTL),
+	}
+	hash := sha256.Sum256([]byte(tokens.Refresh))
+
+	const insertToken = "INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)"
+	if err := tx.Exec(ctx, insertToken, hash[:], sessionID, tokens.RefreshExpires); err != nil {
+		return middleware.Tokens{}, err
+	}
+	const extendSession = "UPDATE sessions SET expires_at = $2 WHERE session_id = $1"
+	if err := tx.Exec(ctx, extendSession, sessionID, tokens.RefreshExpires); err != nil {
+		return middleware.Tokens{}, err
+	}
+	return tokens, nil
+}
+
+// startSession creates a new session for the user, recording some details
+// about the client so users can tell their sessions apart, and sets the
+// session's token cookies on the response. Banned users can't start one.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, userID int, isAdmin bool) (middleware.Tokens, error) {
+	ip := middleware.ClientIP(r)
+	sessionID := rand.Text()
+
+	var tokens middleware.Tokens
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		row, err := tx.QueryRow(r.Context(), "SELECT banned_at IS NOT NULL FROM users WHERE id = $1 FOR SHARE", userID)
+		if err != nil {
+			return err
+		}
+		var banned bool
+		if err := row.Scan(&banned); err != nil {
+			return err
+		}
+		if banned {
+			return errBanned
+		}
+
+		const q = `
+		INSERT INTO sessions (session_id, user_id, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+		expiresAt := time.Now().Add(middleware.RefreshTokenTTL)
+		if err := tx.Exec(r.Context(), q, sessionID, userID, r.UserAgent(), ip, expiresAt); err != nil {
+			return err
+		}
+		tokens, err = issueTokens(r.Context(), tx, sessionID, userID, isAdmin, s.jwtKeys)
+		return err
+	})
+	if err != nil {
+		return middleware.Tokens{}, err
+	}
+	middleware.SetAuthCookies(w, tokens, !s.devmode)
+	return tokens, nil
+}
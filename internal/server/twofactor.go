@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+	"github.com/jessesomerville/yodahunters/internal/pg"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
+	"github.com/jessesomerville/yodahunters/internal/totp"
+	"github.com/jessesomerville/yodahunters/internal/validate"
+)
+
+const (
+	// totpIssuer is the name authenticator apps show for the account.
+	totpIssuer = "yodahunters"
+	// totpSkew is how many time steps either side of the current one are
+	// accepted, to allow for clock drift.
+	totpSkew = 1
+	// recoveryCodeCount is how many recovery codes are generated at a time.
+	recoveryCodeCount = 10
+	// twoFactorChallengeTTL is how long a user has to enter their code after
+	// entering their password.
+	twoFactorChallengeTTL = 5 * time.Minute
+	// maxTwoFactorAttempts is how many codes can be tried for a challenge
+	// before the user has to enter their password again.
+	maxTwoFactorAttempts = 5
+
+	// requireAdminTwoFactorSetting is the site setting that makes two-factor
+	// authentication mandatory for admins. Admins without it enabled only get
+	// the privileges of a member.
+	requireAdminTwoFactorSetting = "require_admin_two_factor"
+)
+
+var errInvalidTwoFactorCode = derror.Forbidden(errors.New("invalid two-factor code"))
+
+// newRecoveryCodes generates a set of recovery codes, formatted in groups of
+// four characters so they're easier to copy down.
+func newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := rand.Text()[:16]
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+	}
+	return codes
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored as. Recovery
+// codes are case insensitive and the separators are optional.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// replaceRecoveryCodes generates new recovery codes for the user, replacing
+// any they already had.
+func replaceRecoveryCodes(ctx context.Context, tx *pg.Tx, userID int) ([]string, error) {
+	if err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := newRecoveryCodes()
+	for _, code := range codes {
+		const q = "INSERT INTO recovery_codes (code_hash, user_id) VALUES ($1, $2)"
+		if err := tx.Exec(ctx, q, hashRecoveryCode(code), userID); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// verifySecondFactor checks a TOTP code or an unused recovery code for the
+// user, and records that it's been used so it can't be used again.
+func verifySecondFactor(ctx context.Context, tx *pg.Tx, userID int, code string) (bool, error) {
+	const q = "SELECT totp_secret, totp_last_step FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL FOR UPDATE"
+	row, err := tx.QueryRow(ctx, q, userID)
+	if err != nil {
+		return false, err
+	}
+	var secret []byte
+	var lastStep int64
+	if err := row.Scan(&secret, &lastStep); errors.Is(err, pg.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := totp.Validate(secret, code, time.Now(), totpSkew); ok {
+		if step <= lastStep {
+			return false, nil
+		}
+		return true, tx.Exec(ctx, "UPDATE users SET totp_last_step = $2 WHERE id = $1", userID, step)
+	}
+
+	const useRecoveryCode = `
+	UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	RETURNING user_id`
+	row, err = tx.QueryRow(ctx, useRecoveryCode, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	if err := row.Scan(&userID); errors.Is(err, pg.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// startTwoFactorChallenge returns a token that's exchanged, along with a
+// code, for a session by apiHandleLoginTwoFactor.
+func (s *Server) startTwoFactorChallenge(ctx context.Context, userID int) (string, error) {
+	token := rand.Text()
+	hash := sha256.Sum256([]byte(token))
+	const q = "INSERT INTO two_factor_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)"
+	if err := s.dbClient.Exec(ctx, q, hash[:], userID, time.Now().Add(twoFactorChallengeTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// apiHandleLoginTwoFactor is the second step of logging in for users with
+// two-factor authentication enabled. It takes the challenge returned by
+// apiHandleLogin and a TOTP or recovery code, and starts a session.
+func (s *Server) apiHandleLoginTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(data.Challenge))
+	var userID int
+	var isAdmin, verified bool
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		const q = `
+		SELECT two_factor_challenges.user_id, users.is_admin
+		FROM two_factor_challenges
+		JOIN users ON two_factor_challenges.user_id = users.id
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP AND attempts < $2
+		FOR UPDATE OF two_factor_challenges`
+		row, err := tx.QueryRow(r.Context(), q, hash[:], maxTwoFactorAttempts)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&userID, &isAdmin); errors.Is(err, pg.ErrNoRows) {
+			return derror.Unauthorized(errors.New("invalid or expired login challenge"))
+		} else if err != nil {
+			return err
+		}
+
+		verified, err = verifySecondFactor(r.Context(), tx, userID, data.Code)
+		if err != nil {
+			return err
+		}
+		// Failed attempts are committed so the codes can't be guessed
+		// indefinitely with the same challenge.
+		const record = `
+		UPDATE two_factor_challenges
+		SET attempts = attempts + 1, used_at = CASE WHEN $2 THEN CURRENT_TIMESTAMP END
+		WHERE token_hash = $1`
+		return tx.Exec(r.Context(), record, hash[:], verified)
+	})
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return errInvalidTwoFactorCode
+	}
+
+	tokens, err := s.startSession(w, r, userID, isAdmin)
+	if err != nil {
+		return err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	token.AccessToken = tokens.Access.Raw
+	return json.NewEncoder(w).Encode(token)
+}
+
+// apiHandlePostMeTwoFactorSetup starts enrolling the user in two-factor
+// authentication by generating a new secret for their authenticator app. It
+// isn't enabled until they verify a code with apiHandlePostMeTwoFactorEnable.
+func (s *Server) apiHandlePostMeTwoFactorSetup(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	secret := totp.NewSecret()
+	var username string
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		if err := checkPassword(r.Context(), tx, userID, data.CurrentPassword); err != nil {
+			return err
+		}
+		const q = `
+		UPDATE users SET totp_secret = $2
+		WHERE id = $1 AND totp_enabled_at IS NULL
+		RETURNING username`
+		row, err := tx.QueryRow(r.Context(), q, userID, secret)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&username); errors.Is(err, pg.ErrNoRows) {
+			return derror.Conflict(errors.New("two-factor authentication is already enabled"))
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{
+		Secret: totp.EncodeSecret(secret),
+		URI:    totp.URI(totpIssuer, username, secret),
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// apiHandlePostMeTwoFactorEnable finishes enrolling the user in two-factor
+// authentication once they've verified a code from their authenticator app,
+// and returns their recovery codes. This is the only time the recovery codes
+// are shown.
+func (s *Server) apiHandlePostMeTwoFactorEnable(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	var codes []string
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		const q = "SELECT totp_secret FROM users WHERE id = $1 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL FOR UPDATE"
+		row, err := tx.QueryRow(r.Context(), q, userID)
+		if err != nil {
+			return err
+		}
+		var secret []byte
+		if err := row.Scan(&secret); errors.Is(err, pg.ErrNoRows) {
+			return derror.Conflict(errors.New("two-factor authentication setup hasn't been started"))
+		} else if err != nil {
+			return err
+		}
+		step, ok := totp.Validate(secret, strings.TrimSpace(data.Code), time.Now(), totpSkew)
+		if !ok {
+			return errInvalidTwoFactorCode
+		}
+
+		const enable = "UPDATE users SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = $2 WHERE id = $1"
+		if err := tx.Exec(r.Context(), enable, userID, step); err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(r.Context(), tx, userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.roles.Invalidate(userID)
+
+	resp := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// apiHandlePostMeTwoFactorDisable turns off two-factor authentication for the
+// user. Both their password and a code are required.
+func (s *Server) apiHandlePostMeTwoFactorDisable(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		if err := checkPassword(r.Context(), tx, userID, data.CurrentPassword); err != nil {
+			return err
+		}
+		ok, err := verifySecondFactor(r.Context(), tx, userID, data.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidTwoFactorCode
+		}
+		const disable = "UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = $1"
+		if err := tx.Exec(r.Context(), disable, userID); err != nil {
+			return err
+		}
+		return tx.Exec(r.Context(), "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	})
+	if err != nil {
+		return err
+	}
+	s.roles.Invalidate(userID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiHandlePostMeRecoveryCodes replaces the user's recovery codes, e.g.
+// after they've used most of them.
+func (s *Server) apiHandlePostMeRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	var codes []string
+	err := s.dbClient.WithTx(r.Context(), func(tx *pg.Tx) error {
+		if err := checkPassword(r.Context(), tx, userID, data.CurrentPassword); err != nil {
+			return err
+		}
+		row, err := tx.QueryRow(r.Context(), "SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = $1", userID)
+		if err != nil {
+			return err
+		}
+		var enabled bool
+		if err := row.Scan(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			return derror.Conflict(errors.New("two-factor authentication isn't enabled"))
+		}
+		codes, err = replaceRecoveryCodes(r.Context(), tx, userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// requireAdminTwoFactor reports whether admins must have two-factor
+// authentication enabled.
+func requireAdminTwoFactor(ctx context.Context, q pg.Querier) (bool, error) {
+	const query = "SELECT EXISTS(SELECT 1 FROM site_settings WHERE name = $1 AND value = 'true')"
+	row, err := q.QueryRow(ctx, query, requireAdminTwoFactorSetting)
+	if err != nil {
+		return false, err
+	}
+	var required bool
+	if err := row.Scan(&required); err != nil {
+		return false, err
+	}
+	return required, nil
+}
+
+func (s *Server) apiHandleGetTwoFactorSettings(w http.ResponseWriter, r *http.Request) error {
+	required, err := requireAdminTwoFactor(r.Context(), s.dbClient)
+	if err != nil {
+		return err
+	}
+	resp := struct {
+		RequireForAdmins bool `json:"require_for_admins"`
+	}{
+		RequireForAdmins: required,
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// apiHandlePutTwoFactorSettings sets whether admins must have two-factor
+// authentication enabled. The admin making the change must have it enabled
+// themselves so they don't lose their own privileges.
+func (s *Server) apiHandlePutTwoFactorSettings(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		RequireForAdmins bool `json:"require_for_admins"`
+	}
+	if err := validate.DecodeJSON(w, r, &data); err != nil {
+		return err
+	}
+
+	if data.RequireForAdmins {
+		const q = "SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = $1"
+		row, err := s.dbClient.QueryRow(r.Context(), q, r.Context().Value(middleware.CtxUserKey))
+		if err != nil {
+			return err
+		}
+		var enabled bool
+		if err := row.Scan(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			return derror.Conflict(errors.New("enable two-factor authentication for your own account first"))
+		}
+	}
+
+	const q = `
+	INSERT INTO site_settings (name, value) VALUES ($1, $2)
+	ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`
+	value := "false"
+	if data.RequireForAdmins {
+		value = "true"
+	}
+	if err := s.dbClient.Exec(r.Context(), q, requireAdminTwoFactorSetting, value); err != nil {
+		return err
+	}
+	s.roles.InvalidateAll()
+	return json.NewEncoder(w).Encode(data)
+}
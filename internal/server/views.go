@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"math"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/jessesomerville/yodahunters/internal/derror"
 	"github.com/jessesomerville/yodahunters/internal/pg"
 	"github.com/jessesomerville/yodahunters/internal/server/middleware"
 	"github.com/jessesomerville/yodahunters/static"
@@ -27,36 +29,79 @@ type PageData struct {
 // HeaderData is a stuct for holding all the bits of data
 // used by all our templates.
 type HeaderData struct {
-	UserID     int
-	HTMLTitle  string
-	Categories []Category
+	UserID      int
+	IsAdmin     bool
+	Role        middleware.Role
+	CanPost     bool
+	CanModerate bool
+	HTMLTitle   string
+	Categories  []Category
+	// UnreadNotifications is shown as a badge on the link to the
+	// notifications page.
+	UnreadNotifications int
+	// CSRFToken has to be sent with every request that isn't a GET. Pages
+	// include it for lib.js to send.
+	CSRFToken string
 }
 
 // newHeaderData is a constructor for the HeaderData type.
 func (s *Server) newHeaderData(title string, r *http.Request) (HeaderData, error) {
 	// We'll grab the categories from the DB
-	q := `SELECT category_id, title, description, author_id, created_at FROM categories`
+	q := `SELECT category_id, title, description, author_id, min_thread_role, min_comment_role, created_at FROM categories`
 	categories, err := pg.QueryRowsToStruct[Category](r.Context(), s.dbClient, q)
 	if err != nil {
 		return HeaderData{}, err
 	}
 
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	unread, err := s.unreadNotifications(r.Context(), userID)
+	if err != nil {
+		return HeaderData{}, err
+	}
+
+	role := r.Context().Value(middleware.CtxRoleKey).(middleware.Role)
 	return HeaderData{
-		HTMLTitle:  title,
-		UserID:     r.Context().Value(middleware.CtxUserKey).(int),
-		Categories: categories,
+		HTMLTitle:           title,
+		UserID:              userID,
+		IsAdmin:             r.Context().Value(middleware.CtxAdminKey).(bool),
+		Role:                role,
+		CanPost:             role.Can(middleware.PermPost),
+		CanModerate:         role.Can(middleware.PermModerate),
+		Categories:          categories,
+		CSRFToken:           middleware.CSRFToken(r),
+		UnreadNotifications: unread,
 	}, nil
 }
 
+// publicHeaderData returns the HeaderData for pages that don't require the
+// user to be logged in.
+func publicHeaderData(title string, r *http.Request) HeaderData {
+	return HeaderData{HTMLTitle: title, CSRFToken: middleware.CSRFToken(r)}
+}
+
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	err := s.serveHTML(r.Context(), w, "login", nil)
+	data := struct {
+		HeaderData HeaderData
+		// OIDCName is the name of the identity provider users can log in
+		// with, or empty if there isn't one.
+		OIDCName string
+	}{
+		HeaderData: publicHeaderData("Login", r),
+		OIDCName:   s.oidcName,
+	}
+	err := s.serveHTML(r.Context(), w, "login", data)
 	return err
 }
 
 // This route is just a box to enter a regkey. It redirects to the route
 // below when you submit.
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) error {
-	err := s.serveHTML(r.Context(), w, "register", nil)
+	data := struct {
+		HeaderData HeaderData
+	}{
+		HeaderData: publicHeaderData("Register", r),
+	}
+	err := s.serveHTML(r.Context(), w, "register", data)
 	return err
 }
 
@@ -64,15 +109,16 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) error {
 func (s *Server) handleRegisterKey(w http.ResponseWriter, r *http.Request) error {
 	regKey := r.PathValue("regkey")
 
-	const checkRegQuery = "SELECT EXISTS(SELECT 1 FROM registration_keys WHERE reg_key = $1 AND used = false)"
 	var regKeyExists bool
-	row, err := s.dbClient.QueryRow(r.Context(), checkRegQuery, regKey)
+	row, err := s.dbClient.QueryRow(r.Context(), checkRegKeyQuery, regKey)
 	if err != nil {
 		return err
 	}
-	row.Scan(&regKeyExists)
+	if err := row.Scan(&regKeyExists); err != nil {
+		return err
+	}
 	if !regKeyExists {
-		return fmt.Errorf("invalid registration key")
+		return derror.Forbidden(errors.New("invalid registration key"))
 	}
 
 	// This is a little bit hacky, but it makes managing profile pics
@@ -90,16 +136,54 @@ func (s *Server) handleRegisterKey(w http.ResponseWriter, r *http.Request) error
 		HeaderData    HeaderData
 		AvatarNumbers []string
 		RegKey        string
+		OIDCName      string
 	}{
-		HeaderData:    HeaderData{HTMLTitle: "Register"},
+		HeaderData:    publicHeaderData("Register", r),
 		AvatarNumbers: avatarNumbers,
 		RegKey:        regKey,
+		OIDCName:      s.oidcName,
 	}
 
 	err = s.serveHTML(r.Context(), w, "register_key", data)
 	return err
 }
 
+// handleForgotPassword serves the form for requesting a password reset email.
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	data := struct {
+		HeaderData HeaderData
+	}{
+		HeaderData: publicHeaderData("Forgot Password", r),
+	}
+	return s.serveHTML(r.Context(), w, "forgot_password", data)
+}
+
+// handleResetPassword serves the form for choosing a new password, which is
+// linked to from password reset emails.
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	data := struct {
+		HeaderData HeaderData
+		Token      string
+	}{
+		HeaderData: publicHeaderData("Reset Password", r),
+		Token:      r.URL.Query().Get("token"),
+	}
+	return s.serveHTML(r.Context(), w, "reset_password", data)
+}
+
+// handleConfirmEmail serves the page linked to from email confirmation emails,
+// which confirms the new address.
+func (s *Server) handleConfirmEmail(w http.ResponseWriter, r *http.Request) error {
+	data := struct {
+		HeaderData HeaderData
+		Token      string
+	}{
+		HeaderData: publicHeaderData("Confirm Email", r),
+		Token:      r.URL.Query().Get("token"),
+	}
+	return s.serveHTML(r.Context(), w, "confirm_email", data)
+}
+
 func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) error {
 	// Handle paging
 	var page middleware.Page
@@ -107,7 +191,7 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) error {
 	offset := strconv.Itoa(page.Size * (page.Number - 1))
 	size := strconv.Itoa(page.Size)
 
-	q := `SELECT COUNT(*) FROM threads`
+	q := `SELECT COUNT(*) FROM threads WHERE deleted_at IS NULL`
 	var threadCount int
 	row, err := s.dbClient.QueryRow(r.Context(), q)
 	if err != nil {
@@ -143,13 +227,14 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) error {
 			threads.author_id,
 			threads.pinned,
 			users.username,
-			(SELECT COUNT(*) FROM comments WHERE comments.thread_id = threads.thread_id) AS reply_count,
-			COALESCE((SELECT comments.body FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), 'No comments yet!') AS latest_comment,
-			COALESCE((SELECT comments.comment_id FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), 0) AS latest_comment_id,
-			COALESCE((SELECT comments.created_at FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), threads.created_at) AS latest_ts
+			(SELECT COUNT(*) FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL) AS reply_count,
+			COALESCE((SELECT comments.body FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), 'No comments yet!') AS latest_comment,
+			COALESCE((SELECT comments.comment_id FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), 0) AS latest_comment_id,
+			COALESCE((SELECT comments.created_at FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), threads.created_at) AS latest_ts
 		FROM threads
 		JOIN users ON threads.author_id = users.id
 		LEFT JOIN comments ON threads.thread_id = comments.thread_id
+		WHERE threads.deleted_at IS NULL
 		GROUP BY threads.thread_id, comments.created_at, users.username
 		ORDER BY threads.thread_id DESC)
 	ORDER BY latest_ts DESC
@@ -168,14 +253,14 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) error {
 		threads.author_id,
 		threads.pinned,
 		users.username,
-		(SELECT COUNT(*) FROM comments WHERE comments.thread_id = threads.thread_id) AS reply_count,
-		COALESCE((SELECT comments.body FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), 'No comments yet!') AS latest_comment,
-		COALESCE((SELECT comments.comment_id FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), 0) AS latest_comment_id,
-		COALESCE((SELECT comments.created_at FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), threads.created_at) AS latest_ts
+		(SELECT COUNT(*) FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL) AS reply_count,
+		COALESCE((SELECT comments.body FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), 'No comments yet!') AS latest_comment,
+		COALESCE((SELECT comments.comment_id FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), 0) AS latest_comment_id,
+		COALESCE((SELECT comments.created_at FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), threads.created_at) AS latest_ts
 	FROM threads
 	JOIN users ON threads.author_id = users.id
 	LEFT JOIN comments ON threads.thread_id = comments.thread_id
-	WHERE threads.pinned = true
+	WHERE threads.pinned = true AND threads.deleted_at IS NULL
 	GROUP BY threads.thread_id, comments.created_at, users.username
 	ORDER BY threads.thread_id DESC`
 
@@ -217,10 +302,10 @@ func (s *Server) handleCategory(w http.ResponseWriter, r *http.Request) error {
 
 	catID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		return err
+		return derror.BadRequest(err)
 	}
 
-	q := `SELECT COUNT(*) FROM threads WHERE category_id = $1`
+	q := `SELECT COUNT(*) FROM threads WHERE category_id = $1 AND deleted_at IS NULL`
 	var threadCount int
 	row, err := s.dbClient.QueryRow(r.Context(), q, catID)
 	if err != nil {
@@ -254,14 +339,14 @@ func (s *Server) handleCategory(w http.ResponseWriter, r *http.Request) error {
 			threads.title,
 			threads.author_id,
 			users.username,
-			(SELECT COUNT(*) FROM comments WHERE comments.thread_id = threads.thread_id) AS reply_count,
-			COALESCE((SELECT comments.body FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), 'No comments yet!') AS latest_comment,
-			COALESCE((SELECT comments.comment_id FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), 0) AS latest_comment_id,
-			COALESCE((SELECT comments.created_at FROM comments WHERE comments.thread_id = threads.thread_id ORDER BY comments.created_at DESC LIMIT 1), threads.created_at) AS latest_ts
+			(SELECT COUNT(*) FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL) AS reply_count,
+			COALESCE((SELECT comments.body FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), 'No comments yet!') AS latest_comment,
+			COALESCE((SELECT comments.comment_id FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), 0) AS latest_comment_id,
+			COALESCE((SELECT comments.created_at FROM comments WHERE comments.thread_id = threads.thread_id AND comments.deleted_at IS NULL ORDER BY comments.created_at DESC LIMIT 1), threads.created_at) AS latest_ts
 		FROM threads
 		JOIN users ON threads.author_id = users.id
 		LEFT JOIN comments ON threads.thread_id = comments.thread_id
-		WHERE threads.category_id = $1
+		WHERE threads.category_id = $1 AND threads.deleted_at IS NULL
 		GROUP BY threads.thread_id, comments.created_at, users.username
 		ORDER BY threads.thread_id DESC)
 	ORDER BY latest_ts DESC
@@ -319,46 +404,61 @@ func (s *Server) handleThread(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	type threadData struct {
-		Title         string    `db:"title"`
-		ThreadID      int       `db:"thread_id"`
-		Body          string    `db:"body"`
-		AuthorID      int       `db:"author_id"`
-		Avatar        int       `db:"avatar"`
-		AvatarStr     string    `db:"-"`
-		Username      string    `db:"username"`
-		CategoryID    int       `db:"category_id"`
-		CategoryTitle string    `db:"category_title"`
-		CreatedAt     time.Time `db:"created_at"`
+		Title          string          `db:"title"`
+		ThreadID       int             `db:"thread_id"`
+		Body           string          `db:"body"`
+		Mentions       map[string]int  `db:"mentions"`
+		AuthorID       int             `db:"author_id"`
+		Avatar         int             `db:"avatar"`
+		AvatarStr      string          `db:"-"`
+		Username       string          `db:"username"`
+		CategoryID     int             `db:"category_id"`
+		CategoryTitle  string          `db:"category_title"`
+		Pinned         bool            `db:"pinned"`
+		Locked         bool            `db:"locked"`
+		MinCommentRole middleware.Role `db:"min_comment_role"`
+		CreatedAt      time.Time       `db:"created_at"`
+		EditedAt       *time.Time      `db:"edited_at"`
 	}
 
 	q = `
 	SELECT 
-		threads.title, threads.thread_id, threads.body, threads.author_id, users.avatar, users.username, threads.category_id, categories.title AS category_title, threads.created_at 
+		threads.title, threads.thread_id, threads.body,
+		(SELECT jsonb_object_agg(username, user_id) FROM mentions WHERE mentions.thread_id = threads.thread_id) AS mentions,
+		threads.author_id, users.avatar, users.username, threads.category_id, categories.title AS category_title, threads.pinned, threads.locked, categories.min_comment_role, threads.created_at, threads.edited_at
 	FROM threads 
 	JOIN users ON threads.author_id = users.id
 	JOIN categories ON threads.category_id = categories.category_id
-	WHERE thread_id = $1`
+	WHERE thread_id = $1 AND threads.deleted_at IS NULL`
 	thread, err := pg.QueryRowToStruct[threadData](r.Context(), s.dbClient, q, threadID)
-	if err != nil {
+	if errors.Is(err, pg.ErrNoRows) {
+		return derror.NotFound(fmt.Errorf("thread %s not found", threadID))
+	} else if err != nil {
 		return err
 	}
 	thread.AvatarStr = fmt.Sprintf("%03d", thread.Avatar)
 
 	type commentView struct {
-		AuthorID            int       `db:"author_id"`
-		Avatar              int       `db:"avatar"`
-		AvatarStr           string    `db:"-"`
-		Username            string    `db:"username"`
-		CommentID           int       `db:"comment_id"`
-		ReplyID             int       `db:"reply_id"`
-		ReplyPage           int       `db:"reply_page"`
-		ReplyBody           string    `db:"reply_body"`
-		ReplyAuthorUsername string    `db:"reply_author_username"`
-		ReplyAuthorID       int       `db:"reply_author_id"`
-		Body                string    `db:"body"`
-		CreatedAt           time.Time `db:"created_at"`
-	}
-
+		AuthorID            int            `db:"author_id"`
+		Avatar              int            `db:"avatar"`
+		AvatarStr           string         `db:"-"`
+		Username            string         `db:"username"`
+		CommentID           int            `db:"comment_id"`
+		ReplyID             int            `db:"reply_id"`
+		ReplyPage           int            `db:"reply_page"`
+		ReplyBody           string         `db:"reply_body"`
+		ReplyMentions       map[string]int `db:"reply_mentions"`
+		ReplyAuthorUsername string         `db:"reply_author_username"`
+		ReplyAuthorID       int            `db:"reply_author_id"`
+		Body                string         `db:"body"`
+		Mentions            map[string]int `db:"mentions"`
+		Deleted             bool           `db:"deleted"`
+		CreatedAt           time.Time      `db:"created_at"`
+		EditedAt            *time.Time     `db:"edited_at"`
+	}
+
+	// Deleted comments are still returned (without their body) so that the
+	// paging and replies to them stay the same.
 	q = `
 	SELECT
 		c1.author_id, 
@@ -366,12 +466,16 @@ func (s *Server) handleThread(w http.ResponseWriter, r *http.Request) error {
 		users.username, 
 		c1.comment_id,
 		c1.reply_id,
-		c1.body,
+		CASE WHEN c1.deleted_at IS NULL THEN c1.body ELSE '' END AS body,
+		(SELECT jsonb_object_agg(username, user_id) FROM mentions WHERE mentions.comment_id = c1.comment_id) AS mentions,
+		c1.deleted_at IS NOT NULL AS deleted,
 		COALESCE((SELECT ind FROM (SELECT c1.comment_id, ROW_NUMBER() OVER (ORDER BY c1.created_at ASC) AS ind) WHERE c1.reply_id = c2.comment_id) / $3 + 1, -1) AS reply_page,
-		COALESCE((SELECT body FROM comments WHERE comments.comment_id = c1.reply_id ), '') AS reply_body,
+		COALESCE((SELECT CASE WHEN deleted_at IS NULL THEN body ELSE '_This comment has been deleted._' END FROM comments WHERE comments.comment_id = c1.reply_id ), '') AS reply_body,
+		(SELECT jsonb_object_agg(username, user_id) FROM mentions WHERE mentions.comment_id = c1.reply_id) AS reply_mentions,
 		COALESCE((SELECT username FROM users WHERE id = c2.author_id ), '') AS reply_author_username,
 		COALESCE((SELECT id FROM users WHERE id = c2.author_id ), -1) AS reply_author_id,
-		c1.created_at
+		c1.created_at,
+		c1.edited_at
 	FROM comments AS c1
 	JOIN users ON c1.author_id = users.id
 	LEFT JOIN comments AS c2 ON c1.reply_id = c2.comment_id
@@ -397,10 +501,12 @@ func (s *Server) handleThread(w http.ResponseWriter, r *http.Request) error {
 		CommentViews []commentView
 		HeaderData   HeaderData
 		PageData     PageData
+		CanComment   bool
 	}{
 		ThreadData:   thread,
 		CommentViews: commentViews,
 		HeaderData:   headerData,
+		CanComment:   canComment(headerData.Role, thread.MinCommentRole, thread.Locked),
 		PageData: PageData{
 			PageNumber: page.Number,
 			PageSize:   page.Size,
@@ -415,11 +521,19 @@ func (s *Server) handleThread(w http.ResponseWriter, r *http.Request) error {
 func (s *Server) handleNewThread(w http.ResponseWriter, r *http.Request) error {
 	// I think it's simpler to just make entire Category structs as opposed to
 	// defining a custom struct with just id and title to hold the data we need.
-	q := `SELECT category_id, title, description, author_id, created_at FROM categories`
-	categoryData, err := pg.QueryRowsToStruct[Category](r.Context(), s.dbClient, q)
+	q := `SELECT category_id, title, description, author_id, min_thread_role, min_comment_role, created_at FROM categories`
+	categories, err := pg.QueryRowsToStruct[Category](r.Context(), s.dbClient, q)
 	if err != nil {
 		return err
 	}
+	// Only the categories the user is allowed to create threads in are listed.
+	role := r.Context().Value(middleware.CtxRoleKey).(middleware.Role)
+	var categoryData []Category
+	for _, c := range categories {
+		if role.AtLeast(c.MinThreadRole) {
+			categoryData = append(categoryData, c)
+		}
+	}
 
 	headerData, err := s.newHeaderData("new thread", r)
 	if err != nil {
@@ -439,14 +553,14 @@ func (s *Server) handleNewThread(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) error {
-	q := `SELECT id, username, bio, avatar, created_at, is_admin FROM users WHERE id = $1`
+	q := `SELECT id, username, bio, avatar, created_at, is_admin, role FROM users WHERE id = $1`
 	var user User
 	var isAdmin bool
 	row, err := s.dbClient.QueryRow(r.Context(), q, r.PathValue("id"))
 	if err != nil {
 		return err
 	}
-	row.Scan(&user.ID, &user.Username, &user.Bio, &user.Avatar, &user.CreatedAt, &isAdmin)
+	row.Scan(&user.ID, &user.Username, &user.Bio, &user.Avatar, &user.CreatedAt, &isAdmin, &user.Role)
 	if user.Username == "" {
 		return fmt.Errorf("user with id %q not found", r.PathValue("id"))
 	}
@@ -458,22 +572,31 @@ func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) error {
 
 	// Passing the avatar id as a string with two leading zeros for use in the template.
 	// This will likely need to be changed when we update to better profile pics.
+	isSelf := r.Context().Value(middleware.CtxUserKey).(int) == user.ID
 	data := struct {
-		Username       string
-		Bio            string
-		Avatar         string
-		IsAdmin        bool
-		CreatedAt      time.Time
-		HeaderData     HeaderData
-		ShowEditButton bool
+		UserID            int
+		Username          string
+		Bio               string
+		Avatar            string
+		IsAdmin           bool
+		Role              string
+		Roles             []middleware.Role
+		CreatedAt         time.Time
+		HeaderData        HeaderData
+		ShowEditButton    bool
+		ShowAdminControls bool
 	}{
-		HeaderData:     headerData,
-		Username:       user.Username,
-		Bio:            user.Bio,
-		Avatar:         fmt.Sprintf("%03d", user.Avatar),
-		IsAdmin:        isAdmin,
-		CreatedAt:      user.CreatedAt,
-		ShowEditButton: r.Context().Value(middleware.CtxUserKey).(int) == user.ID,
+		HeaderData:        headerData,
+		UserID:            user.ID,
+		Username:          user.Username,
+		Bio:               user.Bio,
+		Avatar:            fmt.Sprintf("%03d", user.Avatar),
+		IsAdmin:           isAdmin,
+		Role:              user.Role,
+		Roles:             []middleware.Role{middleware.RoleAdmin, middleware.RoleModerator, middleware.RoleMember, middleware.RoleReadOnly},
+		CreatedAt:         user.CreatedAt,
+		ShowEditButton:    isSelf,
+		ShowAdminControls: headerData.IsAdmin && !isSelf,
 	}
 	err = s.serveHTML(r.Context(), w, "users", data)
 	return err
@@ -481,14 +604,14 @@ func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) error {
 
 func (s *Server) handleUsersEdit(w http.ResponseWriter, r *http.Request) error {
 	// Query user info for the logged in user.
-	q := `SELECT id, username, bio, avatar, created_at, is_admin FROM users WHERE id = $1`
+	q := `SELECT id, username, email, bio, avatar, created_at, is_admin, totp_enabled_at IS NOT NULL FROM users WHERE id = $1`
 	var user User
-	var isAdmin bool
+	var isAdmin, twoFactor bool
 	row, err := s.dbClient.QueryRow(r.Context(), q, r.Context().Value(middleware.CtxUserKey).(int))
 	if err != nil {
 		return err
 	}
-	row.Scan(&user.ID, &user.Username, &user.Bio, &user.Avatar, &user.CreatedAt, &isAdmin)
+	row.Scan(&user.ID, &user.Username, &user.Email, &user.Bio, &user.Avatar, &user.CreatedAt, &isAdmin, &twoFactor)
 	if user.Username == "" {
 		return fmt.Errorf("user with id %q not found", r.PathValue("id"))
 	}
@@ -504,28 +627,206 @@ func (s *Server) handleUsersEdit(w http.ResponseWriter, r *http.Request) error {
 		avatarNumbers[i] = fmt.Sprintf("%03d", i)
 	}
 
+	// The user's active sessions are listed so they can log out of them.
+	sessions, err := pg.QueryRowsToStruct[Session](r.Context(), s.dbClient, activeSessionsQuery, user.ID, r.Context().Value(middleware.CtxSessionKey))
+	if err != nil {
+		return err
+	}
+
+	apiTokens, err := pg.QueryRowsToStruct[APIToken](r.Context(), s.dbClient, apiTokensQuery, user.ID)
+	if err != nil {
+		return err
+	}
+	identities, err := pg.QueryRowsToStruct[UserIdentity](r.Context(), s.dbClient, identitiesQuery, user.ID)
+	if err != nil {
+		return err
+	}
+
 	headerData, err := s.newHeaderData(user.Username, r)
 	if err != nil {
 		return err
 	}
+	adminTwoFactor, err := requireAdminTwoFactor(r.Context(), s.dbClient)
+	if err != nil {
+		return err
+	}
 
 	data := struct {
+		Username              string
+		Email                 string
+		Bio                   string
+		Avatar                string
+		IsAdmin               bool
+		TwoFactorEnabled      bool
+		RequireAdminTwoFactor bool
+		CreatedAt             time.Time
+		HeaderData            HeaderData
+		AvatarNumbers         []string
+		Sessions              []Session
+		APITokens             []APIToken
+		OIDCName              string
+		Identities            []UserIdentity
+	}{
+		HeaderData:            headerData,
+		Username:              user.Username,
+		Email:                 user.Email,
+		Bio:                   user.Bio,
+		Avatar:                fmt.Sprintf("%03d", user.Avatar),
+		IsAdmin:               isAdmin,
+		TwoFactorEnabled:      twoFactor,
+		RequireAdminTwoFactor: adminTwoFactor,
+		CreatedAt:             user.CreatedAt,
+		AvatarNumbers:         avatarNumbers,
+		Sessions:              sessions,
+		APITokens:             apiTokens,
+		OIDCName:              s.oidcName,
+		Identities:            identities,
+	}
+	err = s.serveHTML(r.Context(), w, "edit_profile", data)
+	return err
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) error {
+	page := r.Context().Value(middleware.CtxPageKey).(middleware.Page)
+	params, err := parseSearchParams(r)
+	if err != nil {
+		return err
+	}
+	results, total, err := s.search(r.Context(), params, page)
+	if err != nil {
+		return err
+	}
+	pages := make([]int, int(math.Ceil(float64(total)/float64(page.Size))))
+	for i := range pages {
+		pages[i] = i + 1
+	}
+
+	headerData, err := s.newHeaderData("search", r)
+	if err != nil {
+		return err
+	}
+
+	// The filters are passed back to the template as strings so the form
+	// and the paginator links keep whatever the user searched for.
+	q := r.URL.Query()
+	data := struct {
+		HeaderData HeaderData
+		PageData   PageData
+		Results    []SearchResult
+		Total      int
+		Query      string
+		CategoryID string
+		Author     string
+		From       string
+		To         string
+	}{
+		HeaderData: headerData,
+		PageData: PageData{
+			PageNumber: page.Number,
+			PageSize:   page.Size,
+			Pages:      pages,
+		},
+		Results:    results,
+		Total:      total,
+		Query:      params.Query,
+		CategoryID: q.Get("category_id"),
+		Author:     q.Get("author"),
+		From:       q.Get("from"),
+		To:         q.Get("to"),
+	}
+
+	err = s.serveHTML(r.Context(), w, "search", data)
+	return err
+}
+
+func (s *Server) handleRegistrationKeys(w http.ResponseWriter, r *http.Request) error {
+	keys, err := listRegistrationKeys(r.Context(), s.dbClient)
+	if err != nil {
+		return err
+	}
+	headerData, err := s.newHeaderData("registration keys", r)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		HeaderData       HeaderData
+		RegistrationKeys []RegistrationKey
+		MaxMinted        int
+	}{
+		HeaderData:       headerData,
+		RegistrationKeys: keys,
+		MaxMinted:        maxMintedRegKeys,
+	}
+	err = s.serveHTML(r.Context(), w, "registration_keys", data)
+	return err
+}
+
+func (s *Server) handleLoginAttempts(w http.ResponseWriter, r *http.Request) error {
+	page := r.Context().Value(middleware.CtxPageKey).(middleware.Page)
+	filter := parseLoginAttemptsFilter(r)
+	attempts, err := s.listLoginAttempts(r.Context(), filter, page)
+	if err != nil {
+		return err
+	}
+	headerData, err := s.newHeaderData("login attempts", r)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		HeaderData    HeaderData
+		LoginAttempts []LoginAttempt
 		Username      string
-		Bio           string
-		Avatar        string
-		IsAdmin       bool
-		CreatedAt     time.Time
+		IPAddress     string
+		FailedOnly    bool
+		PageSize      int
+		PrevPage      int
+		NextPage      int
+	}{
+		HeaderData:    headerData,
+		LoginAttempts: attempts,
+		Username:      r.URL.Query().Get("username"),
+		IPAddress:     r.URL.Query().Get("ip"),
+		FailedOnly:    filter.FailedOnly,
+		PageSize:      page.Size,
+		PrevPage:      page.Number - 1,
+	}
+	// The audit trail can be long so it isn't counted, there's just a link
+	// to the next page whenever this one is full.
+	if len(attempts) == page.Size {
+		data.NextPage = page.Number + 1
+	}
+	err = s.serveHTML(r.Context(), w, "login_attempts", data)
+	return err
+}
+
+// handleNotifications serves the user's notifications, newest first.
+func (s *Server) handleNotifications(w http.ResponseWriter, r *http.Request) error {
+	page := r.Context().Value(middleware.CtxPageKey).(middleware.Page)
+	userID := r.Context().Value(middleware.CtxUserKey).(int)
+	notifications, err := s.listNotifications(r.Context(), userID, false, page)
+	if err != nil {
+		return err
+	}
+	headerData, err := s.newHeaderData("notifications", r)
+	if err != nil {
+		return err
+	}
+	data := struct {
 		HeaderData    HeaderData
-		AvatarNumbers []string
+		Notifications []Notification
+		PageSize      int
+		PrevPage      int
+		NextPage      int
 	}{
 		HeaderData:    headerData,
-		Username:      user.Username,
-		Bio:           user.Bio,
-		Avatar:        fmt.Sprintf("%03d", user.Avatar),
-		IsAdmin:       isAdmin,
-		CreatedAt:     user.CreatedAt,
-		AvatarNumbers: avatarNumbers,
+		Notifications: notifications,
+		PageSize:      page.Size,
+		PrevPage:      page.Number - 1,
 	}
-	err = s.serveHTML(r.Context(), w, "edit_profile", data)
-	return err
+	// Like the login audit trail, notifications aren't counted, there's just
+	// a link to the next page whenever this one is full.
+	if len(notifications) == page.Size {
+		data.NextPage = page.Number + 1
+	}
+	return s.serveHTML(r.Context(), w, "notifications", data)
 }
@@ -5,13 +5,17 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/safehtml"
 	"github.com/google/safehtml/template"
 	"github.com/google/safehtml/uncheckedconversions"
+	"github.com/jessesomerville/yodahunters/internal/server/middleware"
 	"rsc.io/markdown"
 )
 
@@ -22,7 +26,7 @@ type Renderer struct {
 
 // New returns a Renderer populated with the templates in the given filesystem.
 func New(fs template.TrustedFS) (*Renderer, error) {
-	pages := []string{"home", "login", "new_thread", "users", "edit_profile", "thread", "category", "register", "register_key"}
+	pages := []string{"home", "login", "new_thread", "users", "edit_profile", "thread", "category", "register", "register_key", "search", "registration_keys", "forgot_password", "reset_password", "confirm_email", "login_attempts", "error", "notifications"}
 
 	r := new(Renderer)
 	for _, page := range pages {
@@ -33,6 +37,7 @@ func New(fs template.TrustedFS) (*Renderer, error) {
 			"generateCommentID":         generateCommentID,
 			"generateLatestCommentLink": generateLatestCommentLink,
 			"renderMarkdown":            renderMarkdown,
+			"highlightSnippet":          HighlightSnippet,
 		}).ParseFS(fs, "*.tmpl")
 		if err != nil {
 			return nil, fmt.Errorf("ParseFS: %v", err)
@@ -73,7 +78,7 @@ func generateCommentID(i int) safehtml.Identifier {
 }
 
 func generateLatestCommentLink(threadID, replyCount, commentID int) string {
-	page := replyCount/20 + 1
+	page := replyCount/middleware.DefaultPageSize + 1
 	if commentID == 0 {
 		return fmt.Sprintf("/threads/%d", threadID)
 	}
@@ -85,9 +90,148 @@ var parser = markdown.Parser{
 	Table:        true,
 }
 
-// renderMarkdown renders any markdown present in the input as HTML.
-func renderMarkdown(contents string) safehtml.HTML {
+// renderMarkdown renders any markdown present in the input as HTML. The
+// @username mentions of the users in mentions, which maps their usernames to
+// their IDs, link to their profiles.
+func renderMarkdown(contents string, mentions map[string]int) safehtml.HTML {
 	sanitized := safehtml.HTMLEscaped(contents)
 	doc := parser.Parse(sanitized.String())
+	replaceMentions(doc.Blocks, func(username string) markdown.Inline {
+		id, ok := mentions[username]
+		if !ok {
+			return nil
+		}
+		// Usernames are only mentioned if they're made of characters that
+		// don't need escaping.
+		return markdown.Inlines{
+			&markdown.HTMLTag{Text: fmt.Sprintf(`<a class="mention" href="/users/%d">`, id)},
+			&markdown.Plain{Text: "@" + username},
+			&markdown.HTMLTag{Text: "</a>"},
+		}
+	})
 	return uncheckedconversions.HTMLFromStringKnownToSatisfyTypeContract(markdown.ToHTML(doc))
 }
+
+// Mentions returns up to limit of the usernames mentioned with @username in
+// the markdown, in the order they're first mentioned. Mentions in code and in
+// the text of links don't count.
+func Mentions(contents string, limit int) []string {
+	var usernames []string
+	doc := parser.Parse(safehtml.HTMLEscaped(contents).String())
+	replaceMentions(doc.Blocks, func(username string) markdown.Inline {
+		if len(usernames) < limit && !slices.Contains(usernames, username) {
+			usernames = append(usernames, username)
+		}
+		return nil
+	})
+	return usernames
+}
+
+// mentionRegexp matches an @username that isn't part of a word or an email
+// address.
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\w@.])@([\w.-]+)`)
+
+// replaceMentions calls replace with the username of each mention in the
+// text of the blocks, replacing the mention with what it returns unless
+// that's nil.
+func replaceMentions(blocks []markdown.Block, replace func(username string) markdown.Inline) {
+	for _, b := range blocks {
+		switch b := b.(type) {
+		case *markdown.Paragraph:
+			replaceMentions([]markdown.Block{b.Text}, replace)
+		case *markdown.Heading:
+			replaceMentions([]markdown.Block{b.Text}, replace)
+		case *markdown.Text:
+			b.Inline = replaceInlineMentions(b.Inline, replace)
+		case *markdown.Quote:
+			replaceMentions(b.Blocks, replace)
+		case *markdown.List:
+			replaceMentions(b.Items, replace)
+		case *markdown.Item:
+			replaceMentions(b.Blocks, replace)
+		case *markdown.Table:
+			for _, cell := range b.Header {
+				replaceMentions([]markdown.Block{cell}, replace)
+			}
+			for _, row := range b.Rows {
+				for _, cell := range row {
+					replaceMentions([]markdown.Block{cell}, replace)
+				}
+			}
+		}
+		// Code blocks and HTML are left alone.
+	}
+}
+
+func replaceInlineMentions(inlines markdown.Inlines, replace func(username string) markdown.Inline) markdown.Inlines {
+	var out markdown.Inlines
+	var text strings.Builder
+	// The parser can split plain text into several pieces, so consecutive
+	// pieces are joined before looking for mentions in them.
+	flush := func() {
+		if text.Len() > 0 {
+			out = append(out, replaceTextMentions(text.String(), replace)...)
+			text.Reset()
+		}
+	}
+	for _, in := range inlines {
+		switch in := in.(type) {
+		case *markdown.Plain:
+			text.WriteString(in.Text)
+			continue
+		case *markdown.Strong:
+			in.Inner = replaceInlineMentions(in.Inner, replace)
+		case *markdown.Emph:
+			in.Inner = replaceInlineMentions(in.Inner, replace)
+		case *markdown.Del:
+			in.Inner = replaceInlineMentions(in.Inner, replace)
+		}
+		// Code spans, links and escaped characters (so that \@username isn't
+		// a mention) are left alone.
+		flush()
+		out = append(out, in)
+	}
+	flush()
+	return out
+}
+
+func replaceTextMentions(text string, replace func(username string) markdown.Inline) markdown.Inlines {
+	var out markdown.Inlines
+	last := 0
+	for _, m := range mentionRegexp.FindAllStringSubmatchIndex(text, -1) {
+		// A mention at the end of a sentence is followed by a period.
+		start, end := m[2]-1, m[2]+len(strings.TrimRight(text[m[2]:m[3]], "."))
+		if end == m[2] {
+			continue
+		}
+		in := replace(text[m[2]:end])
+		if in == nil {
+			continue
+		}
+		if start > last {
+			out = append(out, &markdown.Plain{Text: text[last:start]})
+		}
+		out = append(out, in)
+		last = end
+	}
+	if last < len(text) {
+		out = append(out, &markdown.Plain{Text: text[last:]})
+	}
+	return out
+}
+
+// Search snippets have the matched terms wrapped in these markers, rather than
+// HTML tags, so that the snippet can be escaped before it is highlighted.
+const (
+	HighlightStart = "\uE000"
+	HighlightStop  = "\uE001"
+)
+
+var highlighter = strings.NewReplacer(HighlightStart, "<mark>", HighlightStop, "</mark>")
+
+// HighlightSnippet escapes a search snippet and replaces the highlight
+// markers with <mark> elements.
+func HighlightSnippet(snippet string) safehtml.HTML {
+	escaped := safehtml.HTMLEscaped(snippet)
+	return uncheckedconversions.HTMLFromStringKnownToSatisfyTypeContract(highlighter.Replace(escaped.String()))
+}
@@ -0,0 +1,94 @@
+package templates
+
+import (
+	"reflect"
+	"testing"
+
+	"rsc.io/markdown"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		limit    int
+		want     []string
+	}{
+		{name: "none", contents: "no mentions here", want: nil},
+		{name: "one", contents: "hi @luke", want: []string{"luke"}},
+		{name: "start of line", contents: "@luke hi", want: []string{"luke"}},
+		{name: "trailing period", contents: "thanks @luke.", want: []string{"luke"}},
+		{name: "dots in username", contents: "ask @han.solo...", want: []string{"han.solo"}},
+		{name: "punctuation", contents: "(@luke), '@han'!", want: []string{"luke", "han"}},
+		{name: "underscores and dashes", contents: "@luke_s and @han-solo", want: []string{"luke_s", "han-solo"}},
+		{name: "order and duplicates", contents: "@han @luke @han", want: []string{"han", "luke"}},
+		{name: "email", contents: "mail luke@example.com or a@b.c", want: nil},
+		{name: "double at", contents: "@@luke", want: nil},
+		{name: "only an at", contents: "@ luke", want: nil},
+		{name: "escaped", contents: `\@luke`, want: nil},
+		{name: "code span", contents: "run `@luke` now", want: nil},
+		{name: "indented code block", contents: "code:\n\n    @luke\n", want: nil},
+		{name: "fenced code block", contents: "```\n@luke\n```\n", want: nil},
+		{name: "link text", contents: "[@luke](https://example.com)", want: nil},
+		{name: "emphasis", contents: "*@luke* and **@han** and ~~@leia~~", want: []string{"luke", "han", "leia"}},
+		{name: "after a line break", contents: "hi\n@luke", want: []string{"luke"}},
+		{name: "quote", contents: "> @luke", want: []string{"luke"}},
+		{name: "list", contents: "- @luke\n- @han\n", want: []string{"luke", "han"}},
+		{name: "heading", contents: "# @luke", want: []string{"luke"}},
+		{name: "table", contents: "| a |\n|---|\n| @luke |\n", want: []string{"luke"}},
+		{name: "limit", contents: "@a @b @c @d", limit: 2, want: []string{"a", "b"}},
+		{name: "limit counts distinct", contents: "@a @a @b @c", limit: 2, want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := tt.limit
+			if limit == 0 {
+				limit = 10
+			}
+			if got := Mentions(tt.contents, limit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Mentions(%q, %d) = %q, want %q", tt.contents, limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdown_Mentions(t *testing.T) {
+	mentions := map[string]int{"luke": 1, "han.solo": 2}
+	tests := []struct {
+		contents string
+		want     string
+	}{
+		{"hi @luke.", `<p>hi <a class="mention" href="/users/1">@luke</a>.</p>` + "\n"},
+		{"@han.solo and @luke", `<p><a class="mention" href="/users/2">@han.solo</a> and <a class="mention" href="/users/1">@luke</a></p>` + "\n"},
+		// Mentions of users who weren't mentioned when the post was saved
+		// aren't linked.
+		{"hi @leia", "<p>hi @leia</p>\n"},
+		{"`@luke`", "<p><code>@luke</code></p>\n"},
+		{"luke@example.com", `<p><a href="mailto:luke@example.com">luke@example.com</a></p>` + "\n"},
+		{"<b>@luke</b>", `<p>&lt;b&gt;<a class="mention" href="/users/1">@luke</a>&lt;/b&gt;</p>` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.contents, mentions).String(); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.contents, got, tt.want)
+		}
+	}
+}
+
+// The parser can leave plain text in more than one piece, so a mention can be
+// split between them.
+func TestReplaceInlineMentions_SplitText(t *testing.T) {
+	inlines := markdown.Inlines{
+		&markdown.Plain{Text: "hi @lu"},
+		&markdown.Plain{Text: "ke."},
+		&markdown.Code{Text: "@han"},
+		&markdown.Plain{Text: " @han"},
+	}
+	var got []string
+	replaceInlineMentions(inlines, func(username string) markdown.Inline {
+		got = append(got, username)
+		return nil
+	})
+	if want := []string{"luke", "han"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replaceInlineMentions() found %q, want %q", got, want)
+	}
+}
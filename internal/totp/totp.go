@@ -0,0 +1,95 @@
+// Package totp implements the time-based one-time passwords (RFC 6238) used
+// by authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// Digits is the number of digits in a code.
+	Digits = 6
+	// Period is how long each code is valid for.
+	Period = 30 * time.Second
+	// SecretSize is the size of generated secrets in bytes, as recommended
+	// for HMAC-SHA1 by RFC 4226.
+	SecretSize = 20
+)
+
+// encoding is the base32 encoding authenticator apps expect secrets in.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret.
+func NewSecret() []byte {
+	secret := make([]byte, SecretSize)
+	rand.Read(secret)
+	return secret
+}
+
+// EncodeSecret returns the secret in the base32 format used to enter it into
+// an authenticator app by hand.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for the time step.
+func Code(secret []byte, step int64) string {
+	// This is HOTP (RFC 4226) with the time step as the counter.
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	h := hmac.New(sha1.New, secret)
+	h.Write(counter[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	bin := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, bin%1_000_000)
+}
+
+// Validate checks the code against the time steps within skew steps of t, to
+// allow for clock drift and the time it takes to type the code. It returns
+// the step that matched so callers can reject codes that have already been
+// used.
+func Validate(secret []byte, code string, t time.Time, skew int) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for i := -int64(skew); i <= int64(skew); i++ {
+		if subtle.ConstantTimeCompare([]byte(Code(secret, now+i)), []byte(code)) == 1 {
+			return now + i, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// provisioning URI for the secret, which is
+// usually shown as a QR code for authenticator apps to scan.
+func URI(issuer, account string, secret []byte) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+		RawQuery: url.Values{
+			"secret":    {EncodeSecret(secret)},
+			"issuer":    {issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(Digits)},
+			"period":    {fmt.Sprint(int(Period / time.Second))},
+		}.Encode(),
+	}
+	return u.String()
+}
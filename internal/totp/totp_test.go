@@ -0,0 +1,78 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret used by the RFC 6238 test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// The test vectors from RFC 6238 appendix B, truncated to 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := Code(rfcSecret, Step(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("Code(secret, Step(%d)) = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current", code: Code(rfcSecret, step), wantStep: step, wantOK: true},
+		{name: "previous", code: Code(rfcSecret, step-1), wantStep: step - 1, wantOK: true},
+		{name: "next", code: Code(rfcSecret, step+1), wantStep: step + 1, wantOK: true},
+		{name: "too old", code: Code(rfcSecret, step-2), wantOK: false},
+		{name: "wrong", code: "000000", wantOK: false},
+		{name: "too short", code: "12345", wantOK: false},
+		{name: "empty", code: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := Validate(rfcSecret, tt.code, now, 1)
+			if gotOK != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("Validate(%q) = (%d, %t), want (%d, %t)", tt.code, gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("yodahunters", "yoda", rfcSecret)
+	want := "otpauth://totp/yodahunters:yoda?algorithm=SHA1&digits=6&issuer=yodahunters&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if got != want {
+		t.Errorf("URI() = %q, want %q", got, want)
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, b := NewSecret(), NewSecret()
+	if len(a) != SecretSize {
+		t.Errorf("len(NewSecret()) = %d, want %d", len(a), SecretSize)
+	}
+	if string(a) == string(b) {
+		t.Error("NewSecret() returned the same secret twice")
+	}
+	if enc := EncodeSecret(a); strings.Contains(enc, "=") {
+		t.Errorf("EncodeSecret() = %q, want no padding", enc)
+	}
+}
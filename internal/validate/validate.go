@@ -0,0 +1,140 @@
+// Package validate checks the requests sent to the API, reporting every
+// problem with a request's fields at once.
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+)
+
+// MaxBodySize is the largest request body DecodeJSON reads.
+const MaxBodySize = 1 << 20
+
+// A FieldError is a problem with one field of a request.
+type FieldError struct {
+	// Field is the field's JSON name.
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors are the problems with a request's fields. The zero value has no
+// problems, and problems are added with its methods.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Err returns the errors as an error, or nil if there aren't any.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Add records a problem with the field.
+func (e *Errors) Add(field, format string, args ...any) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check records a problem with the field unless ok is set.
+func (e *Errors) Check(ok bool, field, format string, args ...any) {
+	if !ok {
+		e.Add(field, format, args...)
+	}
+}
+
+// Required checks that the field isn't empty or only whitespace.
+func (e *Errors) Required(field, value string) {
+	e.Check(strings.TrimSpace(value) != "", field, "is required")
+}
+
+// MaxLength checks that the field is at most n characters long, like a
+// VARCHAR(n) column.
+func (e *Errors) MaxLength(field, value string, n int) {
+	e.Check(utf8.RuneCountInString(value) <= n, field, "must be at most %d characters", n)
+}
+
+// Range checks that the field is between min and max inclusive.
+func (e *Errors) Range(field string, value, min, max int) {
+	e.Check(value >= min && value <= max, field, "must be between %d and %d", min, max)
+}
+
+// A Validator is a request that checks its own fields. It returns Errors if
+// any of them are invalid.
+type Validator interface {
+	Validate() error
+}
+
+// DecodeJSON decodes the request's JSON body into v, then validates it if
+// it's a Validator. Bodies larger than MaxBodySize, with fields v doesn't
+// have or with anything after the JSON value are rejected.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	body := http.MaxBytesReader(w, r.Body, MaxBodySize)
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return derror.BadRequest(errors.New("request body must only contain a single JSON value"))
+	}
+
+	if val, ok := v.(Validator); ok {
+		return val.Validate()
+	}
+	return nil
+}
+
+// decodeError returns the error for a body that couldn't be decoded,
+// pointing at the field at fault where possible.
+func decodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &derror.ServerError{Status: http.StatusRequestEntityTooLarge, Err: fmt.Errorf("request body must be at most %d bytes", maxBytesErr.Limit)}
+	case errors.Is(err, io.EOF):
+		return derror.BadRequest(errors.New("request body is empty"))
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return derror.BadRequest(Errors{{Field: typeErr.Field, Message: "must be " + jsonType(typeErr.Type)}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json doesn't have an error type for unknown fields.
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return derror.BadRequest(Errors{{Field: field, Message: "is not a known field"}})
+	default:
+		return derror.BadRequest(fmt.Errorf("invalid JSON: %w", err))
+	}
+}
+
+// jsonType describes the JSON type t is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -0,0 +1,122 @@
+package validate
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jessesomerville/yodahunters/internal/derror"
+)
+
+type post struct {
+	Title string `json:"title"`
+	Count int    `json:"count"`
+}
+
+func (p post) Validate() error {
+	var errs Errors
+	errs.Required("title", p.Title)
+	errs.MaxLength("title", p.Title, 5)
+	errs.Range("count", p.Count, 0, 10)
+	return errs.Err()
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		want       post
+		wantStatus int
+		wantFields Errors
+	}{
+		{
+			name: "valid",
+			body: `{"title": "héllo", "count": 3}`,
+			want: post{Title: "héllo", Count: 3},
+		},
+		{
+			name:       "empty body",
+			body:       "",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed",
+			body:       `{"title": `,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "trailing data",
+			body:       `{"title": "hi"} {"title": "again"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown field",
+			body:       `{"title": "hi", "author_id": 1}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: Errors{{Field: "author_id", Message: "is not a known field"}},
+		},
+		{
+			name:       "wrong type",
+			body:       `{"title": "hi", "count": "3"}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: Errors{{Field: "count", Message: "must be a number"}},
+		},
+		{
+			name:       "too large",
+			body:       `{"title": "` + strings.Repeat("a", MaxBodySize) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "invalid fields",
+			body: `{"title": " ", "count": 11}`,
+			wantFields: Errors{
+				{Field: "title", Message: "is required"},
+				{Field: "count", Message: "must be between 0 and 10"},
+			},
+		},
+		{
+			name:       "too long",
+			body:       `{"title": "héllo!"}`,
+			wantFields: Errors{{Field: "title", Message: "must be at most 5 characters"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			var got post
+			err := DecodeJSON(httptest.NewRecorder(), r, &got)
+
+			status := 0
+			if serr, ok := errors.AsType[*derror.ServerError](err); ok {
+				status = serr.Status
+			}
+			if status != tt.wantStatus {
+				t.Errorf("DecodeJSON() = %v, want status %d", err, tt.wantStatus)
+			}
+			var fields Errors
+			errors.As(err, &fields)
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("DecodeJSON() field errors = %v, want %v", fields, tt.wantFields)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("DecodeJSON() decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorsErr(t *testing.T) {
+	var errs Errors
+	if err := errs.Err(); err != nil {
+		t.Errorf("Err() with no errors = %v, want nil", err)
+	}
+	errs.Check(false, "title", "is %s", "required")
+	errs.Check(true, "body", "is required")
+	if got, want := errs.Err().Error(), "title is required"; got != want {
+		t.Errorf("Err() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+-- add_full_text_search (2026-10-18)
+
+BEGIN;
+
+DROP INDEX IF EXISTS comments_search_idx;
+DROP INDEX IF EXISTS threads_search_idx;
+
+ALTER TABLE comments DROP COLUMN search_vector;
+ALTER TABLE threads DROP COLUMN search_vector;
+
+END;
@@ -0,0 +1,17 @@
+-- add_full_text_search (2026-10-18)
+
+BEGIN;
+
+ALTER TABLE threads ADD COLUMN search_vector tsvector
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(body, '')), 'B')
+	) STORED;
+
+ALTER TABLE comments ADD COLUMN search_vector tsvector
+	GENERATED ALWAYS AS (to_tsvector('english', coalesce(body, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS threads_search_idx ON threads USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS comments_search_idx ON comments USING GIN (search_vector);
+
+END;
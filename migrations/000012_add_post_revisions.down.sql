@@ -0,0 +1,15 @@
+-- add_post_revisions (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS post_revisions;
+
+ALTER TABLE comments
+DROP COLUMN edited_at,
+DROP COLUMN deleted_at;
+
+ALTER TABLE threads
+DROP COLUMN edited_at,
+DROP COLUMN deleted_at;
+
+END;
@@ -0,0 +1,29 @@
+-- add_post_revisions (2026-10-18)
+-- Threads and comments are soft deleted by setting deleted_at so that replies
+-- and revisions keep pointing at something. Each row in post_revisions holds
+-- the contents of a thread or comment before an edit was made by editor_id.
+BEGIN;
+
+ALTER TABLE threads
+ADD COLUMN edited_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+
+ALTER TABLE comments
+ADD COLUMN edited_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS post_revisions (
+	revision_id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+	thread_id INT REFERENCES threads(thread_id) ON DELETE CASCADE,
+	comment_id INT REFERENCES comments(comment_id) ON DELETE CASCADE,
+	title VARCHAR(100),
+	body TEXT NOT NULL,
+	editor_id INT NOT NULL REFERENCES users(id),
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	CHECK ((thread_id IS NULL) <> (comment_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS post_revisions_thread_idx ON post_revisions (thread_id);
+CREATE INDEX IF NOT EXISTS post_revisions_comment_idx ON post_revisions (comment_id);
+
+END;
@@ -0,0 +1,7 @@
+-- add_locked_bool_to_threads (2026-10-18)
+
+BEGIN;
+
+ALTER TABLE threads DROP COLUMN locked;
+
+END;
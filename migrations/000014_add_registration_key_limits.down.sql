@@ -0,0 +1,13 @@
+-- add_registration_key_limits (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS registration_key_uses;
+
+ALTER TABLE registration_keys
+DROP COLUMN expires_at,
+DROP COLUMN max_uses,
+DROP COLUMN use_count,
+DROP COLUMN created_by;
+
+END;
@@ -0,0 +1,25 @@
+-- add_registration_key_limits (2026-10-18)
+-- Registration keys can now be used up to max_uses times before they expire.
+-- Every use is recorded in registration_key_uses. The used and used_by columns
+-- are kept up to date (used_by is the most recent user) for older queries.
+BEGIN;
+
+ALTER TABLE registration_keys
+ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+ADD COLUMN max_uses INT NOT NULL DEFAULT 1,
+ADD COLUMN use_count INT NOT NULL DEFAULT 0,
+ADD COLUMN created_by INT REFERENCES users(id) DEFAULT NULL;
+
+UPDATE registration_keys SET use_count = 1 WHERE used;
+
+CREATE TABLE IF NOT EXISTS registration_key_uses (
+	reg_key VARCHAR(14) NOT NULL REFERENCES registration_keys(reg_key) ON DELETE CASCADE,
+	user_id INT NOT NULL REFERENCES users(id),
+	used_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (reg_key, user_id)
+);
+
+INSERT INTO registration_key_uses (reg_key, user_id)
+SELECT reg_key, used_by FROM registration_keys WHERE used_by IS NOT NULL;
+
+END;
@@ -0,0 +1,7 @@
+-- add_sessions (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS sessions;
+
+END;
@@ -0,0 +1,19 @@
+-- add_sessions (2026-10-18)
+-- Every JWT is issued for a session identified by its jti claim. Requests are
+-- only authorized while the session hasn't been revoked or expired.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS sessions (
+	session_id VARCHAR(32) PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip_address TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	revoked_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+END;
@@ -0,0 +1,7 @@
+-- add_refresh_tokens (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS refresh_tokens;
+
+END;
@@ -0,0 +1,16 @@
+-- add_refresh_tokens (2026-10-18)
+-- Refresh tokens are single-use and stored as SHA-256 hashes. A used token is
+-- kept (with used_at set) so it can be recognized if it's presented again.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash BYTEA PRIMARY KEY,
+	session_id VARCHAR(32) NOT NULL REFERENCES sessions(session_id) ON DELETE CASCADE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+END;
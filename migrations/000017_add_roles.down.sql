@@ -0,0 +1,14 @@
+-- add_roles (2026-10-18)
+
+BEGIN;
+
+ALTER TABLE categories
+DROP COLUMN min_thread_role,
+DROP COLUMN min_comment_role;
+
+ALTER TABLE users DROP COLUMN is_admin;
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN DEFAULT FALSE;
+UPDATE users SET is_admin = TRUE WHERE role = 'admin';
+ALTER TABLE users DROP COLUMN role;
+
+END;
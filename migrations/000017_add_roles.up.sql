@@ -0,0 +1,22 @@
+-- add_roles (2026-10-18)
+-- Users have a role instead of just an admin flag. is_admin is kept as a
+-- generated column so existing queries reading it keep working.
+-- Categories can require a minimum role to create threads or comment in them.
+BEGIN;
+
+ALTER TABLE users
+ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member'
+	CHECK (role IN ('admin', 'moderator', 'member', 'read-only'));
+
+UPDATE users SET role = 'admin' WHERE is_admin;
+
+ALTER TABLE users DROP COLUMN is_admin;
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN GENERATED ALWAYS AS (role = 'admin') STORED;
+
+ALTER TABLE categories
+ADD COLUMN min_thread_role VARCHAR(16) NOT NULL DEFAULT 'member'
+	CHECK (min_thread_role IN ('admin', 'moderator', 'member', 'read-only')),
+ADD COLUMN min_comment_role VARCHAR(16) NOT NULL DEFAULT 'member'
+	CHECK (min_comment_role IN ('admin', 'moderator', 'member', 'read-only'));
+
+END;
@@ -0,0 +1,7 @@
+-- add_password_reset_tokens (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS password_reset_tokens;
+
+END;
@@ -0,0 +1,15 @@
+-- add_password_reset_tokens (2026-10-18)
+-- Password reset tokens are single-use and stored as SHA-256 hashes.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	token_hash BYTEA PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS password_reset_tokens_user_id_idx ON password_reset_tokens (user_id);
+
+END;
@@ -0,0 +1,7 @@
+-- add_email_change_tokens (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS email_change_tokens;
+
+END;
@@ -0,0 +1,17 @@
+-- add_email_change_tokens (2026-10-18)
+-- A new email address is only saved once it's confirmed using a token sent to
+-- it. Tokens are single-use and stored as SHA-256 hashes.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS email_change_tokens (
+	token_hash BYTEA PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	new_email VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_change_tokens_user_id_idx ON email_change_tokens (user_id);
+
+END;
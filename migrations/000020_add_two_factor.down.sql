@@ -0,0 +1,14 @@
+-- add_two_factor (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS site_settings;
+DROP TABLE IF EXISTS two_factor_challenges;
+DROP TABLE IF EXISTS recovery_codes;
+
+ALTER TABLE users
+	DROP COLUMN IF EXISTS totp_last_step,
+	DROP COLUMN IF EXISTS totp_enabled_at,
+	DROP COLUMN IF EXISTS totp_secret;
+
+END;
@@ -0,0 +1,38 @@
+-- add_two_factor (2026-10-18)
+-- TOTP two-factor authentication. totp_secret is set when a user starts
+-- enrolling, and totp_enabled_at once they've verified a code with it.
+-- totp_last_step is the time step of the last code used, so codes can't be
+-- replayed. Recovery codes and login challenges are stored as SHA-256 hashes.
+BEGIN;
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS totp_secret BYTEA DEFAULT NULL,
+	ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+	ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	code_hash BYTEA NOT NULL,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	used_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+	PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_challenges (
+	token_hash BYTEA PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	attempts INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS site_settings (
+	name VARCHAR(100) PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+INSERT INTO site_settings (name, value) VALUES ('require_admin_two_factor', 'false')
+ON CONFLICT (name) DO NOTHING;
+
+END;
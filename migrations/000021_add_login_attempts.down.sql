@@ -0,0 +1,7 @@
+-- add_login_attempts (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS login_attempts;
+
+END;
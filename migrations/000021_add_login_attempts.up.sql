@@ -0,0 +1,22 @@
+-- add_login_attempts (2026-10-18)
+-- Every login attempt is recorded, both to throttle repeated failures for a
+-- username or IP address and as an audit trail for admins. The username is
+-- stored as entered since it may not belong to an account.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	attempt_id BIGSERIAL PRIMARY KEY,
+	username VARCHAR(100) NOT NULL,
+	user_id INT REFERENCES users(id) ON DELETE SET NULL,
+	ip_address TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	succeeded BOOLEAN NOT NULL,
+	reason VARCHAR(32) NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON login_attempts (username, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_address_idx ON login_attempts (ip_address, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts (created_at);
+
+END;
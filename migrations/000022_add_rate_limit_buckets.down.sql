@@ -0,0 +1,7 @@
+-- add_rate_limit_buckets (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS rate_limit_buckets;
+
+END;
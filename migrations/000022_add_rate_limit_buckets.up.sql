@@ -0,0 +1,15 @@
+-- add_rate_limit_buckets (2026-10-18)
+-- Token buckets for rate limits, so limits survive restarts. full_at is when
+-- the bucket will have refilled, after which the row can be deleted.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+	bucket_key TEXT PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	full_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limit_buckets_full_at_idx ON rate_limit_buckets (full_at);
+
+END;
@@ -0,0 +1,7 @@
+-- add_api_tokens (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS api_tokens;
+
+END;
@@ -0,0 +1,21 @@
+-- add_api_tokens (2026-10-18)
+-- Personal API tokens let scripts and bots authenticate with an
+-- Authorization header instead of logging in. Only a hash of each token is
+-- stored, and its scope caps what the token can do on the user's behalf.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+	token_id SERIAL PRIMARY KEY,
+	token_hash BYTEA NOT NULL UNIQUE,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name VARCHAR(100) NOT NULL,
+	scope VARCHAR(16) NOT NULL CHECK (scope IN ('read', 'post', 'admin')),
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+	revoked_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
+
+END;
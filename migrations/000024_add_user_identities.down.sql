@@ -0,0 +1,8 @@
+-- add_user_identities (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS oidc_login_states;
+DROP TABLE IF EXISTS user_identities;
+
+END;
@@ -0,0 +1,30 @@
+-- add_user_identities (2026-10-18)
+-- Users can log in with an OpenID Connect provider. Each external identity,
+-- identified by the provider's issuer and the subject it assigned the user,
+-- is linked to at most one account, and each account to at most one
+-- identity per provider. oidc_login_states holds the state, nonce and PKCE
+-- verifier of logins that are waiting for the provider to redirect back.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS user_identities (
+	identity_id SERIAL PRIMARY KEY,
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	email VARCHAR(255) NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	last_login_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+	UNIQUE (issuer, subject),
+	UNIQUE (user_id, issuer)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+	state_hash BYTEA PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	code_verifier TEXT NOT NULL,
+	reg_key VARCHAR(14) DEFAULT NULL,
+	link_user_id INT REFERENCES users(id) ON DELETE CASCADE DEFAULT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+END;
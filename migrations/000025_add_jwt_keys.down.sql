@@ -0,0 +1,7 @@
+-- add_jwt_keys (2026-10-18)
+
+BEGIN;
+
+DROP TABLE IF EXISTS jwt_keys;
+
+END;
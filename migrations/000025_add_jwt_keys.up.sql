@@ -0,0 +1,18 @@
+-- add_jwt_keys (2026-10-18)
+-- The secrets JWTs are signed with when they're kept in the database rather
+-- than passed in by the environment. The first server to start generates the
+-- current secret, and retired secrets are still accepted for a while so
+-- rotating the secret doesn't log everyone out.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS jwt_keys (
+	key_id SERIAL PRIMARY KEY,
+	secret BYTEA NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	retired_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+-- Only one secret can be current at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS jwt_keys_current_idx ON jwt_keys ((retired_at IS NULL)) WHERE retired_at IS NULL;
+
+END;
@@ -0,0 +1,7 @@
+-- add_user_bans (2026-10-18)
+
+BEGIN;
+
+ALTER TABLE users DROP COLUMN IF EXISTS banned_at;
+
+END;
@@ -0,0 +1,8 @@
+-- add_user_bans (2026-10-18)
+-- Banned users can't log in, and anything they were already logged in with
+-- only gets read-only access.
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+
+END;
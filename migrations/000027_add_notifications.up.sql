@@ -0,0 +1,22 @@
+-- add_notifications (2026-10-18)
+-- Notifications tell users about activity that involves them: a reply to one
+-- of their comments, a comment on one of their threads, or a mention. A
+-- user gets at most one notification per post. comment_id is NULL for
+-- mentions in a thread's opening post.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS notifications (
+	notification_id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	kind VARCHAR(16) NOT NULL CHECK (kind IN ('reply', 'thread_comment', 'mention')),
+	actor_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	thread_id INT NOT NULL REFERENCES threads(thread_id) ON DELETE CASCADE,
+	comment_id INT REFERENCES comments(comment_id) ON DELETE CASCADE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	read_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+
+END;
@@ -0,0 +1,21 @@
+-- add_mentions (2026-10-18)
+-- Mentions are the users mentioned with @username in a post, resolved to their
+-- IDs when the post is saved. Exactly one of thread_id, for a thread's opening
+-- post, and comment_id is set. username is the name as it was written.
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS mentions (
+	mention_id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	thread_id INT REFERENCES threads(thread_id) ON DELETE CASCADE,
+	comment_id INT REFERENCES comments(comment_id) ON DELETE CASCADE,
+	username VARCHAR(100) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	CHECK (num_nonnulls(thread_id, comment_id) = 1),
+	UNIQUE (thread_id, user_id),
+	UNIQUE (comment_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS mentions_user_id_idx ON mentions (user_id, created_at DESC);
+
+END;
@@ -17,24 +17,58 @@ function formatLocalTimestamps() {
 
 document.addEventListener('DOMContentLoaded', formatLocalTimestamps);
 
+document.addEventListener('DOMContentLoaded', function() {
+    document.getElementById('logoutLink')?.addEventListener('click', function(event) {
+        event.preventDefault();
+        jsonPost("/api/logout", null, "Logout failed!", "/login");
+    });
+});
+
 function jsonPost(path, data, error, redir = null) {
+    return jsonRequest("POST", path, data, error, redir)
+}
+
+// csrfToken returns the token that has to be sent in the X-CSRF-Token header
+// with every request that isn't a GET.
+function csrfToken() {
+    return document.getElementById('csrfToken')?.value ?? "";
+}
+
+// problemDetail returns the detail of an error response from the API, or an
+// empty string if it doesn't have one.
+function problemDetail(response) {
+    if (response.headers.get("Content-Type") !== "application/problem+json") {
+        return Promise.resolve("");
+    }
+    return response.json().then(problem => problem.detail ?? "", () => "");
+}
+
+function jsonRequest(method, path, data, error, redir = null) {
     options = {
-        method: "POST",
+        method: method,
         headers: {
-        Accept: "application/json, text/plain, */*",
+        Accept: "application/json, application/problem+json, text/plain, */*",
         "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken(),
         },
-        body: JSON.stringify(data)
+    }
+    if (data != null) {
+        options.body = JSON.stringify(data)
     }
     return fetch(path, options)
         .then(response => {
             if (!response.ok) {
-                alert(error)
-                throw new Error(`HTTP error! status: ${response.status}`);
+                return problemDetail(response).then(detail => {
+                    alert(detail ? `${error}: ${detail}` : error)
+                    throw new Error(`HTTP error! status: ${response.status}`);
+                });
             } else {
                 if (redir != null) {
                     window.location.href = redir
                 }
+                if (response.status === 204) {
+                    return null;
+                }
                 return response.json();
             }
         })